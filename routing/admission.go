@@ -0,0 +1,125 @@
+package routing
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ADMISSION_ERR = errors.New("node not admitted")
+)
+
+// AdmissionPolicy decides which nodes may enter the table,
+// an error with ADMISSION_ERR as cause keeps n out
+type AdmissionPolicy interface {
+	Admit(n *Node) error
+}
+
+// PuzzlePolicy admits the node ids solving the static puzzle of
+// S/Kademlia: the sha256 of the id starts with Difficulty zero bits.
+// The node must have a record and its id be the hash of the public
+// key of the record, so that a key must be ground to get an id, see
+// GeneratePuzzleKey
+type PuzzlePolicy struct {
+	Difficulty int
+}
+
+func (p PuzzlePolicy) Admit(n *Node) error {
+	if n.Record == nil {
+		return errors.Wrap(ADMISSION_ERR, "no record to derive the id from")
+	}
+	if !IDFromPubKey(n.Record.PubKey, len(n.GetID())).Equal(n.GetID()) {
+		return errors.Wrap(ADMISSION_ERR, "id not derived from the key of the record")
+	}
+	if !SolvesPuzzle(n.GetID(), p.Difficulty) {
+		return errors.Wrapf(ADMISSION_ERR, "id doesn't solve the puzzle of %v bits", p.Difficulty)
+	}
+	return nil
+}
+
+// SolvesPuzzle reports whether the sha256 of id starts with difficulty zero bits
+func SolvesPuzzle(id Hash, difficulty int) bool {
+	sum := sha256.Sum256(id)
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 || zeros >= difficulty {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// GeneratePuzzleKey generates keys until the id derived from one,
+// of hashLength bytes, solves the puzzle of difficulty bits.
+// It takes 2^difficulty keys on average
+func GeneratePuzzleKey(scheme string, difficulty, hashLength int) (PrivKey, error) {
+	for {
+		key, err := GenerateKey(scheme)
+		if err != nil {
+			return nil, err
+		}
+		if SolvesPuzzle(IDFromPubKey(key.PubKey(), hashLength), difficulty) {
+			return key, nil
+		}
+	}
+}
+
+// ValidatorOracle is supplied by the chain to vouch for nodes,
+// as validators or as nodes with enough stake for instance.
+// pubKey is the key of the record of the node, nil without one
+type ValidatorOracle interface {
+	Vouches(id Hash, pubKey []byte) bool
+}
+
+// OraclePolicy admits the nodes its oracle vouches for
+type OraclePolicy struct {
+	Oracle ValidatorOracle
+}
+
+func (p OraclePolicy) Admit(n *Node) error {
+	var pub []byte
+	if r := n.GetRecord(); r != nil {
+		pub = r.PubKey
+	}
+	if !p.Oracle.Vouches(n.GetID(), pub) {
+		return errors.Wrap(ADMISSION_ERR, "not vouched for by the oracle")
+	}
+	return nil
+}
+
+// AnyPolicy admits the nodes one of its policies admits,
+// the error of the last policy is returned for the others
+type AnyPolicy []AdmissionPolicy
+
+func (ps AnyPolicy) Admit(n *Node) error {
+	err := ADMISSION_ERR
+	for _, p := range ps {
+		if err = p.Admit(n); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkAdmission applies the admission policy of the config,
+// bootnodes are trusted
+func (t *Table) checkAdmission(n *Node) error {
+	if t.cfg.admission == nil || t.isBootnode(n.GetID()) {
+		return nil
+	}
+	if err := t.cfg.admission.Admit(n); err != nil {
+		atomic.AddUint64(&t.admissionRejected, 1)
+		return err
+	}
+	return nil
+}
+
+// AdmissionRejected returns the number of nodes kept out
+// of the table by the admission policy
+func (t *Table) AdmissionRejected() uint64 {
+	return atomic.LoadUint64(&t.admissionRejected)
+}
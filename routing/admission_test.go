@@ -0,0 +1,127 @@
+package routing
+
+import (
+	ctx "context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPuzzle(t *testing.T) {
+	assert.True(t, SolvesPuzzle(randHashForTest(), 0))
+	key, err := GeneratePuzzleKey(SchemeEd25519, 8, DefaultHashLength)
+	require.Nil(t, err)
+	id := IDFromPubKey(key.PubKey(), DefaultHashLength)
+	assert.True(t, SolvesPuzzle(id, 8))
+	solved := NewNodeFromRecord(signedRecordForTest(t, key, 1, "1.2.3.4:30303"))
+	assert.Nil(t, PuzzlePolicy{8}.Admit(solved))
+
+	// the id must be the one of the key of a record
+	err = PuzzlePolicy{8}.Admit(NewNode(id, "1.2.3.4:30303"))
+	assert.Equal(t, ADMISSION_ERR, errors.Cause(err))
+	other := recordNodeForTest(t)
+	other.ID = id
+	err = PuzzlePolicy{8}.Admit(other)
+	assert.Equal(t, ADMISSION_ERR, errors.Cause(err))
+
+	for SolvesPuzzle(solved.ID, 16) {
+		key, err = GenerateKey(SchemeEd25519)
+		require.Nil(t, err)
+		solved = NewNodeFromRecord(signedRecordForTest(t, key, 1, "1.2.3.4:30303"))
+	}
+	err = PuzzlePolicy{16}.Admit(solved)
+	assert.Equal(t, ADMISSION_ERR, errors.Cause(err))
+}
+
+// oracleForTest vouches for the ids of the set
+type oracleForTest map[HashKey]bool
+
+func (o oracleForTest) Vouches(id Hash, pubKey []byte) bool {
+	return o[id.AsKey()]
+}
+
+// nodesTransport answers every findnode with nodes
+type nodesTransport struct {
+	deadTransport
+	nodes []INode
+}
+
+func (nt nodesTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	return nt.nodes, nil
+}
+
+// valueNodesTransport answers every findvalue with nodes,
+// the addresses asked are recorded
+type valueNodesTransport struct {
+	nodesTransport
+	asked *sync.Map
+}
+
+func (vt valueNodesTransport) Store(cctx ctx.Context, addr string, key Hash, value []byte, ttl time.Duration) error {
+	return nil
+}
+
+func (vt valueNodesTransport) FindValue(cctx ctx.Context, addr string, key Hash) (*ValueReply, error) {
+	vt.asked.Store(addr, true)
+	return &ValueReply{Nodes: vt.nodes}, nil
+}
+
+func TestAdmission(t *testing.T) {
+	initTest()
+	key, err := GeneratePuzzleKey(SchemeEd25519, 8, DefaultHashLength)
+	require.Nil(t, err)
+	solved := NewNodeFromRecord(signedRecordForTest(t, key, 1, genIPForTest(1)))
+	unsolved := recordNodeForTest(t)
+	for SolvesPuzzle(unsolved.ID, 8) {
+		unsolved = recordNodeForTest(t)
+	}
+	vouched := NewNode(randHashForTest(), genIPForTest(2))
+	boot := NewNode(randHashForTest(), genIPForTest(3))
+
+	cfg := DefaultConfig()
+	cfg.Admission = AnyPolicy{PuzzlePolicy{8}, OraclePolicy{oracleForTest{vouched.ID.AsKey(): true}}}
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", []INode{boot}, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	assert.NotNil(t, tab.getNodeLocally(boot.ID), "bootnodes are trusted")
+
+	for _, n := range []*Node{solved, vouched} {
+		require.Nil(t, tab.add(n))
+		assert.NotNil(t, tab.getNodeLocally(n.ID))
+	}
+	assert.NotNil(t, tab.db.getNode(solved.ID))
+
+	err = tab.add(unsolved)
+	assert.Equal(t, ADMISSION_ERR, errors.Cause(err))
+	assert.Nil(t, tab.getNodeLocally(unsolved.ID))
+	assert.Nil(t, tab.db.getNode(unsolved.ID), "refused node stored")
+	assert.Equal(t, uint64(1), tab.AdmissionRejected())
+
+	// inbound requests and the replies of lookups
+	assert.NotNil(t, tab.OnReceiveReq(unsolved))
+	assert.Nil(t, tab.db.nodeStats(unsolved.ID))
+	other := NewNode(randHashForTest(), genIPForTest(4))
+	for SolvesPuzzle(other.ID, 8) {
+		other.ID = randHashForTest()
+	}
+	tab.net = nodesTransport{nodes: []INode{unsolved, other}}
+	reply := make(chan []*Node, 1)
+	tab.findNodeCallback(ctx.Background(), boot, randHashForTest(), reply, nil)
+	assert.Len(t, <-reply, 0)
+	assert.Equal(t, uint64(4), tab.AdmissionRejected())
+	assert.Nil(t, tab.db.getNode(unsolved.ID))
+
+	// and of value lookups, which don't query them
+	vt := valueNodesTransport{nodesTransport: nodesTransport{nodes: []INode{unsolved, other}}, asked: &sync.Map{}}
+	_, err = tab.getValueByNet(vt, randHashForTest())
+	assert.NotNil(t, err)
+	for _, n := range []*Node{unsolved, other} {
+		_, asked := vt.asked.Load(n.Addr)
+		assert.False(t, asked, "refused node queried")
+		assert.Nil(t, tab.getNodeLocally(n.ID))
+	}
+}
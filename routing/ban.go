@@ -0,0 +1,215 @@
+package routing
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	BANNED_ERR      = errors.New("node banned")
+	NOT_ALLOWED_ERR = errors.New("node not in the allow list")
+	BAN_ERR         = errors.New("ban needs exactly one of id, address or cidr")
+)
+
+// Ban keeps the nodes it matches out of the table until it expires
+type Ban struct {
+	ID      Hash      `json:",omitempty"` // the node with this id
+	Addr    string    `json:",omitempty"` // nodes at this ip, or at this ip:port
+	CIDR    string    `json:",omitempty"` // nodes in this ip range
+	Expires time.Time // zero for a ban that never expires
+	Reason  string
+}
+
+// Key identifies the target of the ban,
+// a new ban replaces the one with its key
+func (b *Ban) Key() string {
+	switch {
+	case len(b.ID) != 0:
+		return fmt.Sprintf("id:%x", []byte(b.ID))
+	case b.Addr != "":
+		return "addr:" + b.Addr
+	default:
+		return "cidr:" + b.CIDR
+	}
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !b.Expires.After(now)
+}
+
+// BanStore is implemented by node stores able to keep bans,
+// with other stores the bans are lost on restart
+type BanStore interface {
+	PutBan(b *Ban) error
+	DeleteBan(key string) error
+	Bans() []*Ban
+}
+
+type banRule struct {
+	*Ban
+	ip    net.IP     // set when Addr is an ip without port
+	ipnet *net.IPNet // set for a CIDR ban
+}
+
+func newBanRule(b *Ban) (*banRule, error) {
+	targets := 0
+	for _, set := range []bool{len(b.ID) != 0, b.Addr != "", b.CIDR != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return nil, BAN_ERR
+	}
+	r := &banRule{Ban: b, ip: net.ParseIP(b.Addr)}
+	if b.CIDR != "" {
+		_, ipnet, err := net.ParseCIDR(b.CIDR)
+		if err != nil {
+			return nil, errors.Wrap(BAN_ERR, err.Error())
+		}
+		r.ipnet = ipnet
+	}
+	return r, nil
+}
+
+func (r *banRule) match(n *Node) bool {
+	if len(r.ID) != 0 {
+		return r.ID.Equal(n.GetID())
+	}
+	host, _, err := net.SplitHostPort(n.GetAddr())
+	if err != nil {
+		host = n.GetAddr()
+	}
+	switch {
+	case r.ipnet != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipnet.Contains(ip)
+	case r.ip != nil:
+		return r.ip.Equal(net.ParseIP(host))
+	default:
+		return r.Addr == n.GetAddr()
+	}
+}
+
+// banList holds the bans of a table and its allow list
+type banList struct {
+	mutex sync.Mutex
+	rules map[string]*banRule
+	allow map[HashKey]struct{} // nil when every id is allowed
+}
+
+func newBanList(allow []Hash, bans []*Ban, now time.Time) *banList {
+	l := &banList{rules: make(map[string]*banRule)}
+	if len(allow) != 0 {
+		l.allow = make(map[HashKey]struct{}, len(allow))
+		for _, id := range allow {
+			l.allow[id.AsKey()] = struct{}{}
+		}
+	}
+	for _, b := range bans {
+		if b.expired(now) {
+			continue
+		}
+		r, err := newBanRule(b)
+		if err != nil {
+			log.Println("Failed to load ban", "key", b.Key(), "err", err)
+			continue
+		}
+		l.rules[b.Key()] = r
+	}
+	return l
+}
+
+// checkBan returns NOT_ALLOWED_ERR or BANNED_ERR
+// when n must be kept out of the table
+func (t *Table) checkBan(n *Node) error {
+	now := t.cfg.clock.Now()
+	var expired []string
+	t.bans.mutex.Lock()
+	defer func() {
+		t.bans.mutex.Unlock()
+		for _, key := range expired {
+			t.db.deleteBan(key)
+		}
+	}()
+	if t.bans.allow != nil {
+		if _, ok := t.bans.allow[n.GetID().AsKey()]; !ok {
+			return NOT_ALLOWED_ERR
+		}
+	}
+	for key, r := range t.bans.rules {
+		if r.expired(now) {
+			delete(t.bans.rules, key)
+			expired = append(expired, key)
+			continue
+		}
+		if r.match(n) {
+			return BANNED_ERR
+		}
+	}
+	return nil
+}
+
+// Ban keeps the nodes matched by b out of the table and drops
+// the ones in it. Bans are kept in the node database when its
+// store is a BanStore
+func (t *Table) Ban(b Ban) error {
+	if len(b.ID) != 0 {
+		b.ID = ToHashN(b.ID, len(b.ID))
+	}
+	r, err := newBanRule(&b)
+	if err != nil {
+		return err
+	}
+	t.bans.mutex.Lock()
+	t.bans.rules[b.Key()] = r
+	t.bans.mutex.Unlock()
+	if err := t.db.putBan(&b); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, bk := range t.buckets {
+		for _, n := range append([]*Node{}, bk.entries...) {
+			if r.match(n) {
+				bk.entries = deleteNode(bk.entries, n)
+				t.removeIP(bk, n)
+				t.emit(TableEvent{Type: NodeRemoved, Node: n, Bucket: i})
+			}
+		}
+		for _, n := range append([]*Node{}, bk.replacements...) {
+			if r.match(n) {
+				bk.replacements = deleteNode(bk.replacements, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Unban lifts the ban with the target of b
+func (t *Table) Unban(b Ban) error {
+	t.bans.mutex.Lock()
+	delete(t.bans.rules, b.Key())
+	t.bans.mutex.Unlock()
+	return t.db.deleteBan(b.Key())
+}
+
+// Bans returns the bans not expired yet
+func (t *Table) Bans() []Ban {
+	now := t.cfg.clock.Now()
+	t.bans.mutex.Lock()
+	defer t.bans.mutex.Unlock()
+	bans := make([]Ban, 0, len(t.bans.rules))
+	for _, r := range t.bans.rules {
+		if !r.expired(now) {
+			bans = append(bans, *r.Ban)
+		}
+	}
+	return bans
+}
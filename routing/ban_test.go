@@ -0,0 +1,119 @@
+package routing
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanRule(t *testing.T) {
+	n := NewNode(ToHash([]byte{1}), "1.2.3.4:30303")
+	cases := []struct {
+		ban   Ban
+		match bool
+	}{
+		{Ban{ID: ToHash([]byte{1})}, true},
+		{Ban{ID: ToHash([]byte{2})}, false},
+		{Ban{Addr: "1.2.3.4"}, true},
+		{Ban{Addr: "1.2.3.4:30303"}, true},
+		{Ban{Addr: "1.2.3.4:30304"}, false},
+		{Ban{CIDR: "1.2.0.0/16"}, true},
+		{Ban{CIDR: "1.3.0.0/16"}, false},
+	}
+	for _, c := range cases {
+		r, err := newBanRule(&c.ban)
+		require.Nil(t, err, c.ban.Key())
+		assert.Equal(t, c.match, r.match(n), c.ban.Key())
+	}
+
+	for _, b := range []Ban{{}, {Addr: "1.2.3.4", CIDR: "1.2.0.0/16"}, {CIDR: "1.2.3.4"}} {
+		_, err := newBanRule(&b)
+		assert.Equal(t, BAN_ERR, errors.Cause(err), "%+v", b)
+	}
+}
+
+func TestBan(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	a := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	b := subnetNodeForTest(TEST_SELF_ID, 1, 2, "5.6.7.1:30303")
+	require.Nil(t, tab.add(a))
+	require.Nil(t, tab.add(b))
+
+	require.Nil(t, tab.Ban(Ban{ID: a.ID, Reason: "spam"}))
+	require.Nil(t, tab.Ban(Ban{CIDR: "5.6.0.0/16", Expires: clock.Now().Add(time.Hour)}))
+	assert.Equal(t, 0, tab.len(), "banned nodes kept")
+	assert.Len(t, tab.Bans(), 2)
+	assert.Equal(t, BANNED_ERR, tab.add(a))
+	assert.Equal(t, BANNED_ERR, tab.OnReceiveReq(b))
+	assert.Equal(t, BANNED_ERR, NewTableHandler(tab).HandlePing(b))
+
+	clock.Advance(time.Hour)
+	require.Nil(t, tab.add(b))
+	require.Len(t, tab.Bans(), 1)
+	assert.Equal(t, "spam", tab.Bans()[0].Reason)
+	assert.Len(t, tab.db.bans(), 1, "expired ban kept in the store")
+
+	require.Nil(t, tab.Unban(Ban{ID: a.ID}))
+	require.Nil(t, tab.add(a))
+	assert.Equal(t, 2, tab.len())
+	assert.Empty(t, tab.db.bans())
+}
+
+func TestBanPersisted(t *testing.T) {
+	initTest()
+	path, err := ioutil.TempDir("", tmpDBName)
+	require.Nil(t, err)
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, path, nil, nil)
+	require.Nil(t, err)
+	require.Nil(t, tab.Ban(Ban{Addr: "1.2.3.1", Reason: "invalid blocks"}))
+	tab.db.close()
+
+	tab, err = NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, path, nil, nil)
+	require.Nil(t, err)
+	defer tab.db.close()
+	require.Len(t, tab.Bans(), 1)
+	assert.Equal(t, "invalid blocks", tab.Bans()[0].Reason)
+	assert.Equal(t, BANNED_ERR, tab.add(subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")))
+}
+
+func TestBanInLookup(t *testing.T) {
+	initTest()
+	tsfer, allNodes := newDHTForTest(t, 20)
+	defer closeDHTForTest(tsfer)
+
+	tab := loadTableForTest(tsfer, allNodes[0])
+	banned := allNodes[len(allNodes)-1]
+	require.Nil(t, tab.Ban(Ban{ID: banned.GetID()}))
+	done := make(chan struct{})
+	tab.doRefresh(done)
+	assert.Nil(t, tab.getNodeLocally(banned.GetID()))
+	for _, n := range tab.GetNodesByNet(banned.GetID()) {
+		assert.False(t, n.ID.Equal(banned.GetID()), "banned node in the lookup result")
+	}
+}
+
+func TestAllowIDs(t *testing.T) {
+	initTest()
+	a := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	b := subnetNodeForTest(TEST_SELF_ID, 0, 2, "5.6.7.1:30303")
+	cfg := DefaultConfig()
+	cfg.AllowIDs = []Hash{a.ID}
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", []INode{a, b}, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	assert.Equal(t, 1, tab.BootstrapStatus().SeedsLoaded)
+	assert.NotNil(t, tab.getNodeLocally(a.ID))
+	assert.Equal(t, NOT_ALLOWED_ERR, tab.add(b))
+}
@@ -0,0 +1,99 @@
+package routing
+
+import (
+	ctx "context"
+	"sync"
+	"time"
+)
+
+// BootstrapStatus tells how far the table got into the network
+type BootstrapStatus struct {
+	SeedsLoaded        int       // db seeds and bootnodes put in the table by the last load
+	SeedLoads          int       // times the seeds were loaded, again each time the table went empty
+	Bootnodes          int       // bootnodes configured
+	BootnodesReachable int       // bootnodes that answered a findnode
+	FirstLookup        time.Time // when a lookup first got an answer, zero before
+	TableSize          int       // entries in the buckets
+}
+
+// Bootstrapped reports whether a lookup got an answer
+func (s BootstrapStatus) Bootstrapped() bool {
+	return !s.FirstLookup.IsZero()
+}
+
+type bootState struct {
+	mutex       sync.Mutex
+	seedsLoaded int
+	seedLoads   int
+	reached     map[HashKey]struct{}
+	firstLookup time.Time
+	ready       chan struct{} // closed with the first answer
+}
+
+func newBootState() *bootState {
+	return &bootState{
+		reached: make(map[HashKey]struct{}),
+		ready:   make(chan struct{}),
+	}
+}
+
+// BootstrapStatus returns the progress of the bootstrap
+func (t *Table) BootstrapStatus() BootstrapStatus {
+	t.boot.mutex.Lock()
+	st := BootstrapStatus{
+		SeedsLoaded:        t.boot.seedsLoaded,
+		SeedLoads:          t.boot.seedLoads,
+		Bootnodes:          len(t.nursery),
+		BootnodesReachable: len(t.boot.reached),
+		FirstLookup:        t.boot.firstLookup,
+	}
+	t.boot.mutex.Unlock()
+	st.TableSize = t.len()
+	return st
+}
+
+// WaitBootstrapped blocks until a lookup of the table got an answer,
+// cctx being done or the table closing
+func (t *Table) WaitBootstrapped(cctx ctx.Context) error {
+	select {
+	case <-t.boot.ready:
+		return nil
+	case <-t.closed:
+		return TABLE_CLOSED_ERR
+	case <-cctx.Done():
+		return cctx.Err()
+	}
+}
+
+// bootAnswered records a findnode answered by from
+func (t *Table) bootAnswered(from *Node) {
+	t.boot.mutex.Lock()
+	defer t.boot.mutex.Unlock()
+	for _, n := range t.nursery {
+		if n.GetID().Equal(from.GetID()) {
+			t.boot.reached[from.GetID().AsKey()] = struct{}{}
+			break
+		}
+	}
+	if t.boot.firstLookup.IsZero() {
+		t.boot.firstLookup = t.cfg.clock.Now()
+		close(t.boot.ready)
+	}
+}
+
+func (t *Table) bootLoaded(seeds int) {
+	t.boot.mutex.Lock()
+	t.boot.seedsLoaded = seeds
+	t.boot.seedLoads++
+	t.boot.mutex.Unlock()
+}
+
+// len returns the number of entries in the buckets
+func (t *Table) len() (n int) {
+	t.mutex.Lock()
+	for _, b := range t.buckets {
+		n += len(b.entries)
+	}
+	t.mutex.Unlock()
+	return n
+}
@@ -0,0 +1,61 @@
+package routing
+
+import (
+	ctx "context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapStatus(t *testing.T) {
+	initTest()
+	tsfer := &TransferForTest{}
+	nodes := genBootNodes(8)
+	tsfer.fillSpecificData(t, nodes, 3)
+	defer closeDHTForTest(tsfer)
+	tab := loadTableForTest(tsfer, nodes[0])
+
+	st := tab.BootstrapStatus()
+	assert.Equal(t, 3, st.Bootnodes)
+	assert.Equal(t, 3, st.SeedsLoaded)
+	assert.Equal(t, 1, st.SeedLoads)
+	assert.Equal(t, 3, st.TableSize)
+	assert.False(t, st.Bootstrapped())
+	wctx, cancel := ctx.WithTimeout(ctx.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, ctx.DeadlineExceeded, tab.WaitBootstrapped(wctx))
+
+	done := make(chan struct{})
+	tab.doRefresh(done)
+	require.Nil(t, tab.WaitBootstrapped(ctx.Background()))
+	st = tab.BootstrapStatus()
+	assert.True(t, st.Bootstrapped())
+	assert.True(t, st.BootnodesReachable > 0 && st.BootnodesReachable <= 3, "reachable %v", st.BootnodesReachable)
+	assert.True(t, st.TableSize > 3, "table size %v", st.TableSize)
+}
+
+func TestBootstrapRetry(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.MaxFindFailures = 1
+	bootnodes := []INode{farNodeForTest(TEST_SELF_ID, 1), farNodeForTest(TEST_SELF_ID, 2)}
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", bootnodes, cfg)
+	require.Nil(t, err)
+	tab.Start()
+
+	// the first refresh drops the dead bootnodes
+	require.Eventually(t, func() bool { return tab.len() == 0 }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		clock.Advance(cfg.BootstrapRetry)
+		return tab.BootstrapStatus().SeedLoads > 1
+	}, time.Second, 10*time.Millisecond, "seeds never reloaded")
+	assert.Equal(t, 2, tab.BootstrapStatus().SeedsLoaded)
+	assert.False(t, tab.BootstrapStatus().Bootstrapped())
+
+	tab.Stop()
+	assert.Equal(t, TABLE_CLOSED_ERR, tab.WaitBootstrapped(ctx.Background()))
+}
@@ -0,0 +1,163 @@
+package routing
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// manualClockForTest only moves on Advance
+type manualClockForTest struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*manualTimerForTest
+}
+
+type manualTimerForTest struct {
+	clock  *manualClockForTest
+	when   time.Time
+	period time.Duration
+	active bool
+	c      chan time.Time
+}
+
+func newManualClockForTest() *manualClockForTest {
+	return &manualClockForTest{now: time.Unix(1000000, 0)}
+}
+
+func (c *manualClockForTest) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClockForTest) newTimer(d, period time.Duration) *manualTimerForTest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &manualTimerForTest{clock: c, when: c.now.Add(d), period: period, active: true, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *manualClockForTest) NewTimer(d time.Duration) Timer { return c.newTimer(d, 0) }
+
+func (c *manualClockForTest) NewTicker(d time.Duration) Ticker {
+	return manualTickerForTest{c.newTimer(d, d)}
+}
+
+func (c *manualClockForTest) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		for t.active && !t.when.After(c.now) {
+			select {
+			case t.c <- t.when:
+			default:
+			}
+			if t.period == 0 {
+				t.active = false
+			} else {
+				t.when = t.when.Add(t.period)
+			}
+		}
+	}
+}
+
+func (t *manualTimerForTest) C() <-chan time.Time { return t.c }
+
+func (t *manualTimerForTest) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *manualTimerForTest) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	return active
+}
+
+type manualTickerForTest struct {
+	*manualTimerForTest
+}
+
+func (t manualTickerForTest) Stop() { t.manualTimerForTest.Stop() }
+
+func TestClockExpiration(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	n := NewNode(randHashForTest(), "10.0.0.1:30303")
+	require.Nil(t, tab.db.updateNode(n))
+	require.Nil(t, tab.db.updateLastPongReceived(n.GetID(), clock.Now()))
+	require.Nil(t, tab.db.putValue(n.GetID(), []byte("v"), clock.Now().Add(2*time.Hour), true))
+	assert.Len(t, tab.db.querySeeds(10, time.Hour), 1)
+
+	clock.Advance(3 * time.Hour)
+	assert.Nil(t, tab.db.getValue(n.GetID()), "value outlived its ttl")
+	assert.Len(t, tab.db.querySeeds(10, time.Hour), 0, "seed older than max age")
+	assert.Len(t, tab.db.querySeeds(10, 4*time.Hour), 1)
+	assert.NotNil(t, tab.db.getNode(n.GetID()))
+
+	// days later, the expirer drops the node
+	clock.Advance(2 * 24 * time.Hour)
+	require.Eventually(t, func() bool {
+		// ticks are dropped while the expirer is busy
+		clock.Advance(cfg.CleanupCycle)
+		return tab.db.getNode(n.GetID()) == nil
+	}, time.Second, time.Millisecond, "node not expired")
+}
+
+func TestClockAddTime(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	n := NewNode(randHashForTest(), "10.0.0.1:30303")
+	require.Nil(t, tab.add(n))
+	assert.Equal(t, clock.Now(), tab.getNodeLocally(n.GetID()).AddedAt())
+}
+
+func TestRandSource(t *testing.T) {
+	initTest()
+	newTab := func() *Table {
+		cfg := DefaultConfig()
+		cfg.Rand = rand.New(rand.NewSource(7))
+		tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+		require.Nil(t, err, "new table err")
+		return tab
+	}
+	t1, t2 := newTab(), newTab()
+	defer t1.db.close()
+	defer t2.db.close()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, t1.nextRevalidateTime(), t2.nextRevalidateTime())
+	}
+
+	// a source running dry doesn't stop the table
+	cfg := DefaultConfig()
+	cfg.Rand = bytes.NewReader(nil)
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	tab.db.close()
+}
@@ -1,11 +1,196 @@
 package routing
 
 import (
+	crand "crypto/rand"
+	"io"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// DefaultHashLength is the length of hashes made by ToHash and NewHash
+const DefaultHashLength = 40
+
+var (
+	CONFIG_ERR = errors.New("invalid routing config")
+)
+
+// Config holds the parameters of one Table,
+// tables with different configs can live in the same process
+type Config struct {
+	HashLength         int           // bytes of a node id
+	Alpha              int           // concurrent queries of one lookup, or of each of its paths
+	DisjointPaths      int           // lookup paths never asking the same node, 1 for the plain lookup
+	BucketSize         int           // entries kept in a bucket
+	FindSize           int           // nodes returned by a lookup
+	MaxReplacements    int           // replacements kept in a bucket
+	MaxFindFailures    int           // failed findnodes before a node is dropped
+	SeedCount          int           // nodes loaded from db on start
+	SeedMaxAge         time.Duration // seeds not seen for longer are skipped
+	RefreshInterval    time.Duration
+	RevalidateInterval time.Duration
+	NodeExpiration     time.Duration // time after which an unseen node is dropped from db
+	CleanupCycle       time.Duration // time period for running the db expiration
+	RepublishInterval  time.Duration // time period for republishing our own values
+	MaxValueSize       int           // bytes of the biggest value accepted
+	MaxValueTTL        time.Duration // values from remote nodes are kept at most for it
+	MaxRemoteValues    int           // values of remote nodes kept at most
+	MaxRemoteBytes     int           // bytes of the values of remote nodes kept at most
+	BootstrapRetry     time.Duration // time period for reloading the seeds while the table is empty
+	BucketIPLimit      int           // entries of a bucket in the same /24 or /64, 0 for no limit
+	TableIPLimit       int           // entries of the table in the same /24 or /64, 0 for no limit
+	MinQueryTimeout    time.Duration // bounds of the adaptive findnode timeout of latency aware lookups
+	MaxQueryTimeout    time.Duration
+
+	// AddrRateLimit, IDRateLimit and GlobalRateLimit bound the inbound
+	// requests of each source host, of each authenticated sender id (of a
+	// session or a valid record) and of all of them,
+	// the requests over a limit are dropped before touching the table,
+	// see RateLimited
+	AddrRateLimit   RateLimit
+	IDRateLimit     RateLimit
+	GlobalRateLimit RateLimit
+	// PrivateKey signs the record of the local node, its id must be
+	// derived from the key, see IDFromPubKey
+	PrivateKey PrivKey
+	// RequireRecords refuses nodes without a signed record
+	RequireRecords bool
+	// Clock drives the timers of the table and its db, SystemClock when nil
+	Clock Clock
+	// Rand is the source of the random refresh targets and seeds,
+	// crypto/rand when nil. It must be safe for concurrent use
+	Rand io.Reader
+	// NetworkID isolates the tables of a network, nodes of other
+	// networks are refused and not stored. It's signed in the record
+	// of the local node when there is one. "" accepts every node.
+	// The network of a node without a record is the one its packets
+	// claim unsigned, it keeps honest nodes of other networks apart
+	// but anyone can claim it: set RequireRecords to rely on the
+	// network signed in the records only
+	NetworkID string
+	// Endpoints are advertised for the local node,
+	// the address given to NewTable is used alone when empty
+	Endpoints []Endpoint
+	// LatencyAware makes lookups ask the fastest and most reliable of
+	// equally close nodes first, from the NodeStats of the table, and
+	// gives up on each of them after a timeout adapted to its rtt
+	LatencyAware bool
+	// LatencyTradeoff lets latency aware lookups ask a fast node before
+	// slower ones up to two log distances closer to the target, instead
+	// of only reordering the nodes at the same distance
+	LatencyTradeoff bool
+	// AllowIDs turns on the allow list mode of permissioned chains,
+	// when set only these ids enter the table, bootnodes included
+	AllowIDs []Hash
+	// Metric is the closeness of ids the table is built on,
+	// XORMetric when nil
+	Metric Metric
+	// Admission decides which nodes enter the table against sybils, see
+	// PuzzlePolicy and OraclePolicy. The nodes it refuses are counted,
+	// see AdmissionRejected, and never stored. Bootnodes are trusted.
+	// Every node is admitted when nil
+	Admission AdmissionPolicy
+	// Store keeps the nodes known, when nil NewTable opens a LevelDBStore
+	// at its path, or a MemoryStore if the path is empty.
+	// The table closes it when closing
+	Store NodeStore
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		HashLength:         DefaultHashLength,
+		Alpha:              3,
+		DisjointPaths:      1,
+		BucketSize:         16,
+		FindSize:           16,
+		MaxReplacements:    10,
+		MaxFindFailures:    5,
+		SeedCount:          30,
+		SeedMaxAge:         7 * 24 * time.Hour,
+		RefreshInterval:    30 * time.Second,
+		RevalidateInterval: 30 * time.Second,
+		NodeExpiration:     24 * time.Hour,
+		CleanupCycle:       time.Hour,
+		RepublishInterval:  time.Hour,
+		MaxValueSize:       16 * 1024,
+		MaxValueTTL:        24 * time.Hour,
+		MaxRemoteValues:    4096,
+		MaxRemoteBytes:     16 * 1024 * 1024,
+		BootstrapRetry:     10 * time.Second,
+		BucketIPLimit:      0,
+		TableIPLimit:       0,
+		MinQueryTimeout:    50 * time.Millisecond,
+		MaxQueryTimeout:    500 * time.Millisecond,
+		AddrRateLimit:      RateLimit{Rate: 20, Burst: 40},
+		IDRateLimit:        RateLimit{Rate: 20, Burst: 40},
+		GlobalRateLimit:    RateLimit{Rate: 500, Burst: 1000},
+	}
+}
+
+// Validate reports the first parameter that can't work,
+// the error returned has CONFIG_ERR as cause
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.HashLength < 2:
+		// need at least one bucket, see updateHashLength
+		return errors.Wrapf(CONFIG_ERR, "hash length %v less than 2", cfg.HashLength)
+	case cfg.Alpha < 1:
+		return errors.Wrapf(CONFIG_ERR, "alpha %v less than 1", cfg.Alpha)
+	case cfg.DisjointPaths < 1:
+		return errors.Wrapf(CONFIG_ERR, "disjoint paths %v less than 1", cfg.DisjointPaths)
+	case cfg.BucketSize < 1:
+		return errors.Wrapf(CONFIG_ERR, "bucket size %v less than 1", cfg.BucketSize)
+	case cfg.FindSize < 1:
+		return errors.Wrapf(CONFIG_ERR, "find size %v less than 1", cfg.FindSize)
+	case cfg.MaxReplacements < 0:
+		return errors.Wrapf(CONFIG_ERR, "negative max replacements %v", cfg.MaxReplacements)
+	case cfg.MaxFindFailures < 1:
+		return errors.Wrapf(CONFIG_ERR, "max find failures %v less than 1", cfg.MaxFindFailures)
+	case cfg.SeedCount < 0:
+		return errors.Wrapf(CONFIG_ERR, "negative seed count %v", cfg.SeedCount)
+	case cfg.SeedMaxAge <= 0:
+		return errors.Wrapf(CONFIG_ERR, "seed max age %v not positive", cfg.SeedMaxAge)
+	case cfg.RefreshInterval <= 0:
+		return errors.Wrapf(CONFIG_ERR, "refresh interval %v not positive", cfg.RefreshInterval)
+	case cfg.RevalidateInterval <= 0:
+		return errors.Wrapf(CONFIG_ERR, "revalidate interval %v not positive", cfg.RevalidateInterval)
+	case cfg.NodeExpiration <= 0:
+		return errors.Wrapf(CONFIG_ERR, "node expiration %v not positive", cfg.NodeExpiration)
+	case cfg.CleanupCycle <= 0:
+		return errors.Wrapf(CONFIG_ERR, "cleanup cycle %v not positive", cfg.CleanupCycle)
+	case cfg.RepublishInterval <= 0:
+		return errors.Wrapf(CONFIG_ERR, "republish interval %v not positive", cfg.RepublishInterval)
+	case cfg.MaxValueSize < 1:
+		return errors.Wrapf(CONFIG_ERR, "max value size %v less than 1", cfg.MaxValueSize)
+	case cfg.MaxValueTTL <= 0:
+		return errors.Wrapf(CONFIG_ERR, "max value ttl %v not positive", cfg.MaxValueTTL)
+	case cfg.MaxRemoteValues < 1 || cfg.MaxRemoteBytes < cfg.MaxValueSize:
+		return errors.Wrapf(CONFIG_ERR, "remote values quota %v, %v bytes less than one value", cfg.MaxRemoteValues, cfg.MaxRemoteBytes)
+	case cfg.BootstrapRetry <= 0:
+		return errors.Wrapf(CONFIG_ERR, "bootstrap retry %v not positive", cfg.BootstrapRetry)
+	case cfg.BucketIPLimit < 0:
+		return errors.Wrapf(CONFIG_ERR, "negative bucket ip limit %v", cfg.BucketIPLimit)
+	case cfg.TableIPLimit < 0:
+		return errors.Wrapf(CONFIG_ERR, "negative table ip limit %v", cfg.TableIPLimit)
+	case cfg.LatencyAware && (cfg.MinQueryTimeout <= 0 || cfg.MaxQueryTimeout < cfg.MinQueryTimeout):
+		return errors.Wrapf(CONFIG_ERR, "query timeout bounds [%v, %v] invalid", cfg.MinQueryTimeout, cfg.MaxQueryTimeout)
+	}
+	for _, l := range []RateLimit{cfg.AddrRateLimit, cfg.IDRateLimit, cfg.GlobalRateLimit} {
+		if l.Rate < 0 || (l.enabled() && l.Burst < 1) {
+			return errors.Wrapf(CONFIG_ERR, "rate limit %+v invalid", l)
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		if err := e.Validate(); err != nil {
+			return errors.Wrapf(CONFIG_ERR, "endpoint %v: %v", e, err)
+		}
+	}
+	return nil
+}
+
 type tbConfig struct {
 	alpha              int
+	disjointPaths      int
 	HashLength         int
 	hashBits           int
 	findsize           int
@@ -15,93 +200,102 @@ type tbConfig struct {
 	seedCount          int
 	seedMaxAge         time.Duration
 	maxReplacements    int
-	bucketMinDistance  int //0~151,152,..,160
 	refreshInterval    time.Duration
 	revalidateInterval time.Duration
+	republishInterval  time.Duration
+	maxValueSize       int
+	maxRemoteValues    int
+	maxRemoteBytes     int
+	maxValueTTL        time.Duration
+	bootstrapRetry     time.Duration
+	bucketIPLimit      int
+	tableIPLimit       int
+	latencyAware       bool
+	latencyTradeoff    bool
+	minQueryTimeout    time.Duration
+	maxQueryTimeout    time.Duration
+	requireRecords     bool
+	networkID          string
+	admission          AdmissionPolicy
+	metric             Metric
+	clock              Clock
+	rand               io.Reader
 }
 
-func (c *tbConfig) SetDefault() {
-	c.alpha = 3
-	c.findsize = 16
-	c.bucketSize = 16
-	c.maxFindFailures = 5
-	c.seedCount = 30
-	c.seedMaxAge = 7 * 24 * time.Hour
-	c.maxReplacements = 10
-	c.refreshInterval = 30 * time.Second
-	c.revalidateInterval = 30 * time.Second
-	c.updateHashLength(40)
+func newTbConfig(cfg *Config) *tbConfig {
+	c := &tbConfig{
+		alpha:              cfg.Alpha,
+		disjointPaths:      cfg.DisjointPaths,
+		findsize:           cfg.FindSize,
+		bucketSize:         cfg.BucketSize,
+		maxFindFailures:    cfg.MaxFindFailures,
+		seedCount:          cfg.SeedCount,
+		seedMaxAge:         cfg.SeedMaxAge,
+		maxReplacements:    cfg.MaxReplacements,
+		refreshInterval:    cfg.RefreshInterval,
+		revalidateInterval: cfg.RevalidateInterval,
+		republishInterval:  cfg.RepublishInterval,
+		maxValueSize:       cfg.MaxValueSize,
+		maxRemoteValues:    cfg.MaxRemoteValues,
+		maxRemoteBytes:     cfg.MaxRemoteBytes,
+		maxValueTTL:        cfg.MaxValueTTL,
+		bootstrapRetry:     cfg.BootstrapRetry,
+		bucketIPLimit:      cfg.BucketIPLimit,
+		tableIPLimit:       cfg.TableIPLimit,
+		latencyAware:       cfg.LatencyAware,
+		latencyTradeoff:    cfg.LatencyTradeoff,
+		minQueryTimeout:    cfg.MinQueryTimeout,
+		maxQueryTimeout:    cfg.MaxQueryTimeout,
+		requireRecords:     cfg.RequireRecords,
+		networkID:          cfg.NetworkID,
+		admission:          cfg.Admission,
+		metric:             cfg.metricOrDefault(),
+		clock:              cfg.clockOrDefault(),
+		rand:               cfg.randOrDefault(),
+	}
+	c.updateHashLength(cfg.HashLength)
+	return c
 }
 
 func (c *tbConfig) updateHashLength(v int) {
 	c.HashLength = v
 	c.hashBits = c.HashLength * 8
-	c.nBuckets = c.hashBits / 15                  //10 21
-	c.bucketMinDistance = c.hashBits - c.nBuckets //0~151,152,..,160
+	c.nBuckets = c.hashBits / 15 //10 21
 }
 
-type dbConfig struct {
-	nodeDBNilHash        Hash          // Special node ID to use as a nil element.
-	nodeDBNodeExpiration time.Duration // Time after which an unseen node should be dropped.
-	nodeDBCleanupCycle   time.Duration // Time period for running the expiration task.
-
-	nodeDBItemPrefix []byte // Identifier to prefix node entries
-
-	nodeDBDiscoverRoot      string
-	nodeDBDiscoverPing      string
-	nodeDBDiscoverPong      string
-	nodeDBDiscoverFindFails string
-}
-
-func (c *dbConfig) SetDefault() {
-	c.nodeDBNilHash = NewHash()             // Special node ID to use as a nil element.
-	c.nodeDBNodeExpiration = 24 * time.Hour // Time after which an unseen node should be dropped.
-	c.nodeDBCleanupCycle = time.Hour        // Time period for running the expiration task.
-	c.nodeDBItemPrefix = []byte("n:")       // Identifier to prefix node entries
-	c.nodeDBDiscoverRoot = ":discover"
-	c.nodeDBDiscoverPing = c.nodeDBDiscoverRoot + ":lastping"
-	c.nodeDBDiscoverPong = c.nodeDBDiscoverRoot + ":lastpong"
-	c.nodeDBDiscoverFindFails = c.nodeDBDiscoverRoot + ":findfail"
+func (cfg *Config) clockOrDefault() Clock {
+	if cfg.Clock == nil {
+		return SystemClock{}
+	}
+	return cfg.Clock
 }
 
-type Configurable struct {
-	HashLength int
+func (cfg *Config) metricOrDefault() Metric {
+	if cfg.Metric == nil {
+		return XORMetric{}
+	}
+	return cfg.Metric
 }
 
-func NewConfigurable() *Configurable {
-	return &Configurable{}
-}
-func NewCgWithParam(hl int) *Configurable {
-	return &Configurable{
-		HashLength: hl,
+func (cfg *Config) randOrDefault() io.Reader {
+	if cfg.Rand == nil {
+		return crand.Reader
 	}
+	return cfg.Rand
 }
 
-var c *tbConfig
-var dbc *dbConfig
-
-// Init method initializes params used by the module,
-// so call it before using any other methods in this package.
-// Or it will call panic
-func Init(cg *Configurable) {
-	initConfig(cg)
+type dbConfig struct {
+	clock                Clock
+	networkID            string
+	nodeDBNodeExpiration time.Duration // Time after which an unseen node should be dropped.
+	nodeDBCleanupCycle   time.Duration // Time period for running the expiration task.
 }
 
-func initConfig(cg *Configurable) {
-	if cg == nil {
-		cg = NewConfigurable()
-	}
-	if c == nil {
-		c = &tbConfig{}
-		c.SetDefault()
-	}
-	if cg.HashLength > 0 {
-		c.updateHashLength(cg.HashLength)
-	}
-	if dbc == nil {
-		dbc = &dbConfig{}
-		dbc.SetDefault()
-	}
-	return
-
+func newDBConfig(cfg *Config) *dbConfig {
+	c := &dbConfig{}
+	c.clock = cfg.clockOrDefault()
+	c.networkID = cfg.NetworkID
+	c.nodeDBNodeExpiration = cfg.NodeExpiration // Time after which an unseen node should be dropped.
+	c.nodeDBCleanupCycle = cfg.CleanupCycle     // Time period for running the expiration task.
+	return c
 }
@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	require.Nil(t, DefaultConfig().Validate())
+
+	bad := []func(cfg *Config){
+		func(cfg *Config) { cfg.HashLength = 1 },
+		func(cfg *Config) { cfg.Alpha = 0 },
+		func(cfg *Config) { cfg.DisjointPaths = 0 },
+		func(cfg *Config) { cfg.BucketSize = 0 },
+		func(cfg *Config) { cfg.FindSize = -1 },
+		func(cfg *Config) { cfg.MaxReplacements = -1 },
+		func(cfg *Config) { cfg.MaxFindFailures = 0 },
+		func(cfg *Config) { cfg.SeedCount = -1 },
+		func(cfg *Config) { cfg.SeedMaxAge = 0 },
+		func(cfg *Config) { cfg.RefreshInterval = 0 },
+		func(cfg *Config) { cfg.RevalidateInterval = -time.Second },
+		func(cfg *Config) { cfg.NodeExpiration = 0 },
+		func(cfg *Config) { cfg.CleanupCycle = 0 },
+		func(cfg *Config) { cfg.BootstrapRetry = 0 },
+		func(cfg *Config) { cfg.TableIPLimit = -1 },
+		func(cfg *Config) { cfg.LatencyAware, cfg.MaxQueryTimeout = true, cfg.MinQueryTimeout/2 },
+		func(cfg *Config) { cfg.AddrRateLimit.Burst = 0 },
+		func(cfg *Config) { cfg.GlobalRateLimit.Rate = -1 },
+	}
+	for i, set := range bad {
+		cfg := DefaultConfig()
+		set(cfg)
+		err := cfg.Validate()
+		assert.Equal(t, CONFIG_ERR, errors.Cause(err), "case %v", i)
+		_, err = NewTable(testNet, NewHashN(cfg.HashLength), "nc", "", nil, cfg)
+		assert.NotNil(t, err, "case %v: table created with bad config", i)
+	}
+}
+
+func TestTablesWithDifferentConfigs(t *testing.T) {
+	mainCfg := DefaultConfig()
+	testCfg := DefaultConfig()
+	testCfg.HashLength = 32
+	testCfg.BucketSize = 4
+	testCfg.Alpha = 1
+
+	mainTab, err := NewTable(testNet, ToHashN([]byte{41}, mainCfg.HashLength), "na", "", nil, mainCfg)
+	require.Nil(t, err, "new main table err")
+	defer mainTab.db.close()
+	testTab, err := NewTable(testNet, ToHashN([]byte{41}, testCfg.HashLength), "nb", "", nil, testCfg)
+	require.Nil(t, err, "new test table err")
+	defer testTab.db.close()
+
+	assert.Len(t, mainTab.NewHash(), 40)
+	assert.Len(t, testTab.NewHash(), 32)
+	assert.Len(t, testTab.buckets, 32*8/15)
+
+	// ids of the other table's length are refused
+	assert.NotNil(t, mainTab.add(NewNode(testTab.ToHash([]byte{43}), "nc")))
+	assert.NotNil(t, testTab.add(NewNode(mainTab.ToHash([]byte{43}), "nc")))
+	assert.Nil(t, testTab.GetNodesLocally(mainTab.ToHash([]byte{43})))
+
+	for i := 0; i < 10; i++ {
+		id := testTab.ToHash([]byte{43, byte(i)})
+		require.Nil(t, testTab.add(NewNode(id, "nc")))
+	}
+	// all of them fall into one bucket of the test config's size
+	assert.Len(t, testTab.GetNodesLocally(testTab.ToHash([]byte{43})), testCfg.BucketSize)
+}
+
+func TestHashLength(t *testing.T) {
+	assert.Len(t, ToHash([]byte{1}), DefaultHashLength)
+	assert.Len(t, NewHash(), DefaultHashLength)
+	h := ToHashN([]byte{1, 2}, 4)
+	assert.Equal(t, Hash{1, 2, 0xff, 0xff}, h)
+	assert.Nil(t, h.Check(4))
+	assert.Equal(t, HASH_FORMAT_ERR, h.Check(DefaultHashLength))
+
+	var cp Hash
+	cp.Copy(h)
+	assert.Equal(t, h, cp)
+}
@@ -1,113 +1,149 @@
 package routing
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/binary"
-
-	//"encoding/json"
+	"fmt"
 	"log"
 	"sync"
 	"time"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/storage"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-type nodeDB struct {
-	lvl    *leveldb.DB
-	self   Hash
-	runner sync.Once // Ensures we can start at most one expirer
-	quit   chan struct{}
+// NodeStore keeps what a table learns about nodes across restarts.
+// The table calls it from several goroutines, so implementations
+// must be safe for concurrent use
+type NodeStore interface {
+	// Node returns the node stored with id or nil
+	Node(id Hash) *Node
+	UpdateNode(n *Node) error
+	// DeleteNode drops the node and everything stored about it
+	DeleteNode(id Hash) error
+
+	LastPingReceived(id Hash) time.Time
+	UpdateLastPingReceived(id Hash, instance time.Time) error
+	LastPongReceived(id Hash) time.Time
+	UpdateLastPongReceived(id Hash, instance time.Time) error
+	FindFails(id Hash) int
+	UpdateFindFails(id Hash, fails int) error
+
+	// LocalSeq is the seq of the last record signed for the local node
+	LocalSeq() uint64
+	StoreLocalSeq(seq uint64) error
+
+	// QuerySeeds returns up to n random nodes that answered since seen
+	QuerySeeds(n int, seen time.Time) []*Node
+	// Iterate calls fn with every node stored until it returns false
+	Iterate(fn func(n *Node) bool) error
+	// ExpireNodes drops the nodes that didn't answer since threshold
+	ExpireNodes(threshold time.Time) error
+
+	Close() error
 }
 
-func newNodeDB(path string, self Hash) (*nodeDB, error) {
-	var db *leveldb.DB
-	var err error
-	if path == "" {
-		db, err = leveldb.Open(storage.NewMemStorage(), nil)
-	} else {
-		db, err = leveldb.OpenFile(path, nil)
-	}
+// StoredValue is a DHT value kept in a ValueStore
+type StoredValue struct {
+	Key     Hash
+	Data    []byte
+	Expires time.Time
+	Origin  bool // published by the local node
+}
 
-	if err != nil {
-		return nil, err
-	}
-	return &nodeDB{
-		lvl:  db,
-		self: self,
-		quit: make(chan struct{}),
-	}, nil
+// ValueStore is implemented by node stores able to keep DHT values,
+// Table.Put and Table.Get need it
+type ValueStore interface {
+	PutValue(sv *StoredValue) error
+	// Value returns the value stored under key, even if expired
+	Value(key Hash) *StoredValue
+	DeleteValue(key Hash) error
+	// OriginValues returns the values published by the local node
+	OriginValues() []*StoredValue
+	// ExpireValues drops the values expired at now
+	ExpireValues(now time.Time) error
+	// RemoteValues returns the number and the bytes of the values
+	// not published by the local node, expired ones included
+	RemoteValues() (num, bytes int)
 }
 
-func makeKey(id Hash, field string) []byte {
-	if id.Equal(dbc.nodeDBNilHash) {
-		return []byte(field)
-	}
-	return append(dbc.nodeDBItemPrefix, append(id[:], field...)...)
+// SelfStore is implemented by node stores that persist across restarts,
+// BindSelf is called with the local node id before the store is used
+// so what was stored for another local node isn't taken for ours
+type SelfStore interface {
+	BindSelf(self Hash) error
 }
 
-func splitKey(key []byte) (id Hash, field string) {
-	if !bytes.HasPrefix(key, dbc.nodeDBItemPrefix) {
-		return nil, string(key)
-	}
-	item := key[len(dbc.nodeDBItemPrefix):]
-	id.Copy(item)
-	field = string(item[len(id):])
+// SchemaError is returned by NewTable when the node database
+// was written in a way the config can't read
+type SchemaError struct {
+	Path   string
+	Key    string // what doesn't match
+	Stored string
+	Want   string
+}
 
-	return id, field
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("node database %v: %v is %v, want %v", e.Path, e.Key, e.Stored, e.Want)
 }
 
-func (db *nodeDB) getNode(id Hash) *Node {
-	dbvalue, err := db.lvl.Get(makeKey(id, dbc.nodeDBDiscoverRoot), nil)
-	if err != nil {
-		return nil
+// nodeDB runs a NodeStore for a table,
+// it applies the table's clock and expiration to it
+type nodeDB struct {
+	store  NodeStore
+	self   Hash
+	cfg    *dbConfig
+	runner sync.Once // Ensures we can start at most one expirer
+	quit   chan struct{}
+
+	statsMutex sync.Mutex // serializes the read-modify-write of stats
+	valueMutex sync.Mutex // serializes the quota check and the store of remote values
+}
+
+// openNodeDB uses the store of cfg, or opens a LevelDBStore at path
+// or a MemoryStore when path is empty
+func openNodeDB(path string, self Hash, cfg *Config) (*nodeDB, error) {
+	store := cfg.Store
+	if store == nil {
+		if path == "" {
+			store = NewMemoryStore(cfg)
+		} else {
+			lvl, err := NewLevelDBStore(path, cfg)
+			if err != nil {
+				return nil, err
+			}
+			store = lvl
+		}
 	}
-	node := &Node{}
-	if err := node.Unmarshal(dbvalue); err != nil {
-		log.Println("Failed to decode node", "err", err)
-		return nil
+	if ss, ok := store.(SelfStore); ok {
+		if err := ss.BindSelf(self); err != nil {
+			if cfg.Store == nil {
+				store.Close()
+			}
+			return nil, err
+		}
 	}
-	return node
+	return newNodeDB(store, self, newDBConfig(cfg)), nil
 }
 
-func (db *nodeDB) updateNode(node *Node) error {
-	dbvalue, err := node.Marshal()
-	if err != nil {
-		return err
+func newNodeDB(store NodeStore, self Hash, cfg *dbConfig) *nodeDB {
+	return &nodeDB{
+		store: store,
+		self:  self,
+		cfg:   cfg,
+		quit:  make(chan struct{}),
 	}
-	return db.lvl.Put(makeKey(node.GetID(), dbc.nodeDBDiscoverRoot), dbvalue, nil)
 }
 
-func (db *nodeDB) deleteNode(id Hash) error {
-	deleter := db.lvl.NewIterator(util.BytesPrefix(makeKey(id, "")), nil)
-	for deleter.Next() {
-		if err := db.lvl.Delete(deleter.Key(), nil); err != nil {
-			return err
-		}
-	}
-	return nil
+func (db *nodeDB) getNode(id Hash) *Node {
+	return db.store.Node(id)
 }
 
-func (db *nodeDB) getInt64(key []byte) int64 {
-	dbvalue, err := db.lvl.Get(key, nil)
-	if err != nil {
-		return 0
-	}
-	val, nbyte := binary.Varint(dbvalue)
-	if nbyte <= 0 {
-		return 0
+// updateNode stores node, nodes of other networks are refused.
+func (db *nodeDB) updateNode(node *Node) error {
+	if db.cfg.networkID != "" && node.GetNetwork() != db.cfg.networkID {
+		return NETWORK_ERR
 	}
-	return val
+	return db.store.UpdateNode(node)
 }
 
-func (db *nodeDB) storeInt64(key []byte, n int64) error {
-	dbvalue := make([]byte, binary.MaxVarintLen64)
-	dbvalue = dbvalue[:binary.PutVarint(dbvalue, n)]
-
-	return db.lvl.Put(key, dbvalue, nil)
+func (db *nodeDB) deleteNode(id Hash) error {
+	return db.store.DeleteNode(id)
 }
 
 // ensureExpirer is a small helper method ensuring that the data expiration
@@ -126,14 +162,17 @@ func (db *nodeDB) ensureExpirer() {
 // expirer should be started in a go routine, and is responsible for looping ad
 // infinitum and dropping stale data from the database.
 func (db *nodeDB) expirer() {
-	tick := time.NewTicker(dbc.nodeDBCleanupCycle)
+	tick := db.cfg.clock.NewTicker(db.cfg.nodeDBCleanupCycle)
 	defer tick.Stop()
 	for {
 		select {
-		case <-tick.C:
+		case <-tick.C():
 			if err := db.expireNodes(); err != nil {
 				log.Println("Failed to expire nodedb items", "err", err)
 			}
+			if err := db.expireValues(); err != nil {
+				log.Println("Failed to expire nodedb values", "err", err)
+			}
 		case <-db.quit:
 			return
 		}
@@ -141,130 +180,180 @@ func (db *nodeDB) expirer() {
 }
 
 func (db *nodeDB) expireNodes() error {
-	threshold := time.Now().Add(-dbc.nodeDBNodeExpiration)
-
-	// Find discovered nodes that are older than the allowance
-	it := db.lvl.NewIterator(nil, nil)
-
-	for it.Next() {
-		// Skip the item if not a discovery node
-		id, field := splitKey(it.Key())
-		if field != dbc.nodeDBDiscoverRoot {
-			continue
-		}
-		// Skip the node if not expired yet (and not self)
-		if !bytes.Equal(id[:], db.self[:]) {
-			if seen := db.lastPongReceived(id); seen.After(threshold) {
-				continue
-			}
-		}
-		// Otherwise delete all associated information
-		db.deleteNode(id)
-	}
-	it.Release()
-	return nil
+	return db.store.ExpireNodes(db.cfg.clock.Now().Add(-db.cfg.nodeDBNodeExpiration))
 }
 
 // lastPingReceived retrieves the time of the last ping packet sent by the remote node.
-//not used
 func (db *nodeDB) lastPingReceived(id Hash) time.Time {
-	return time.Unix(db.getInt64(makeKey(id, dbc.nodeDBDiscoverPing)), 0)
+	return db.store.LastPingReceived(id)
 }
 
 // updateLastPing updates the last time remote node pinged us.
-//not used
 func (db *nodeDB) updateLastPingReceived(id Hash, instance time.Time) error {
-	return db.storeInt64(makeKey(id, dbc.nodeDBDiscoverPing), instance.Unix())
+	return db.store.UpdateLastPingReceived(id, instance)
 }
 
 // lastPongReceived retrieves the time of the last successful pong from remote node.
 func (db *nodeDB) lastPongReceived(id Hash) time.Time {
-	return time.Unix(db.getInt64(makeKey(id, dbc.nodeDBDiscoverPong)), 0)
+	return db.store.LastPongReceived(id)
 }
 
 // hasBond reports whether the given node is considered bonded.
 //not used
 func (db *nodeDB) hasBond(id Hash) bool {
-	return time.Since(db.lastPongReceived(id)) < dbc.nodeDBNodeExpiration
+	return db.cfg.clock.Now().Sub(db.lastPongReceived(id)) < db.cfg.nodeDBNodeExpiration
 }
 
 // updateLastPongReceived updates the last pong time of a node.
 func (db *nodeDB) updateLastPongReceived(id Hash, instance time.Time) error {
-	return db.storeInt64(makeKey(id, dbc.nodeDBDiscoverPong), instance.Unix())
+	return db.store.UpdateLastPongReceived(id, instance)
 }
 
 // findFails retrieves the number of findnode failures since bonding.
 func (db *nodeDB) findFails(id Hash) int {
-	return int(db.getInt64(makeKey(id, dbc.nodeDBDiscoverFindFails)))
+	return db.store.FindFails(id)
 }
 
 // updateFindFails updates the number of findnode failures since bonding.
 func (db *nodeDB) updateFindFails(id Hash, fails int) error {
-	return db.storeInt64(makeKey(id, dbc.nodeDBDiscoverFindFails), int64(fails))
+	return db.store.UpdateFindFails(id, fails)
+}
+
+// localSeq retrieves the seq of the last record signed for the local node.
+func (db *nodeDB) localSeq() uint64 {
+	return db.store.LocalSeq()
+}
+
+// storeLocalSeq updates the seq of the last record signed for the local node.
+func (db *nodeDB) storeLocalSeq(seq uint64) error {
+	return db.store.StoreLocalSeq(seq)
 }
 
 // querySeeds retrieves random nodes to be used as potential seed nodes
 // for bootstrapping.
 func (db *nodeDB) querySeeds(n int, maxAge time.Duration) []*Node {
-	var (
-		now   = time.Now()
-		nodes = make([]*Node, 0, n)
-		it    = db.lvl.NewIterator(nil, nil)
-		id    = NewHash()
-	)
-
-seek:
-	for seeks := 0; len(nodes) < n && seeks < n*5; seeks++ {
-		// Seek to a random entry. The first byte is incremented by a
-		// random amount each time in order to increase the likelihood
-		// of hitting all existing nodes in very small databases.
-		ctr := id[0]
-		rand.Read(id[:])
-		id[0] = ctr + id[0]%16
-		it.Seek(makeKey(id, dbc.nodeDBDiscoverRoot))
-
-		node := nextNode(it)
-		if node == nil {
-			id[0] = 0
-			continue seek // iterator exhausted
-		}
-		if node.GetID().Equal(db.self) {
-			continue seek
+	nodes := db.store.QuerySeeds(n+1, db.cfg.clock.Now().Add(-maxAge))
+	for i := range nodes {
+		if nodes[i].GetID().Equal(db.self) {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
 		}
-		if now.Sub(db.lastPongReceived(node.GetID())) > maxAge {
-			continue seek
-		}
-		for i := range nodes {
-			if nodes[i].GetID().Equal(node.GetID()) {
-				continue seek // duplicate
-			}
-		}
-		nodes = append(nodes, node)
 	}
-	it.Release()
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
 	return nodes
 }
 
-// reads the next node record from the iterator, skipping over other
-// database entries.
-func nextNode(it iterator.Iterator) *Node {
-	for end := false; !end; end = !it.Next() {
-		id, field := splitKey(it.Key())
-		if field != dbc.nodeDBDiscoverRoot {
-			continue
+// putValue stores a DHT value, VALUE_UNSUPPORTED_ERR
+// is returned when the store can't keep values
+func (db *nodeDB) putValue(key Hash, data []byte, expires time.Time, origin bool) error {
+	vs, ok := db.store.(ValueStore)
+	if !ok {
+		return VALUE_UNSUPPORTED_ERR
+	}
+	return vs.PutValue(&StoredValue{Key: key, Data: data, Expires: expires, Origin: origin})
+}
+
+// putRemoteValue stores a value sent by a remote node. The values we
+// publish can't be replaced, VALUE_ORIGIN_ERR is returned, and the
+// values of remote nodes are kept under maxValues and maxBytes, the
+// value replaced aside, VALUE_QUOTA_ERR is returned over them
+func (db *nodeDB) putRemoteValue(key Hash, data []byte, expires time.Time, maxValues, maxBytes int) error {
+	vs, ok := db.store.(ValueStore)
+	if !ok {
+		return VALUE_UNSUPPORTED_ERR
+	}
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	now := db.cfg.clock.Now()
+	old := vs.Value(key)
+	if old != nil && old.Origin && old.Expires.After(now) {
+		return VALUE_ORIGIN_ERR
+	}
+	over := func() bool {
+		num, bytes := vs.RemoteValues()
+		if old != nil && !old.Origin {
+			num, bytes = num-1, bytes-len(old.Data)
+		}
+		return num+1 > maxValues || bytes+len(data) > maxBytes
+	}
+	if over() {
+		// the expired values may make room
+		if err := vs.ExpireValues(now); err != nil {
+			return err
 		}
-		n := &Node{}
-		if err := n.Unmarshal(it.Value()); err != nil {
-			log.Println("Failed to decode node", "id", id, "err", err)
-			continue
+		if old = vs.Value(key); over() {
+			return VALUE_QUOTA_ERR
 		}
-		return n
+	}
+	return vs.PutValue(&StoredValue{Key: key, Data: data, Expires: expires})
+}
+
+// getValue retrieves a value not expired yet.
+func (db *nodeDB) getValue(key Hash) *StoredValue {
+	vs, ok := db.store.(ValueStore)
+	if !ok {
+		return nil
+	}
+	sv := vs.Value(key)
+	if sv == nil || !sv.Expires.After(db.cfg.clock.Now()) {
+		return nil
+	}
+	return sv
+}
+
+func (db *nodeDB) deleteValue(key Hash) error {
+	if vs, ok := db.store.(ValueStore); ok {
+		return vs.DeleteValue(key)
+	}
+	return nil
+}
+
+// originValues retrieves the values published by the local node.
+func (db *nodeDB) originValues() []*StoredValue {
+	if vs, ok := db.store.(ValueStore); ok {
+		return vs.OriginValues()
+	}
+	return nil
+}
+
+// expireValues drops the values whose ttl ran out.
+func (db *nodeDB) expireValues() error {
+	if vs, ok := db.store.(ValueStore); ok {
+		return vs.ExpireValues(db.cfg.clock.Now())
+	}
+	return nil
+}
+
+// putBan keeps b when the store is a BanStore,
+// bans only live in the table otherwise
+func (db *nodeDB) putBan(b *Ban) error {
+	if bs, ok := db.store.(BanStore); ok {
+		return bs.PutBan(b)
+	}
+	return nil
+}
+
+func (db *nodeDB) deleteBan(key string) error {
+	if bs, ok := db.store.(BanStore); ok {
+		return bs.DeleteBan(key)
+	}
+	return nil
+}
+
+// bans retrieves the bans kept, expired ones included.
+func (db *nodeDB) bans() []*Ban {
+	if bs, ok := db.store.(BanStore); ok {
+		return bs.Bans()
 	}
 	return nil
 }
 
-// close flushes and closes the database files.
+// close stops the expirer and closes the store.
 func (db *nodeDB) close() {
 	close(db.quit)
-	db.lvl.Close()
+	if err := db.store.Close(); err != nil {
+		log.Println("Failed to close nodedb", "err", err)
+	}
 }
@@ -7,6 +7,7 @@ import (
 
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -15,91 +16,309 @@ const (
 	tmpDBName = "nodeDB_test"
 )
 
+// dbsForTest opens a nodeDB on every kind of store
+func dbsForTest(t *testing.T, self Hash) map[string]*nodeDB {
+	path, err := ioutil.TempDir("", tmpDBName)
+	require.Nil(t, err, "make tempdir err")
+	lvl, err := NewLevelDBStore(path, nil)
+	require.Nil(t, err, "new leveldb store err")
+	dbc := newDBConfig(DefaultConfig())
+	return map[string]*nodeDB{
+		"leveldb": newNodeDB(lvl, self, dbc),
+		"memory":  newNodeDB(NewMemoryStore(nil), self, dbc),
+	}
+}
+
 func Test_newNodeDB(t *testing.T) {
-	Init(NewConfigurable())
 	path, err := ioutil.TempDir("", tmpDBName)
 	assert.Nil(t, err, "make tempdir err")
 	self := Hash{}
-	db, err := newNodeDB(path, self)
+	db, err := openNodeDB(path, self, DefaultConfig())
 	assert.Nil(t, err, "new node db err")
+	assert.IsType(t, &LevelDBStore{}, db.store)
 	db.close()
 
+	db, err = openNodeDB("", self, DefaultConfig())
+	assert.Nil(t, err, "new node db err")
+	assert.IsType(t, &MemoryStore{}, db.store)
+	db.close()
 }
 
 func Test_Node(t *testing.T) {
-	Init(NewConfigurable())
-	path, err := ioutil.TempDir("", tmpDBName)
-	assert.Nil(t, err, "make tempdir err")
-	self := Hash{}
-	db, err := newNodeDB(path, self)
-	assert.Nil(t, err, "new node db err")
-	defer db.close()
-	//ti := time.Now()
-	node := &Node{Addr: "na", ID: ToHash([]byte{45}), Time: time.Now().Unix()}
-	err = db.updateNode(node)
-	require.Nil(t, err, "update node err")
-	key := makeKey(node.ID, dbc.nodeDBDiscoverRoot)
-	nget := db.getNode(node.ID)
-
-	if !node.Equal(nget) {
-		t.Error(fmt.Sprintf("node get from db wrong,key:%x\nori:%v\nget:%v", key, node, nget))
-	}
+	for name, db := range dbsForTest(t, Hash{}) {
+		//ti := time.Now()
+		node := &Node{Addr: "na", ID: ToHash([]byte{45}), Time: time.Now().Unix()}
+		err := db.updateNode(node)
+		require.Nil(t, err, "update node err")
+		nget := db.getNode(node.ID)
 
-	err = db.deleteNode(node.ID)
-	require.Nil(t, err, "delete node err")
+		if !node.Equal(nget) {
+			t.Error(fmt.Sprintf("%v: node get from db wrong\nori:%v\nget:%v", name, node, nget))
+		}
 
-	nget = db.getNode(node.ID)
-	//db.ensureExpirer()
-	if nget != nil {
-		t.Error("delete node fail,get:%v", nget)
-	}
+		require.Nil(t, db.updateFindFails(node.ID, 3))
+		assert.Equal(t, 3, db.findFails(node.ID), name)
+		err = db.deleteNode(node.ID)
+		require.Nil(t, err, "delete node err")
+
+		nget = db.getNode(node.ID)
+		//db.ensureExpirer()
+		if nget != nil {
+			t.Errorf("%v: delete node fail,get:%v", name, nget)
+		}
+		assert.Equal(t, 0, db.findFails(node.ID), name)
+
+		require.Nil(t, db.storeLocalSeq(9))
+		assert.Equal(t, uint64(9), db.localSeq(), name)
 
+		require.Nil(t, db.recordPing(node.ID, time.Second, true))
+		require.Nil(t, db.recordFind(node.ID, 0, false))
+		st := db.nodeStats(node.ID)
+		require.NotNil(t, st, name)
+		assert.Equal(t, time.Second, st.RTT, name)
+		assert.Equal(t, uint64(1), st.PingOK, name)
+		assert.Equal(t, uint64(1), st.FindFail, name)
+		db.close()
+	}
 }
 
 func Test_querySeeds(t *testing.T) {
-	Init(NewConfigurable())
-	path, err := ioutil.TempDir("", tmpDBName)
-	require.Nil(t, err, "make tempdir err")
 	self := ToHash([]byte{7, 63, 74})
-	db, err := newNodeDB(path, self)
-	require.Nil(t, err, "new node db err")
-	defer db.close()
-	var node *Node
-	have := make(map[HashKey]struct{})
-	want := make(map[HashKey]struct{})
-	node = &Node{Addr: "na", ID: ToHash([]byte{7, 63, 74}), Time: time.Now().Unix()}
-	err = db.updateNode(node)
-	if err != nil {
-		t.Error(err)
-	}
-	//want[node.ID] = struct{}{}
-	node = &Node{Addr: "nb", ID: ToHash([]byte{24, 26, 84}), Time: time.Now().Unix()}
-	err = db.updateNode(node)
-	if err != nil {
-		t.Error(err)
-	}
-	want[node.ID.AsKey()] = struct{}{}
-	node = &Node{Addr: "nc", ID: ToHash([]byte{60, 14, 24}), Time: time.Now().Unix()}
-	err = db.updateNode(node)
-	if err != nil {
-		t.Error(err)
+	for name, db := range dbsForTest(t, self) {
+		var node *Node
+		have := make(map[HashKey]struct{})
+		want := make(map[HashKey]struct{})
+		node = &Node{Addr: "na", ID: ToHash([]byte{7, 63, 74}), Time: time.Now().Unix()}
+		err := db.updateNode(node)
+		if err != nil {
+			t.Error(err)
+		}
+		//want[node.ID] = struct{}{}
+		node = &Node{Addr: "nb", ID: ToHash([]byte{24, 26, 84}), Time: time.Now().Unix()}
+		err = db.updateNode(node)
+		if err != nil {
+			t.Error(err)
+		}
+		want[node.ID.AsKey()] = struct{}{}
+		node = &Node{Addr: "nc", ID: ToHash([]byte{60, 14, 24}), Time: time.Now().Unix()}
+		err = db.updateNode(node)
+		if err != nil {
+			t.Error(err)
+		}
+		want[node.ID.AsKey()] = struct{}{}
+		// too old to be a seed
+		node = &Node{Addr: "nd", ID: ToHash([]byte{90, 1, 1}), Time: time.Now().Unix()}
+		require.Nil(t, db.updateNode(node))
+		err = db.updateLastPongReceived(ToHash([]byte{7, 63, 74}), time.Now())
+		err = db.updateLastPongReceived(ToHash([]byte{24, 26, 84}), time.Now())
+		err = db.updateLastPongReceived(ToHash([]byte{60, 14, 24}), time.Now())
+		err = db.updateLastPongReceived(ToHash([]byte{90, 1, 1}), time.Now().Add(-24*time.Hour))
+		nodes := db.querySeeds(5, time.Hour*12)
+		for _, node = range nodes {
+			have[node.ID.AsKey()] = struct{}{}
+		}
+		if len(have) != len(want) {
+			t.Error(name, "quert count mistake", "have:", len(have), "want:", len(want))
+		}
+
+		for id := range have {
+			if _, ok := want[id]; !ok {
+				t.Error(name, "extra missed : ", id)
+			}
+		}
+		db.close()
 	}
-	want[node.ID.AsKey()] = struct{}{}
-	err = db.updateLastPongReceived(ToHash([]byte{7, 63, 74}), time.Now())
-	err = db.updateLastPongReceived(ToHash([]byte{24, 26, 84}), time.Now())
-	err = db.updateLastPongReceived(ToHash([]byte{60, 14, 24}), time.Now())
-	nodes := db.querySeeds(5, time.Hour*12)
-	for _, node = range nodes {
-		have[node.ID.AsKey()] = struct{}{}
+}
+
+func Test_iterateExpire(t *testing.T) {
+	for name, db := range dbsForTest(t, Hash{}) {
+		fresh, stale := ToHash([]byte{1}), ToHash([]byte{2})
+		for _, id := range []Hash{fresh, stale} {
+			require.Nil(t, db.updateNode(NewNode(id, "na")))
+		}
+		require.Nil(t, db.updateLastPongReceived(fresh, time.Now()))
+		require.Nil(t, db.updateLastPongReceived(stale, time.Now().Add(-2*db.cfg.nodeDBNodeExpiration)))
+
+		count := 0
+		require.Nil(t, db.store.Iterate(func(n *Node) bool {
+			count++
+			return true
+		}))
+		assert.Equal(t, 2, count, name)
+		count = 0
+		require.Nil(t, db.store.Iterate(func(n *Node) bool {
+			count++
+			return false
+		}))
+		assert.Equal(t, 1, count, name)
+
+		// ids without a node expire on their own last seen
+		seen, unseen := ToHash([]byte{3}), ToHash([]byte{4})
+		require.Nil(t, db.updateLastPingReceived(seen, time.Now().Add(-2*db.cfg.nodeDBNodeExpiration)))
+		require.Nil(t, db.updateStats(seen, func(s *NodeStats) { s.seen(time.Now()) }))
+		require.Nil(t, db.updateLastPingReceived(unseen, time.Now().Add(-2*db.cfg.nodeDBNodeExpiration)))
+		require.Nil(t, db.updateStats(unseen, func(s *NodeStats) { s.seen(time.Now().Add(-2 * db.cfg.nodeDBNodeExpiration)) }))
+
+		require.Nil(t, db.expireNodes())
+		assert.NotNil(t, db.getNode(fresh), name)
+		assert.Nil(t, db.getNode(stale), name)
+		assert.NotNil(t, db.nodeStats(seen), name)
+		assert.Nil(t, db.nodeStats(unseen), name)
+		assert.Equal(t, int64(0), db.lastPingReceived(unseen).Unix(), name)
+		db.close()
 	}
-	if len(have) != len(want) {
-		t.Error("quert count mistake", "have:", len(have), "want:", len(want))
+}
+
+func Test_values(t *testing.T) {
+	for name, db := range dbsForTest(t, Hash{}) {
+		live, stale := ToHash([]byte{1}), ToHash([]byte{2})
+		require.Nil(t, db.putValue(live, []byte("live"), time.Now().Add(time.Hour), true))
+		require.Nil(t, db.putValue(stale, []byte("stale"), time.Now().Add(-time.Second), false))
+
+		sv := db.getValue(live)
+		require.NotNil(t, sv)
+		assert.Equal(t, []byte("live"), sv.Data)
+		assert.True(t, sv.Origin)
+		assert.Nil(t, db.getValue(stale), "expired value returned")
+
+		origin := db.originValues()
+		require.Len(t, origin, 1)
+		assert.True(t, origin[0].Key.Equal(live))
+
+		require.Nil(t, db.expireValues())
+		assert.Nil(t, db.store.(ValueStore).Value(stale), "%v: expired value not dropped", name)
+		assert.NotNil(t, db.getValue(live))
+		db.close()
 	}
+}
 
-	for id := range have {
-		if _, ok := want[id]; !ok {
-			t.Error("extra missed : ", id)
-		}
+func Test_remoteValues(t *testing.T) {
+	for name, db := range dbsForTest(t, Hash{}) {
+		a, b, c := ToHash([]byte{1}), ToHash([]byte{2}), ToHash([]byte{3})
+		later := time.Now().Add(time.Hour)
+		require.Nil(t, db.putValue(a, []byte("origin"), later, true))
+		require.Nil(t, db.putRemoteValue(b, []byte("bb"), later, 1, 4), name)
+		num, bytes := db.store.(ValueStore).RemoteValues()
+		assert.Equal(t, 1, num, name)
+		assert.Equal(t, 2, bytes, name)
+
+		assert.Equal(t, VALUE_QUOTA_ERR, db.putRemoteValue(c, []byte("c"), later, 1, 4), name)
+		assert.Nil(t, db.putRemoteValue(b, []byte("bbbb"), later, 1, 4), "%v: replaced value counted", name)
+		assert.Equal(t, VALUE_QUOTA_ERR, db.putRemoteValue(b, []byte("bbbbb"), later, 1, 4), name)
+		assert.Equal(t, VALUE_ORIGIN_ERR, db.putRemoteValue(a, []byte("a"), later, 2, 8), name)
+
+		// expired values make room
+		require.Nil(t, db.putRemoteValue(b, []byte("bb"), time.Now().Add(-time.Second), 1, 4))
+		assert.Nil(t, db.putRemoteValue(c, []byte("c"), later, 1, 4), name)
+		num, bytes = db.store.(ValueStore).RemoteValues()
+		assert.Equal(t, 1, num, name)
+		assert.Equal(t, 1, bytes, name)
+		db.close()
 	}
+}
+
+func TestSchema(t *testing.T) {
+	initTest()
+	path, err := ioutil.TempDir("", tmpDBName)
+	require.Nil(t, err)
+	cfg := DefaultConfig()
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, path, nil, cfg)
+	require.Nil(t, err)
+	require.Nil(t, tab.db.updateNode(NewNode(randHashForTest(), "na")))
+	tab.db.close()
+
+	// ids of another length
+	short := DefaultConfig()
+	short.HashLength = 32
+	_, err = NewTable(testNet, TEST_SELF_ID[:32], TEST_SELF_ADDR, path, nil, short)
+	serr, ok := errors.Cause(err).(*SchemaError)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, "hash length", serr.Key)
+	assert.Equal(t, path, serr.Path)
+
+	// same without the hash length key, as written before it existed
+	store, err := NewLevelDBStore(path, cfg)
+	require.Nil(t, err)
+	require.Nil(t, store.lvl.Delete(store.makeKey(nil, levelHashLength), nil))
+	require.Nil(t, store.Close())
+	_, err = NewLevelDBStore(path, short)
+	assert.IsType(t, &SchemaError{}, errors.Cause(err))
+
+	// written by a newer version
+	store, err = NewLevelDBStore(path, cfg)
+	require.Nil(t, err)
+	require.Nil(t, store.storeInt64(store.makeKey(nil, levelSchema), levelSchemaVersion+1))
+	require.Nil(t, store.Close())
+	_, err = NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, path, nil, cfg)
+	serr, ok = errors.Cause(err).(*SchemaError)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, "schema version", serr.Key)
+}
+
+func TestBindSelf(t *testing.T) {
+	path, err := ioutil.TempDir("", tmpDBName)
+	require.Nil(t, err)
+	self, other := randHashForTest(), randHashForTest()
+	node := NewNode(randHashForTest(), "na")
+
+	db, err := openNodeDB(path, self, DefaultConfig())
+	require.Nil(t, err)
+	require.Nil(t, db.updateNode(node))
+	require.Nil(t, db.storeLocalSeq(5))
+	db.close()
+
+	db, err = openNodeDB(path, self, DefaultConfig())
+	require.Nil(t, err)
+	assert.NotNil(t, db.getNode(node.ID), "dropped for the same node")
+	db.close()
+
+	// refused for another node, the operator decides
+	_, err = openNodeDB(path, other, DefaultConfig())
+	serr, ok := errors.Cause(err).(*SchemaError)
+	require.True(t, ok, "got %v", err)
+	assert.Equal(t, "local node id", serr.Key)
+	assert.Equal(t, path, serr.Path)
+	_, err = NewTable(testNet, other, TEST_SELF_ADDR, path, nil, nil)
+	assert.IsType(t, &SchemaError{}, errors.Cause(err))
+
+	store, err := NewLevelDBStore(path, DefaultConfig())
+	require.Nil(t, err)
+	require.Nil(t, store.Rebind(other))
+	require.Nil(t, store.Close())
+	db, err = openNodeDB(path, other, DefaultConfig())
+	require.Nil(t, err)
+	defer db.close()
+	assert.Nil(t, db.getNode(node.ID), "kept for another node")
+	assert.Equal(t, uint64(0), db.localSeq())
+	store = db.store.(*LevelDBStore)
+	assert.Equal(t, int64(levelSchemaVersion), store.getInt64(store.makeKey(nil, levelSchema)))
+}
+
+// nodeOnlyStore hides the value methods of its store
+type nodeOnlyStore struct {
+	NodeStore
+	closed bool
+}
+
+func (s *nodeOnlyStore) Close() error {
+	s.closed = true
+	return s.NodeStore.Close()
+}
+
+func TestTableStore(t *testing.T) {
+	initTest()
+	store := &nodeOnlyStore{NodeStore: NewMemoryStore(nil)}
+	cfg := DefaultConfig()
+	cfg.Store = store
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "ignored", nil, cfg)
+	require.Nil(t, err, "new table err")
+
+	key, _ := GenerateKey(SchemeEd25519)
+	r := signedRecordForTest(t, key, 1, "10.0.0.1:30303")
+	require.Nil(t, tab.add(NewNodeFromRecord(r)))
+	assert.NotNil(t, store.Node(r.ID), "record not kept in the store")
+	assert.Equal(t, VALUE_UNSUPPORTED_ERR, tab.Put(randHashForTest(), []byte("v"), time.Hour))
 
+	tab.db.close()
+	assert.True(t, store.closed)
 }
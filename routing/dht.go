@@ -0,0 +1,246 @@
+package routing
+
+import (
+	ctx "context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	VALUE_NOT_FOUND_ERR   = errors.New("value not found")
+	VALUE_SIZE_ERR        = errors.New("value empty or too large")
+	VALUE_TTL_ERR         = errors.New("value ttl not positive")
+	VALUE_STORE_ERR       = errors.New("value stored on no remote node")
+	VALUE_UNSUPPORTED_ERR = errors.New("transport can't carry values")
+	VALUE_ORIGIN_ERR      = errors.New("value published by the local node")
+	VALUE_QUOTA_ERR       = errors.New("values of remote nodes over the quota")
+)
+
+// ValueReply answers a FIND_VALUE request,
+// it holds either the value or the nodes closest to its key
+type ValueReply struct {
+	Value []byte
+	TTL   time.Duration // time left before the value expires
+	Nodes []INode
+}
+
+// ValueTransport is implemented by transports able to carry
+// STORE and FIND_VALUE requests, Table.Put and Table.Get need it
+type ValueTransport interface {
+	Store(cctx ctx.Context, addr string, key Hash, value []byte, ttl time.Duration) error
+	FindValue(cctx ctx.Context, addr string, key Hash) (*ValueReply, error)
+}
+
+// ValueHandler is the inbound half of ValueTransport
+type ValueHandler interface {
+	HandleStore(from INode, key Hash, value []byte, ttl time.Duration) error
+	HandleFindValue(from INode, key Hash) (*ValueReply, error)
+}
+
+// Put stores value under key on the nodes closest to key,
+// the local copy is republished until ttl runs out. Nothing is stored
+// when the transport can't carry values, and the local copy is kept
+// when no remote node took it, VALUE_STORE_ERR is returned then
+func (t *Table) Put(key Hash, value []byte, ttl time.Duration) error {
+	if err := t.checkValue(key, value, ttl); err != nil {
+		return err
+	}
+	vt, ok := t.net.(ValueTransport)
+	if !ok {
+		return VALUE_UNSUPPORTED_ERR
+	}
+	expires := t.cfg.clock.Now().Add(ttl)
+	if err := t.db.putValue(key, value, expires, true); err != nil {
+		return err
+	}
+	if t.storeOnClosest(vt, key, value, expires) == 0 {
+		return VALUE_STORE_ERR
+	}
+	return nil
+}
+
+// Get returns the value stored under key, asking the network
+// with an iterative FIND_VALUE when it's not held locally
+func (t *Table) Get(key Hash) ([]byte, error) {
+	if err := t.CheckHash(key); err != nil {
+		return nil, err
+	}
+	if sv := t.db.getValue(key); sv != nil {
+		return sv.Data, nil
+	}
+	vt, ok := t.net.(ValueTransport)
+	if !ok {
+		return nil, VALUE_UNSUPPORTED_ERR
+	}
+	return t.getValueByNet(vt, key)
+}
+
+func (t *Table) checkValue(key Hash, value []byte, ttl time.Duration) error {
+	if err := t.CheckHash(key); err != nil {
+		return err
+	}
+	if len(value) == 0 || len(value) > t.cfg.maxValueSize {
+		return VALUE_SIZE_ERR
+	}
+	if ttl <= 0 {
+		return VALUE_TTL_ERR
+	}
+	return nil
+}
+
+// storeValue keeps a value sent by a remote node, the values
+// published by ourselves can't be replaced by remote nodes and
+// the ones of remote nodes are kept under the quota of the config
+func (t *Table) storeValue(key Hash, value []byte, ttl time.Duration) error {
+	if err := t.checkValue(key, value, ttl); err != nil {
+		return err
+	}
+	if ttl > t.cfg.maxValueTTL {
+		ttl = t.cfg.maxValueTTL
+	}
+	expires := t.cfg.clock.Now().Add(ttl)
+	return t.db.putRemoteValue(key, value, expires, t.cfg.maxRemoteValues, t.cfg.maxRemoteBytes)
+}
+
+// storeOnClosest sends the value to the nodes closest to key,
+// it returns how many of them accepted it
+func (t *Table) storeOnClosest(vt ValueTransport, key Hash, value []byte, expires time.Time) int {
+	nodes := t.getNodesByNetCallback(key, nil, false)
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		stored int
+	)
+	for _, n := range nodes {
+		ttl := expires.Sub(t.cfg.clock.Now())
+		if ttl <= 0 {
+			break
+		}
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if err := vt.Store(WithNodeID(ctx.Background(), n.GetID()), n.GetAddr(), key, value, ttl); err == nil {
+				mutex.Lock()
+				stored++
+				mutex.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	return stored
+}
+
+type valueResult struct {
+	from *Node
+	rsp  *ValueReply
+	err  error
+}
+
+func (t *Table) getValueByNet(vt ValueTransport, key Hash) ([]byte, error) {
+	var (
+		asked          = make(map[HashKey]bool)
+		seen           = make(map[HashKey]bool)
+		result         *nodesByDistance
+		missed         = &nodesByDistance{target: key, metric: t.cfg.metric} // asked nodes without the value
+		reply          = make(chan valueResult, t.cfg.alpha)
+		pendingQueries = 0
+	)
+	asked[t.self.GetID().AsKey()] = true
+
+	t.mutex.Lock()
+	result = t.closest(key, t.cfg.findsize)
+	t.mutex.Unlock()
+	cctx, cancel := ctx.WithCancel(ctx.Background())
+	defer cancel()
+
+	for {
+		for i := 0; i < len(result.entries) && pendingQueries < t.cfg.alpha; i++ {
+			n := result.entries[i]
+			nodeKey := n.GetID().AsKey()
+			if !asked[nodeKey] {
+				asked[nodeKey] = true
+				seen[nodeKey] = true
+				pendingQueries++
+				go func(n *Node) {
+					rsp, err := vt.FindValue(WithNodeID(cctx, n.GetID()), n.GetAddr(), key)
+					reply <- valueResult{from: n, rsp: rsp, err: err}
+				}(n)
+			}
+		}
+		if pendingQueries == 0 {
+			break
+		}
+		r := <-reply
+		pendingQueries--
+		if r.err != nil || r.rsp == nil {
+			continue
+		}
+		if len(r.rsp.Value) > 0 {
+			t.cacheOnPath(vt, missed, key, r.rsp)
+			return r.rsp.Value, nil
+		}
+		missed.push(r.from, 1)
+		for _, in := range r.rsp.Nodes {
+			n := nodeFromINode(in)
+			if t.checkReplied(n) != nil {
+				continue
+			}
+			t.add(n)
+			nodeKey := n.GetID().AsKey()
+			if !seen[nodeKey] {
+				seen[nodeKey] = true
+				result.push(n, t.cfg.findsize)
+			}
+		}
+	}
+	return nil, VALUE_NOT_FOUND_ERR
+}
+
+// cacheOnPath stores a found value on the closest node asked that
+// didn't have it, so later lookups of popular keys end sooner
+func (t *Table) cacheOnPath(vt ValueTransport, missed *nodesByDistance, key Hash, rsp *ValueReply) {
+	ttl := rsp.TTL / 2
+	if len(missed.entries) == 0 || ttl <= 0 {
+		return
+	}
+	n := missed.entries[0]
+	go vt.Store(WithNodeID(ctx.Background(), n.GetID()), n.GetAddr(), key, rsp.Value, ttl)
+}
+
+// doRepublish sends every value published by ourselves
+// to the nodes currently closest to its key
+func (t *Table) doRepublish(done chan struct{}) {
+	defer close(done)
+	vt, ok := t.net.(ValueTransport)
+	if !ok {
+		return
+	}
+	now := t.cfg.clock.Now()
+	for _, sv := range t.db.originValues() {
+		if sv.Expires.After(now) {
+			t.storeOnClosest(vt, sv.Key, sv.Data, sv.Expires)
+		}
+	}
+}
+
+func (h *TableHandler) HandleStore(from INode, key Hash, value []byte, ttl time.Duration) error {
+	if err := h.receive(from); err != nil {
+		return err
+	}
+	return h.tab.storeValue(key, value, ttl)
+}
+
+func (h *TableHandler) HandleFindValue(from INode, key Hash) (*ValueReply, error) {
+	if err := h.receive(from); err != nil {
+		return nil, err
+	}
+	if err := h.tab.CheckHash(key); err != nil {
+		return nil, err
+	}
+	if sv := h.tab.db.getValue(key); sv != nil {
+		return &ValueReply{Value: sv.Data, TTL: sv.Expires.Sub(h.tab.cfg.clock.Now())}, nil
+	}
+	return &ValueReply{Nodes: h.tab.GetNodesLocally(key)}, nil
+}
@@ -0,0 +1,175 @@
+package routing
+
+import (
+	ctx "context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (tf *TransferForTest) Store(cctx ctx.Context, addr string, key Hash, value []byte, ttl time.Duration) error {
+	if t, ok := tf.transferMap.Load(addr); ok {
+		return NewTableHandler(t.(*Table)).HandleStore(nil, key, value, ttl)
+	}
+	return ERR_TEST_NODE_NOT_FIND
+}
+
+func (tf *TransferForTest) FindValue(cctx ctx.Context, addr string, key Hash) (*ValueReply, error) {
+	if t, ok := tf.transferMap.Load(addr); ok {
+		return NewTableHandler(t.(*Table)).HandleFindValue(nil, key)
+	}
+	return nil, ERR_TEST_NODE_NOT_FIND
+}
+
+// holders returns the tables keeping a value for key
+func (tf *TransferForTest) holders(key Hash) (ret []*Table) {
+	tf.ExecAll(func(tb *Table) bool {
+		if tb.db.getValue(key) != nil {
+			ret = append(ret, tb)
+		}
+		return true
+	})
+	return
+}
+
+func newDHTForTest(t *testing.T, num int) (*TransferForTest, []INode) {
+	tsfer := &TransferForTest{}
+	allNodes := genBootNodes(num)
+	tsfer.fillSpecificData(t, allNodes, 3)
+	tsfer.findNodeForcely(t)
+	return tsfer, allNodes
+}
+
+func closeDHTForTest(tsfer *TransferForTest) {
+	tsfer.ExecAll(func(tb *Table) bool {
+		tb.db.close()
+		return true
+	})
+	tsfer.Clear()
+}
+
+func loadTableForTest(tsfer *TransferForTest, n INode) *Table {
+	t, _ := tsfer.transferMap.Load(n.GetAddr())
+	return t.(*Table)
+}
+
+func TestPutGet(t *testing.T) {
+	initTest()
+	tsfer, allNodes := newDHTForTest(t, 30)
+	defer closeDHTForTest(tsfer)
+
+	publisher := loadTableForTest(tsfer, allNodes[0])
+	key := randHashForTest()
+	value := []byte("block 1024")
+	require.Nil(t, publisher.Put(key, value, time.Hour))
+
+	holders := tsfer.holders(key)
+	assert.True(t, len(holders) > 1, "value stored on no remote node")
+	for _, h := range holders {
+		assert.Equal(t, value, h.db.getValue(key).Data)
+	}
+
+	for _, n := range allNodes[1:] {
+		tb := loadTableForTest(tsfer, n)
+		got, err := tb.Get(key)
+		require.Nil(t, err, "get from %v", n.GetAddr())
+		assert.Equal(t, value, got)
+	}
+
+	_, err := publisher.Get(randHashForTest())
+	assert.Equal(t, VALUE_NOT_FOUND_ERR, err)
+	assert.Equal(t, VALUE_SIZE_ERR, publisher.Put(key, nil, time.Hour))
+	assert.Equal(t, VALUE_SIZE_ERR, publisher.Put(key, make([]byte, publisher.cfg.maxValueSize+1), time.Hour))
+	assert.Equal(t, VALUE_TTL_ERR, publisher.Put(key, value, 0))
+
+	// nothing is kept when the transport can't carry values
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, DefaultConfig())
+	require.Nil(t, err)
+	defer tab.db.close()
+	assert.Equal(t, VALUE_UNSUPPORTED_ERR, tab.Put(key, value, time.Hour))
+	assert.Nil(t, tab.db.getValue(key))
+	assert.Empty(t, tab.db.originValues())
+}
+
+func TestGetCachesOnPath(t *testing.T) {
+	initTest()
+	tsfer, allNodes := newDHTForTest(t, 30)
+	defer closeDHTForTest(tsfer)
+
+	// the value sits on one node only, the one closest to the key,
+	// so lookups have to walk to it
+	holder := loadTableForTest(tsfer, allNodes[len(allNodes)-1])
+	key := ToHash(holder.self.GetID())
+	key[len(key)-1] ^= 1
+	value := []byte("tx pool")
+	require.Nil(t, holder.storeValue(key, value, time.Hour))
+
+	var cached bool
+	for _, n := range allNodes[:len(allNodes)-1] {
+		got, err := loadTableForTest(tsfer, n).Get(key)
+		require.Nil(t, err)
+		require.Equal(t, value, got)
+		if len(tsfer.holders(key)) > 1 {
+			cached = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, cached, "value never cached along the lookup path")
+	for _, h := range tsfer.holders(key) {
+		if h != holder {
+			assert.False(t, h.db.getValue(key).Origin)
+			assert.True(t, time.Until(h.db.getValue(key).Expires) <= 30*time.Minute)
+		}
+	}
+}
+
+func TestRepublish(t *testing.T) {
+	initTest()
+	tsfer, allNodes := newDHTForTest(t, 20)
+	defer closeDHTForTest(tsfer)
+
+	publisher := loadTableForTest(tsfer, allNodes[0])
+	key := randHashForTest()
+	value := []byte("genesis")
+	require.Nil(t, publisher.Put(key, value, time.Hour))
+	// remote copies get lost
+	for _, h := range tsfer.holders(key) {
+		if h != publisher {
+			h.db.deleteValue(key)
+		}
+	}
+	require.Len(t, tsfer.holders(key), 1)
+
+	done := make(chan struct{})
+	publisher.doRepublish(done)
+	<-done
+	assert.True(t, len(tsfer.holders(key)) > 1, "value not republished")
+
+	// a remote store can't replace what we publish
+	h := NewTableHandler(publisher)
+	err := h.HandleStore(allNodes[1], key, []byte("forged"), time.Hour)
+	assert.Equal(t, VALUE_ORIGIN_ERR, err)
+	got, err := publisher.Get(key)
+	require.Nil(t, err)
+	assert.Equal(t, value, got)
+	origin := publisher.db.originValues()
+	require.Len(t, origin, 1)
+	assert.Equal(t, value, origin[0].Data)
+}
+
+func TestUDPPutGet(t *testing.T) {
+	initTest()
+	udps, tabs := newUDPTablesForTest(t, 3)
+	defer closeUDPTablesForTest(udps, tabs)
+
+	key := randHashForTest()
+	require.Nil(t, tabs[0].Put(key, []byte("over udp"), time.Minute))
+	for _, tb := range tabs[1:] {
+		got, err := tb.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("over udp"), got)
+	}
+}
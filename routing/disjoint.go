@@ -0,0 +1,104 @@
+package routing
+
+import (
+	ctx "context"
+	"sync"
+)
+
+// askedSet holds the nodes queried by the paths of a lookup
+type askedSet struct {
+	mutex sync.Mutex
+	nodes map[HashKey]bool
+}
+
+func newAskedSet(self Hash) *askedSet {
+	return &askedSet{nodes: map[HashKey]bool{self.AsKey(): true}}
+}
+
+// ask marks id as queried, false when a path already did
+func (s *askedSet) ask(id Hash) bool {
+	key := id.AsKey()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nodes[key] {
+		return false
+	}
+	s.nodes[key] = true
+	return true
+}
+
+// LookupDisjoint is LookupContext with paths disjoint lookup paths
+// instead of the ones of the config
+func (t *Table) LookupDisjoint(cctx ctx.Context, target Hash, paths int) ([]*Node, error) {
+	return t.lookupPaths(cctx, target, paths, nil, false)
+}
+
+// lookupPaths runs the lookup of S/Kademlia: the closest nodes of the
+// table are dealt to paths lookups that never ask the same node, so
+// that peers returning made up nodes capture only the paths they are
+// on. The union of the results of the paths is returned, up to paths
+// times FindSize nodes by distance, made up nodes being closer than
+// the honest ones found. With must the first path finding targetID
+// ends the others
+func (t *Table) lookupPaths(parent ctx.Context, targetID Hash, paths int, deal DealOnGetNodeFunc, must bool) ([]*Node, error) {
+	if err := t.CheckHash(targetID); err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	closest := t.closest(targetID, t.cfg.findsize)
+	t.mutex.Unlock()
+	if len(closest.entries) == 0 {
+		return nil, NO_PEERS_ERR
+	}
+	// queries still in flight when we return are abandoned:
+	// they get canceled and reply has room for all of them
+	cctx, cancel := ctx.WithCancel(parent)
+	defer cancel()
+	asked := newAskedSet(t.self.GetID())
+	if paths <= 1 {
+		return t.lookupPath(parent, cctx, closest, asked, deal, must)
+	}
+	if paths > len(closest.entries) {
+		paths = len(closest.entries)
+	}
+
+	type pathResult struct {
+		nodes []*Node
+		err   error
+	}
+	results := make(chan pathResult, paths)
+	for i := 0; i < paths; i++ {
+		start := &nodesByDistance{target: targetID, metric: t.cfg.metric}
+		for j := i; j < len(closest.entries); j += paths {
+			start.entries = append(start.entries, closest.entries[j])
+		}
+		go func() {
+			nodes, err := t.lookupPath(parent, cctx, start, asked, deal, must)
+			results <- pathResult{nodes, err}
+		}()
+	}
+	var (
+		union = &nodesByDistance{target: targetID, metric: t.cfg.metric}
+		seen  = make(map[HashKey]bool)
+		err   error
+	)
+	for i := 0; i < paths; i++ {
+		r := <-results
+		if must && r.err == nil {
+			return r.nodes, nil
+		}
+		if r.err != nil && (err == nil || err == NODE_NOT_FOUND_ERR) {
+			err = r.err
+		}
+		for _, n := range r.nodes {
+			if key := n.GetID().AsKey(); !seen[key] {
+				seen[key] = true
+				union.push(n, paths*t.cfg.findsize)
+			}
+		}
+	}
+	if must {
+		return nil, err
+	}
+	return union.entries, err
+}
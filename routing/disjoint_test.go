@@ -0,0 +1,158 @@
+package routing
+
+import (
+	ctx "context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lyingTransport is a TransferForTest where the liars answer every
+// findnode with made up nodes closer to the target than any other
+type lyingTransport struct {
+	*TransferForTest
+	liars map[string]bool
+	fakes uint32
+
+	mutex sync.Mutex
+	asks  map[string]int // findnodes received by addr
+}
+
+func (lt *lyingTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	lt.mutex.Lock()
+	lt.asks[addr]++
+	lt.mutex.Unlock()
+	if !lt.liars[addr] {
+		return lt.TransferForTest.FindNode(cctx, addr, target)
+	}
+	nodes := make([]INode, DefaultConfig().FindSize)
+	for i := range nodes {
+		id := ToHashN(target, len(target))
+		fake := atomic.AddUint32(&lt.fakes, 1)
+		id[len(id)-2] ^= byte(fake >> 8)
+		id[len(id)-1] ^= byte(fake) | 1
+		nodes[i] = NewNode(id, genIPForTest(1000+int(fake%60000)))
+	}
+	return nodes, nil
+}
+
+// lyingNetForTest makes a table for each of ids knowing the ids of
+// known, the first liars of them lie
+func lyingNetForTest(t *testing.T, ids []Hash, known [][]int, liars int, cfg *Config) *lyingTransport {
+	lt := &lyingTransport{
+		TransferForTest: &TransferForTest{},
+		liars:           make(map[string]bool),
+		asks:            make(map[string]int),
+	}
+	for i := range ids {
+		if i < liars {
+			lt.liars[genIPForTest(i+1)] = true
+		}
+		c := *cfg
+		tab, err := NewTable(lt, ids[i], genIPForTest(i+1), "", nil, &c)
+		require.Nil(t, err)
+		for _, j := range known[i] {
+			tab.add(NewNode(ids[j], genIPForTest(j+1)))
+		}
+		lt.transferMap.Store(genIPForTest(i+1), tab)
+	}
+	return lt
+}
+
+func (lt *lyingTransport) table(addr string) *Table {
+	tab, _ := lt.transferMap.Load(addr)
+	return tab.(*Table)
+}
+
+// resolveRateForTest resolves honest nodes from honest nodes
+// with paths disjoint paths and returns the share found
+func resolveRateForTest(lt *lyingTransport, ids []Hash, liars, paths int) float64 {
+	r := rand.New(rand.NewSource(2))
+	found, lookups := 0, 0
+	for lookups < 50 {
+		from := liars + r.Intn(len(ids)-liars)
+		to := liars + r.Intn(len(ids)-liars)
+		tab := lt.table(genIPForTest(from + 1))
+		if from == to || tab.getNodeLocally(ids[to]) != nil {
+			continue
+		}
+		lookups++
+		if _, err := tab.lookupPaths(ctx.Background(), ids[to], paths, nil, true); err == nil {
+			found++
+		}
+	}
+	return float64(found) / float64(lookups)
+}
+
+// idsForTest makes num ids, each knowing 8 others
+func idsForTest(num int) ([]Hash, [][]int) {
+	r := rand.New(rand.NewSource(1))
+	ids := make([]Hash, num)
+	known := make([][]int, num)
+	for i := range ids {
+		ids[i] = NewHash()
+		r.Read(ids[i])
+		for _, j := range r.Perm(num)[:9] {
+			if j != i && len(known[i]) < 8 {
+				known[i] = append(known[i], j)
+			}
+		}
+	}
+	return ids, known
+}
+
+func closeLyingNetForTest(lt *lyingTransport) {
+	lt.ExecAll(func(tab *Table) bool {
+		tab.db.close()
+		return true
+	})
+}
+
+func TestLookupDisjoint(t *testing.T) {
+	initTest()
+	ids, known := idsForTest(60)
+	lt := lyingNetForTest(t, ids, known, 10, DefaultConfig())
+	defer closeLyingNetForTest(lt)
+
+	tab := lt.table(genIPForTest(60))
+	target := ids[20]
+	nodes, err := tab.LookupDisjoint(ctx.Background(), target, 4)
+	require.Nil(t, err)
+	// the made up nodes come first, the honest ones are still there
+	assert.True(t, len(nodes) > tab.cfg.findsize && len(nodes) <= 4*tab.cfg.findsize, "%v nodes", len(nodes))
+	found := false
+	for i, n := range nodes {
+		found = found || n.ID.Equal(target)
+		if i > 0 {
+			assert.True(t, distance(nodes[i-1].ID, target) <= distance(n.ID, target))
+		}
+	}
+	assert.True(t, found)
+	for addr, asks := range lt.asks {
+		assert.Equal(t, 1, asks, "%v asked by several paths", addr)
+	}
+
+	_, err = tab.LookupDisjoint(ctx.Background(), Hash{1}, 4)
+	assert.Equal(t, HASH_FORMAT_ERR, err)
+}
+
+func TestDisjointLookupResistance(t *testing.T) {
+	initTest()
+	const num, liars = 100, 20
+	ids, known := idsForTest(num)
+
+	rates := make(map[int]float64)
+	for _, paths := range []int{1, 4} {
+		cfg := DefaultConfig()
+		cfg.DisjointPaths = paths
+		lt := lyingNetForTest(t, ids, known, liars, cfg)
+		rates[paths] = resolveRateForTest(lt, ids, liars, paths)
+		closeLyingNetForTest(lt)
+	}
+	t.Logf("resolved with %v%% liars: %.2f on one path, %.2f on 4 disjoint paths", 100*liars/num, rates[1], rates[4])
+	assert.True(t, rates[4] >= rates[1]+0.2, "disjoint paths don't resist better")
+}
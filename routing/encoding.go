@@ -0,0 +1,207 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// nodeEncodingVersion leads every binary node, a legacy json node
+// starts with '{' instead
+const nodeEncodingVersion byte = 1
+
+const (
+	nodeFlagRecord byte = 1 << iota
+	nodeFlagNetwork
+	nodeFlagEndpoints
+)
+
+var (
+	NODE_ENCODING_ERR = errors.New("node encoding invalid")
+)
+
+// Marshal encodes the node as:
+//
+//	version(1) | time(varint) | id | addr | flags(1) [| network] [| endpoints] [| record]
+//
+// where byte strings are prefixed with their uvarint length
+// and endpoints are a count followed by their text forms.
+func (n *Node) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(nodeEncodingVersion)
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], n.Time)])
+	writeBytes(&buf, n.ID)
+	writeBytes(&buf, []byte(n.Addr))
+	var flags byte
+	if n.Network != "" {
+		flags |= nodeFlagNetwork
+	}
+	if len(n.Endpoints) != 0 {
+		flags |= nodeFlagEndpoints
+	}
+	if n.Record != nil {
+		flags |= nodeFlagRecord
+	}
+	buf.WriteByte(flags)
+	if n.Network != "" {
+		writeBytes(&buf, []byte(n.Network))
+	}
+	if len(n.Endpoints) != 0 {
+		writeUvarint(&buf, uint64(len(n.Endpoints)))
+		for _, e := range n.Endpoints {
+			writeBytes(&buf, []byte(e.String()))
+		}
+	}
+	if n.Record == nil {
+		return buf.Bytes(), nil
+	}
+	r := n.Record
+	writeUvarint(&buf, r.Seq)
+	writeBytes(&buf, r.ID)
+	writeUvarint(&buf, uint64(len(r.Addrs)))
+	for _, addr := range r.Addrs {
+		writeBytes(&buf, []byte(addr))
+	}
+	keys := r.attrKeys()
+	writeUvarint(&buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeBytes(&buf, []byte(k))
+		writeBytes(&buf, r.Attrs[k])
+	}
+	writeBytes(&buf, []byte(r.Scheme))
+	writeBytes(&buf, r.PubKey)
+	writeBytes(&buf, r.Sig)
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a node written by Marshal,
+// the legacy json encoding is accepted as well
+func (n *Node) Unmarshal(bys []byte) error {
+	if len(bys) == 0 {
+		return NODE_ENCODING_ERR
+	}
+	if isLegacyNode(bys) {
+		return json.Unmarshal(bys, n)
+	}
+	if bys[0] != nodeEncodingVersion {
+		return errors.Wrapf(NODE_ENCODING_ERR, "unknown version %v", bys[0])
+	}
+	d := nodeDecoder{buf: bys[1:]}
+	nn := Node{
+		Time: d.varint(),
+		ID:   d.bytes(),
+		Addr: string(d.bytes()),
+	}
+	flags := d.byte()
+	if flags&nodeFlagNetwork != 0 {
+		nn.Network = string(d.bytes())
+	}
+	if flags&nodeFlagEndpoints != 0 {
+		nn.Endpoints = make([]Endpoint, d.count())
+		for i := range nn.Endpoints {
+			e, err := ParseEndpoint(string(d.bytes()))
+			if err != nil && d.err == nil {
+				d.err = errors.Wrap(NODE_ENCODING_ERR, err.Error())
+			}
+			nn.Endpoints[i] = e
+		}
+	}
+	if flags&nodeFlagRecord != 0 {
+		r := &Record{Seq: d.uvarint(), ID: d.bytes()}
+		if num := d.count(); num > 0 {
+			r.Addrs = make([]string, num)
+			for i := range r.Addrs {
+				r.Addrs[i] = string(d.bytes())
+			}
+		}
+		if num := d.count(); num > 0 {
+			r.Attrs = make(map[string][]byte, num)
+			for i := 0; i < num; i++ {
+				k := string(d.bytes())
+				r.Attrs[k] = d.bytes()
+			}
+		}
+		r.Scheme = string(d.bytes())
+		r.PubKey = d.bytes()
+		r.Sig = d.bytes()
+		nn.Record = r
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*n = nn
+	return nil
+}
+
+// isLegacyNode reports whether bys is a node written as json
+func isLegacyNode(bys []byte) bool {
+	return len(bys) > 0 && bys[0] == '{'
+}
+
+// nodeDecoder reads the fields of a binary node,
+// it keeps the first error and returns zero values after it
+type nodeDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *nodeDecoder) fail() {
+	if d.err == nil {
+		d.err = errors.Wrap(NODE_ENCODING_ERR, "truncated")
+	}
+	d.buf = nil
+}
+
+func (d *nodeDecoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *nodeDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *nodeDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads a length, it can't be more than the bytes left
+func (d *nodeDecoder) count() int {
+	v := d.uvarint()
+	if v > uint64(len(d.buf)) {
+		d.fail()
+		return 0
+	}
+	return int(v)
+}
+
+// bytes reads a length prefixed byte string, nil when empty
+func (d *nodeDecoder) bytes() []byte {
+	num := d.count()
+	if num == 0 {
+		return nil
+	}
+	b := append([]byte{}, d.buf[:num]...)
+	d.buf = d.buf[num:]
+	return b
+}
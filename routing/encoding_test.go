@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recordNodeForTest(t testing.TB) *Node {
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	r := NewRecord(key, DefaultHashLength)
+	r.Seq = 7
+	r.Addrs = []string{"10.0.0.1:30303", "[::1]:30303"}
+	r.Set("chain", []byte("main"))
+	require.Nil(t, r.Sign(key))
+	n := NewNodeFromRecord(r)
+	n.Time = time.Now().Unix()
+	return n
+}
+
+func TestNodeEncoding(t *testing.T) {
+	plain := &Node{Time: time.Now().Unix(), ID: randHashForTest(), Addr: "10.0.0.2:30303"}
+	network := &Node{Time: time.Now().Unix(), ID: randHashForTest(), Addr: "10.0.0.3:30303", Network: "testnet"}
+	e, err := ParseEndpoint("[2001:db8::1]:30303/26656")
+	require.Nil(t, err)
+	network.Endpoints = []Endpoint{e}
+	for _, n := range []*Node{plain, network, recordNodeForTest(t)} {
+		bys, err := n.Marshal()
+		require.Nil(t, err)
+		assert.Equal(t, nodeEncodingVersion, bys[0])
+
+		got := &Node{}
+		require.Nil(t, got.Unmarshal(bys))
+		assert.True(t, n.Equal(got), "got %v want %v", got, n)
+		assert.Equal(t, n.Record, got.Record)
+		assert.Equal(t, n.Network, got.Network)
+		assert.Equal(t, n.Endpoints, got.Endpoints)
+		if got.Record != nil {
+			assert.Nil(t, got.Record.Verify())
+		}
+
+		// legacy entries are still read
+		legacy, err := json.Marshal(n)
+		require.Nil(t, err)
+		got = &Node{}
+		require.Nil(t, got.Unmarshal(legacy))
+		assert.True(t, n.Equal(got))
+		assert.Equal(t, n.Network, got.Network)
+	}
+}
+
+func TestNodeEncodingStable(t *testing.T) {
+	n := recordNodeForTest(t)
+	for i := 0; i < 8; i++ {
+		n.Record.Set(fmt.Sprintf("attr%v", i), []byte{byte(i)})
+	}
+	first, err := n.Marshal()
+	require.Nil(t, err)
+	for i := 0; i < 16; i++ {
+		bys, err := n.Marshal()
+		require.Nil(t, err)
+		assert.Equal(t, first, bys)
+	}
+}
+
+func TestNodeEncodingErrors(t *testing.T) {
+	bys, err := recordNodeForTest(t).Marshal()
+	require.Nil(t, err)
+	n := &Node{}
+	for i := 0; i < len(bys); i++ {
+		assert.Equal(t, NODE_ENCODING_ERR, errors.Cause(n.Unmarshal(bys[:i])), "truncated at %v", i)
+	}
+	bys[0] = nodeEncodingVersion + 1
+	assert.Equal(t, NODE_ENCODING_ERR, errors.Cause(n.Unmarshal(bys)))
+}
+
+func TestNodeMigration(t *testing.T) {
+	path, err := ioutil.TempDir("", tmpDBName)
+	require.Nil(t, err)
+	store, err := NewLevelDBStore(path, nil)
+	require.Nil(t, err)
+	// a database written before the binary encoding
+	require.Nil(t, store.lvl.Delete(store.makeKey(nil, levelSchema), nil))
+	nodes := []*Node{recordNodeForTest(t), {Time: time.Now().Unix(), ID: randHashForTest(), Addr: "10.0.0.2:30303"}}
+	for _, n := range nodes {
+		legacy, err := json.Marshal(n)
+		require.Nil(t, err)
+		require.Nil(t, store.lvl.Put(store.makeKey(n.ID, levelDiscoverRoot), legacy, nil))
+		require.Nil(t, store.UpdateLastPongReceived(n.ID, time.Now()))
+	}
+	require.Nil(t, store.Close())
+
+	store, err = NewLevelDBStore(path, nil)
+	require.Nil(t, err)
+	defer store.Close()
+	for _, n := range nodes {
+		dbvalue, err := store.lvl.Get(store.makeKey(n.ID, levelDiscoverRoot), nil)
+		require.Nil(t, err)
+		assert.Equal(t, nodeEncodingVersion, dbvalue[0], "node not migrated")
+		got := store.Node(n.ID)
+		require.NotNil(t, got)
+		assert.True(t, n.Equal(got))
+		assert.False(t, store.LastPongReceived(n.ID).IsZero())
+	}
+	assert.Equal(t, int64(levelSchemaVersion), store.getInt64(store.makeKey(nil, levelSchema)))
+}
+
+func BenchmarkNodeMarshal(b *testing.B) {
+	n := recordNodeForTest(b)
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n.Marshal()
+		}
+	})
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			json.Marshal(n)
+		}
+	})
+}
+
+func BenchmarkNodeUnmarshal(b *testing.B) {
+	n := recordNodeForTest(b)
+	bin, _ := n.Marshal()
+	js, _ := json.Marshal(n)
+	b.Logf("binary %v bytes, json %v bytes", len(bin), len(js))
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			(&Node{}).Unmarshal(bin)
+		}
+	})
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			(&Node{}).Unmarshal(js)
+		}
+	})
+}
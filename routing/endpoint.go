@@ -0,0 +1,232 @@
+package routing
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ENDPOINT_ERR = errors.New("endpoint invalid")
+)
+
+// Endpoint is one address a node can be reached at. Its text form is
+// host:udp[/tcp], as in 1.2.3.4:30303/26656 or [2001:db8::1]:30303
+type Endpoint struct {
+	IP  net.IP // v4 or v6, nil when DNS is set
+	DNS string // host name, resolved by the caller
+	UDP uint16 // discovery port
+	TCP uint16 // data port, 0 when the node serves no data there
+}
+
+// ParseEndpoint reads and validates the text form of an endpoint,
+// the single host:port addresses of old nodes are accepted
+func ParseEndpoint(s string) (Endpoint, error) {
+	var e Endpoint
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		tcp, err := strconv.ParseUint(s[i+1:], 10, 16)
+		if err != nil {
+			return e, errors.Wrapf(ENDPOINT_ERR, "tcp port of %v", s)
+		}
+		e.TCP = uint16(tcp)
+		s = s[:i]
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return e, errors.Wrap(ENDPOINT_ERR, err.Error())
+	}
+	udp, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return e, errors.Wrapf(ENDPOINT_ERR, "udp port of %v", s)
+	}
+	e.UDP = uint16(udp)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		e.IP = ip
+	} else {
+		e.DNS = host
+	}
+	return e, e.Validate()
+}
+
+// Validate reports why the endpoint can't be dialed, ENDPOINT_ERR is the cause
+func (e Endpoint) Validate() error {
+	switch {
+	case e.UDP == 0:
+		return errors.Wrap(ENDPOINT_ERR, "no udp port")
+	case e.IP == nil && e.DNS == "":
+		return errors.Wrap(ENDPOINT_ERR, "no host")
+	case e.IP != nil && e.DNS != "":
+		return errors.Wrap(ENDPOINT_ERR, "both ip and dns name set")
+	case e.IP != nil && (e.IP.IsUnspecified() || e.IP.IsMulticast()):
+		return errors.Wrapf(ENDPOINT_ERR, "ip %v can't be dialed", e.IP)
+	case e.IP != nil && len(e.IP) != net.IPv4len && len(e.IP) != net.IPv6len:
+		return errors.Wrap(ENDPOINT_ERR, "ip length")
+	case e.DNS != "" && !validDNSName(e.DNS):
+		return errors.Wrapf(ENDPOINT_ERR, "dns name %q", e.DNS)
+	}
+	return nil
+}
+
+func validDNSName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e Endpoint) host() string {
+	if e.IP != nil {
+		return e.IP.String()
+	}
+	return e.DNS
+}
+
+// Is4 reports whether the endpoint is an ipv4 address
+func (e Endpoint) Is4() bool {
+	return e.IP.To4() != nil
+}
+
+// Is6 reports whether the endpoint is an ipv6 address
+func (e Endpoint) Is6() bool {
+	return e.IP != nil && e.IP.To4() == nil
+}
+
+// UDPAddr is the host:port of the discovery port
+func (e Endpoint) UDPAddr() string {
+	return net.JoinHostPort(e.host(), strconv.Itoa(int(e.UDP)))
+}
+
+// TCPAddr is the host:port of the data port, "" without one
+func (e Endpoint) TCPAddr() string {
+	if e.TCP == 0 {
+		return ""
+	}
+	return net.JoinHostPort(e.host(), strconv.Itoa(int(e.TCP)))
+}
+
+func (e Endpoint) String() string {
+	if e.TCP == 0 {
+		return e.UDPAddr()
+	}
+	return e.UDPAddr() + "/" + strconv.Itoa(int(e.TCP))
+}
+
+func (e Endpoint) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *Endpoint) UnmarshalText(text []byte) error {
+	pe, err := ParseEndpoint(string(text))
+	if err != nil {
+		return err
+	}
+	*e = pe
+	return nil
+}
+
+// EndpointPolicy tells which endpoints a caller can use
+type EndpointPolicy struct {
+	IPv4    bool
+	IPv6    bool
+	DNS     bool
+	NeedTCP bool // skip the endpoints without a data port
+}
+
+func (p EndpointPolicy) accepts(e Endpoint) bool {
+	if p.NeedTCP && e.TCP == 0 {
+		return false
+	}
+	switch {
+	case e.Is4():
+		return p.IPv4
+	case e.Is6():
+		return p.IPv6
+	default:
+		return p.DNS
+	}
+}
+
+// EndpointsNode is implemented by INodes advertising several endpoints
+type EndpointsNode interface {
+	INode
+	GetEndpoints() []Endpoint
+}
+
+// GetEndpoints returns the endpoints advertised by n, or the one
+// of its address when it has none and the address parses. The
+// endpoints of a node with a record are the ones it signed
+func (n *Node) GetEndpoints() []Endpoint {
+	if n.Record != nil {
+		if endpoints := endpointsFromAddrs(n.Record.Addrs); len(endpoints) != 0 {
+			return endpoints
+		}
+	} else if len(n.Endpoints) != 0 {
+		return n.Endpoints
+	}
+	if e, err := ParseEndpoint(n.Addr); err == nil {
+		return []Endpoint{e}
+	}
+	return nil
+}
+
+// FirstEndpoint returns the first endpoint of n, in the order it
+// advertises them, the caller can use with p. Literal ips are
+// preferred over dns names as they need no resolution, the
+// endpoints aren't ranked by their reachability
+func (n *Node) FirstEndpoint(p EndpointPolicy) (Endpoint, bool) {
+	var dns *Endpoint
+	for _, e := range n.GetEndpoints() {
+		if !p.accepts(e) {
+			continue
+		}
+		if e.IP != nil {
+			return e, true
+		}
+		if dns == nil {
+			e := e
+			dns = &e
+		}
+	}
+	if dns != nil {
+		return *dns, true
+	}
+	return Endpoint{}, false
+}
+
+// checkEndpoints validates the endpoints a node advertises
+func (n *Node) checkEndpoints() error {
+	for _, e := range n.Endpoints {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointsFromAddrs parses the addresses of a record,
+// the ones that don't parse are skipped
+func endpointsFromAddrs(addrs []string) []Endpoint {
+	var endpoints []Endpoint
+	for _, addr := range addrs {
+		if e, err := ParseEndpoint(addr); err == nil {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,98 @@
+package routing
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	cases := []struct {
+		text string
+		want Endpoint
+	}{
+		{"1.2.3.4:30303", Endpoint{IP: net.ParseIP("1.2.3.4").To4(), UDP: 30303}},
+		{"1.2.3.4:30303/26656", Endpoint{IP: net.ParseIP("1.2.3.4").To4(), UDP: 30303, TCP: 26656}},
+		{"[2001:db8::1]:30303/26656", Endpoint{IP: net.ParseIP("2001:db8::1"), UDP: 30303, TCP: 26656}},
+		{"seed.example.org:30303", Endpoint{DNS: "seed.example.org", UDP: 30303}},
+	}
+	for _, c := range cases {
+		e, err := ParseEndpoint(c.text)
+		require.Nil(t, err, c.text)
+		assert.Equal(t, c.want, e, c.text)
+		assert.Equal(t, c.text, e.String())
+	}
+
+	for _, text := range []string{"na", "1.2.3.4", "1.2.3.4:0", "1.2.3.4:30303/x", "224.0.0.1:30303", "0.0.0.0:30303", "bad_name:30303", "-a.org:30303"} {
+		_, err := ParseEndpoint(text)
+		assert.Equal(t, ENDPOINT_ERR, errors.Cause(err), text)
+	}
+}
+
+func TestFirstEndpoint(t *testing.T) {
+	n := NewNode(randHashForTest(), "1.2.3.4:30303")
+	assert.Len(t, n.GetEndpoints(), 1, "legacy address not parsed")
+
+	for _, text := range []string{"seed.example.org:30303/26656", "[2001:db8::1]:30303", "1.2.3.4:30303/26656"} {
+		e, err := ParseEndpoint(text)
+		require.Nil(t, err)
+		n.Endpoints = append(n.Endpoints, e)
+	}
+	best := func(p EndpointPolicy) string {
+		e, ok := n.FirstEndpoint(p)
+		if !ok {
+			return ""
+		}
+		return e.String()
+	}
+	assert.Equal(t, "[2001:db8::1]:30303", best(EndpointPolicy{IPv4: true, IPv6: true, DNS: true}))
+	assert.Equal(t, "1.2.3.4:30303/26656", best(EndpointPolicy{IPv4: true, IPv6: true, DNS: true, NeedTCP: true}))
+	assert.Equal(t, "seed.example.org:30303/26656", best(EndpointPolicy{IPv6: true, DNS: true, NeedTCP: true}))
+	assert.Equal(t, "", best(EndpointPolicy{IPv6: true, NeedTCP: true}))
+
+	// only the endpoints signed in a record count
+	n.Record = &Record{Addrs: []string{"5.6.7.8:30303"}}
+	assert.Equal(t, "5.6.7.8:30303", best(EndpointPolicy{IPv4: true, IPv6: true, DNS: true}))
+	assert.Equal(t, "", best(EndpointPolicy{IPv6: true, DNS: true}))
+}
+
+func TestNodeEndpoints(t *testing.T) {
+	initTest()
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	cfg := DefaultConfig()
+	cfg.PrivateKey = key
+	for _, text := range []string{"1.2.3.4:30303/26656", "[2001:db8::1]:30303/26656"} {
+		e, err := ParseEndpoint(text)
+		require.Nil(t, err)
+		cfg.Endpoints = append(cfg.Endpoints, e)
+	}
+	tab, err := NewTable(deadTransport{}, IDFromPubKey(key.PubKey(), cfg.HashLength), "1.2.3.4:30303", "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	// the record carries every endpoint
+	require.NotNil(t, tab.self.Record)
+	assert.Equal(t, []string{"1.2.3.4:30303/26656", "[2001:db8::1]:30303/26656"}, tab.self.Record.Addrs)
+	n := NewNodeFromRecord(tab.self.Record)
+	assert.Equal(t, "1.2.3.4:30303", n.Addr)
+	assert.Equal(t, cfg.Endpoints, n.Endpoints)
+
+	// so does json
+	bys, err := json.Marshal(n)
+	require.Nil(t, err)
+	got := &Node{}
+	require.Nil(t, json.Unmarshal(bys, got))
+	assert.Equal(t, cfg.Endpoints, got.Endpoints)
+
+	bad := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	bad.Endpoints = []Endpoint{{IP: net.ParseIP("1.2.3.1"), UDP: 0}}
+	assert.Equal(t, ENDPOINT_ERR, errors.Cause(tab.add(bad)))
+
+	cfg.Endpoints = bad.Endpoints
+	assert.Equal(t, CONFIG_ERR, errors.Cause(cfg.Validate()))
+}
@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"fmt"
+	"sync"
+)
+
+type EventType int
+
+const (
+	NodeAdded               EventType = iota + 1 // node entered a bucket
+	NodeRemoved                                  // node left a bucket
+	NodeReplaced                                 // a replacement took the place of Old
+	NodeMovedToReplacements                      // bucket full, node kept as a replacement
+	RevalidationFailed                           // node didn't answer the revalidation ping
+)
+
+func (e EventType) String() string {
+	switch e {
+	case NodeAdded:
+		return "NodeAdded"
+	case NodeRemoved:
+		return "NodeRemoved"
+	case NodeReplaced:
+		return "NodeReplaced"
+	case NodeMovedToReplacements:
+		return "NodeMovedToReplacements"
+	case RevalidationFailed:
+		return "RevalidationFailed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(e))
+}
+
+// TableEvent describes a change of the table membership
+type TableEvent struct {
+	Type   EventType
+	Node   *Node
+	Old    *Node // the node replaced, only set for NodeReplaced
+	Bucket int   // index of the bucket changed
+}
+
+func (e TableEvent) String() string {
+	if e.Old != nil {
+		return fmt.Sprintf("%v bucket:%v node:{%v} old:{%v}", e.Type, e.Bucket, e.Node, e.Old)
+	}
+	return fmt.Sprintf("%v bucket:%v node:{%v}", e.Type, e.Bucket, e.Node)
+}
+
+// Subscription delivers table events to a channel until Unsubscribe
+type Subscription struct {
+	tab  *Table
+	ch   chan<- TableEvent
+	once sync.Once
+}
+
+// Subscribe sends every later membership change to ch.
+// The table never waits for a subscriber: events that don't fit in ch
+// are dropped, so ch should be buffered and drained promptly
+func (t *Table) Subscribe(ch chan<- TableEvent) *Subscription {
+	sub := &Subscription{tab: t, ch: ch}
+	t.subMutex.Lock()
+	if t.subs == nil {
+		t.subs = make(map[*Subscription]struct{})
+	}
+	t.subs[sub] = struct{}{}
+	t.subMutex.Unlock()
+	return sub
+}
+
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.tab.subMutex.Lock()
+		delete(s.tab.subs, s)
+		s.tab.subMutex.Unlock()
+	})
+}
+
+func (t *Table) emit(ev TableEvent) {
+	t.subMutex.Lock()
+	for sub := range t.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+	t.subMutex.Unlock()
+}
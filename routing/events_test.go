@@ -0,0 +1,107 @@
+package routing
+
+import (
+	ctx "context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadTransport never gets an answer
+type deadTransport struct{}
+
+func (deadTransport) Ping(addr string) error { return ERR_TEST_NODE_NOT_FIND }
+
+func (deadTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	return nil, ERR_TEST_NODE_NOT_FIND
+}
+
+// farNodeForTest makes a node falling in the farthest bucket of self
+func farNodeForTest(self Hash, i int) *Node {
+	id := ToHash(self)
+	id[0] ^= 0x80
+	id[len(id)-1] = byte(i)
+	return NewNode(id, fmt.Sprintf("10.0.0.%v:30303", i))
+}
+
+func nextEventForTest(t *testing.T, ch chan TableEvent) TableEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event")
+	}
+	return TableEvent{}
+}
+
+func TestSubscribe(t *testing.T) {
+	initTest()
+	cfg := DefaultConfig()
+	cfg.BucketSize = 2
+	cfg.MaxReplacements = 1
+	cfg.RevalidateInterval = time.Hour
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	ch := make(chan TableEvent, 16)
+	sub := tab.Subscribe(ch)
+	far := len(tab.buckets) - 1
+	n1, n2, n3 := farNodeForTest(TEST_SELF_ID, 1), farNodeForTest(TEST_SELF_ID, 2), farNodeForTest(TEST_SELF_ID, 3)
+
+	require.Nil(t, tab.add(n1))
+	assert.Equal(t, TableEvent{Type: NodeAdded, Node: n1, Bucket: far}, nextEventForTest(t, ch))
+	require.Nil(t, tab.add(n2))
+	assert.Equal(t, TableEvent{Type: NodeAdded, Node: n2, Bucket: far}, nextEventForTest(t, ch))
+	// bucket full
+	require.Nil(t, tab.add(n3))
+	assert.Equal(t, TableEvent{Type: NodeMovedToReplacements, Node: n3, Bucket: far}, nextEventForTest(t, ch))
+	// known nodes are only bumped
+	require.Nil(t, tab.add(n1))
+	require.Nil(t, tab.add(n3))
+	assert.Len(t, ch, 0)
+
+	// the last entry fails revalidation and n3 takes its place
+	last := tab.buckets[far].entries[1]
+	for len(ch) == 0 {
+		done := make(chan struct{}, 1)
+		tab.doRevalidate(done)
+	}
+	assert.Equal(t, TableEvent{Type: RevalidationFailed, Node: last, Bucket: far}, nextEventForTest(t, ch))
+	assert.Equal(t, TableEvent{Type: NodeReplaced, Node: n3, Old: last, Bucket: far}, nextEventForTest(t, ch))
+
+	tab.delete(n3)
+	assert.Equal(t, TableEvent{Type: NodeRemoved, Node: n3, Bucket: far}, nextEventForTest(t, ch))
+	// deleting an unknown node changes nothing
+	tab.delete(n3)
+	assert.Len(t, ch, 0)
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	require.Nil(t, tab.add(n3))
+	assert.Len(t, ch, 0)
+	assert.Len(t, tab.subs, 0)
+}
+
+func TestSubscribeFullChannel(t *testing.T) {
+	initTest()
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	slow := make(chan TableEvent, 1)
+	fast := make(chan TableEvent, 4)
+	tab.Subscribe(slow)
+	tab.Subscribe(fast)
+	for i := 1; i <= 4; i++ {
+		require.Nil(t, tab.add(farNodeForTest(TEST_SELF_ID, i)))
+	}
+	// a full channel neither blocks the table nor the other subscribers
+	assert.Len(t, slow, 1)
+	assert.Len(t, fast, 4)
+	assert.Equal(t, "NodeAdded", (<-slow).Type.String())
+	assert.Equal(t, "EventType(42)", EventType(42).String())
+}
@@ -0,0 +1,32 @@
+package routing
+
+// TableHandler is the adapter answering inbound requests with a Table,
+// every sender is offered to the table before it gets an answer.
+// The requests over the rate limits of the table are refused first
+type TableHandler struct {
+	tab *Table
+}
+
+func NewTableHandler(tab *Table) *TableHandler {
+	return &TableHandler{tab: tab}
+}
+
+func (h *TableHandler) HandlePing(from INode) error {
+	return h.tab.OnReceiveReq(from)
+}
+
+func (h *TableHandler) HandleFindNode(from INode, target Hash) ([]INode, error) {
+	if err := h.receive(from); err != nil {
+		return nil, err
+	}
+	return h.tab.GetNodesLocally(target), nil
+}
+
+// receive applies the rate limits to a request and offers its sender,
+// when known, to the table
+func (h *TableHandler) receive(from INode) error {
+	if from == nil {
+		return h.tab.allowInbound(nil)
+	}
+	return h.tab.OnReceiveReq(from)
+}
@@ -0,0 +1,62 @@
+package routing
+
+import (
+	ctx "context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serverForTest records what NewTable serves on it
+type serverForTest struct {
+	self    INode
+	handler Handler
+}
+
+func (s *serverForTest) Ping(addr string) error { return nil }
+
+func (s *serverForTest) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	return nil, ERR_TEST_NODE_NOT_FIND
+}
+
+func (s *serverForTest) Serve(self INode, h Handler) {
+	s.self = self
+	s.handler = h
+}
+
+func TestNewTableServes(t *testing.T) {
+	initTest()
+	srv := &serverForTest{}
+	tab, err := NewTable(srv, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+	require.NotNil(t, srv.handler, "table not served")
+	assert.True(t, srv.self.GetID().Equal(TEST_SELF_ID))
+	assert.Equal(t, TEST_SELF_ADDR, srv.self.GetAddr())
+}
+
+func TestTableHandler(t *testing.T) {
+	initTest()
+	tab, err := NewTable(testNet, ToHash([]byte{41}), "nc", "", nil, nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+	h := NewTableHandler(tab)
+
+	pinger := NewNode(ToHash([]byte{43}), "na")
+	require.Nil(t, h.HandlePing(pinger))
+	assert.NotNil(t, tab.getNodeLocally(pinger.GetID()), "pinger not added")
+
+	finder := NewNode(ToHash([]byte{46}), "nb")
+	nodes, err := h.HandleFindNode(finder, ToHash([]byte{43}))
+	require.Nil(t, err)
+	var found bool
+	for _, n := range nodes {
+		found = found || n.GetID().Equal(pinger.GetID())
+	}
+	assert.True(t, found, "pinger not returned")
+	assert.NotNil(t, tab.getNodeLocally(finder.GetID()), "finder not added")
+
+	_, err = h.HandleFindNode(&Node{}, ToHash([]byte{43}))
+	assert.NotNil(t, err, "incomplete sender accepted")
+}
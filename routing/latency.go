@@ -0,0 +1,91 @@
+package routing
+
+import (
+	ctx "context"
+	"sort"
+	"time"
+)
+
+// queryTimeout is the time a latency aware lookup waits for a node
+// with stats s, its rtt plus four deviations as the retransmission
+// timer of tcp, within the bounds of the config. Nodes never
+// measured get the longest timeout
+func (t *Table) queryTimeout(s *NodeStats) time.Duration {
+	if s == nil || s.RTT == 0 {
+		return t.cfg.maxQueryTimeout
+	}
+	d := s.RTT + 4*s.RTTJitter
+	switch {
+	case d < t.cfg.minQueryTimeout:
+		return t.cfg.minQueryTimeout
+	case d > t.cfg.maxQueryTimeout:
+		return t.cfg.maxQueryTimeout
+	}
+	return d
+}
+
+// queryCost estimates the time a findnode to a node with stats s
+// takes to end: its rtt when it answers and its timeout when it doesn't,
+// weighted by the share of its answers. Nodes never measured cost half
+// the longest timeout, they are asked after the fast nodes and before
+// the slow or failing ones
+func (t *Table) queryCost(s *NodeStats) time.Duration {
+	if s == nil || s.RTT == 0 {
+		return t.cfg.maxQueryTimeout / 2
+	}
+	ok := s.FindRatio()
+	if s.FindOK+s.FindFail == 0 {
+		ok = s.PingRatio()
+	}
+	return time.Duration(ok*float64(s.RTT) + (1-ok)*float64(t.queryTimeout(s)))
+}
+
+// queryOrder returns the entries of result in the order a latency aware
+// lookup asks them: by log distance to the target, by cost among the
+// nodes at the same log distance and then by xor distance.
+// With LatencyTradeoff the log distance is weighted by the cost, a node
+// expected to take half the longest timeout is asked as if it was one
+// bit farther: a step of the lookup is traded for a much faster answer.
+// costs caches the costs over the lookup
+func (t *Table) queryOrder(result *nodesByDistance, costs map[HashKey]time.Duration) []*Node {
+	cost := func(n *Node) time.Duration {
+		key := n.GetID().AsKey()
+		c, ok := costs[key]
+		if !ok {
+			c = t.queryCost(t.db.nodeStats(n.GetID()))
+			costs[key] = c
+		}
+		return c
+	}
+	weighted := func(n *Node) int {
+		d := t.cfg.metric.Distance(n.GetID(), result.target)
+		if t.cfg.latencyTradeoff {
+			d += int(2 * cost(n) / t.cfg.maxQueryTimeout)
+		}
+		return d
+	}
+	order := append([]*Node{}, result.entries...)
+	sort.SliceStable(order, func(i, j int) bool {
+		di, dj := weighted(order[i]), weighted(order[j])
+		if di != dj {
+			return di < dj
+		}
+		return cost(order[i]) < cost(order[j])
+	})
+	return order
+}
+
+// withQueryTimeout is ctx.WithTimeout on the clock of the table
+func (t *Table) withQueryTimeout(parent ctx.Context, d time.Duration) (ctx.Context, ctx.CancelFunc) {
+	cctx, cancel := ctx.WithCancel(parent)
+	timer := t.cfg.clock.NewTimer(d)
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-cctx.Done():
+		}
+		timer.Stop()
+	}()
+	return cctx, cancel
+}
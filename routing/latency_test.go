@@ -0,0 +1,124 @@
+package routing
+
+import (
+	ctx "context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCost(t *testing.T) {
+	initTest()
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, DefaultConfig())
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	assert.Equal(t, 500*time.Millisecond, tab.queryTimeout(nil))
+	assert.Equal(t, 50*time.Millisecond, tab.queryTimeout(&NodeStats{RTT: 20 * time.Millisecond, RTTJitter: 5 * time.Millisecond}))
+	assert.Equal(t, 220*time.Millisecond, tab.queryTimeout(&NodeStats{RTT: 100 * time.Millisecond, RTTJitter: 30 * time.Millisecond}))
+	assert.Equal(t, 500*time.Millisecond, tab.queryTimeout(&NodeStats{RTT: time.Second}))
+
+	assert.Equal(t, 250*time.Millisecond, tab.queryCost(nil))
+	assert.Equal(t, 130*time.Millisecond, tab.queryCost(&NodeStats{
+		RTT: 100 * time.Millisecond, RTTJitter: 30 * time.Millisecond, FindOK: 3, FindFail: 1,
+	}))
+	// pings only
+	assert.Equal(t, 40*time.Millisecond, tab.queryCost(&NodeStats{RTT: 40 * time.Millisecond, PingOK: 1}))
+}
+
+func TestQueryOrder(t *testing.T) {
+	initTest()
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, DefaultConfig())
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	target := subnetNodeForTest(TEST_SELF_ID, 0, 0, "").ID
+	result := &nodesByDistance{target: target}
+	var nodes []*Node
+	for i := 1; i <= 5; i++ {
+		n := subnetNodeForTest(TEST_SELF_ID, 0, i, genIPForTest(i))
+		nodes = append(nodes, n)
+		result.push(n, 16)
+	}
+	// 1 is at distance 1 but never measured, 2 and 3 at distance 2,
+	// 3 answering faster, and 4 and 5 at distance 3, 5 being slow
+	require.Nil(t, tab.db.recordFind(nodes[0].ID, 0, false))
+	require.Nil(t, tab.db.recordFind(nodes[1].ID, 200*time.Millisecond, true))
+	require.Nil(t, tab.db.recordFind(nodes[2].ID, 20*time.Millisecond, true))
+	require.Nil(t, tab.db.recordFind(nodes[3].ID, 20*time.Millisecond, true))
+	require.Nil(t, tab.db.recordFind(nodes[4].ID, 400*time.Millisecond, true))
+
+	costs := make(map[HashKey]time.Duration)
+	order := tab.queryOrder(result, costs)
+	assert.Equal(t, []*Node{nodes[0], nodes[2], nodes[1], nodes[3], nodes[4]}, order)
+	assert.Equal(t, nodes, result.entries)
+
+	// the fast nodes may go before closer slow ones
+	tab.cfg.latencyTradeoff = true
+	order = tab.queryOrder(result, costs)
+	assert.Equal(t, []*Node{nodes[2], nodes[1], nodes[0], nodes[3], nodes[4]}, order)
+	assert.Len(t, costs, 5)
+	assert.Equal(t, 250*time.Millisecond, costs[nodes[0].ID.AsKey()])
+}
+
+// lateTransport answers findnodes after moving clock by delay,
+// unless the query is canceled within a short real time
+type lateTransport struct {
+	clock *manualClockForTest
+	delay time.Duration
+}
+
+func (ht lateTransport) Ping(addr string) error {
+	return nil
+}
+
+func (ht lateTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	ht.clock.Advance(ht.delay)
+	select {
+	case <-cctx.Done():
+		return nil, cctx.Err()
+	case <-time.After(100 * time.Millisecond):
+		return []INode{NewNode(randHashForTest(), "1.2.3.9:30303")}, nil
+	}
+}
+
+func TestAdaptiveQueryTimeout(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.LatencyAware = true
+	n := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	tab, err := NewTable(lateTransport{clock, 30 * time.Millisecond}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	// timeout of 50ms
+	require.Nil(t, tab.db.recordFind(n.ID, 20*time.Millisecond, true))
+
+	reply := make(chan []*Node, 1)
+	tab.findNodeCallback(ctx.Background(), n, randHashForTest(), reply, nil)
+	assert.Len(t, <-reply, 1)
+	st, _ := tab.NodeStats(n.ID)
+	assert.Equal(t, uint64(2), st.FindOK)
+
+	tab.net = lateTransport{clock, 80 * time.Millisecond}
+	tab.findNodeCallback(ctx.Background(), n, randHashForTest(), reply, nil)
+	assert.Len(t, <-reply, 0)
+	st, _ = tab.NodeStats(n.ID)
+	assert.Equal(t, uint64(1), st.FindFail)
+	// a node slower than its timeout isn't dropped for it
+	require.Nil(t, tab.add(n))
+	for i := 0; i < tab.cfg.maxFindFailures; i++ {
+		tab.findNodeCallback(ctx.Background(), n, randHashForTest(), reply, nil)
+		<-reply
+	}
+	assert.Equal(t, 0, tab.db.findFails(n.ID))
+	assert.NotNil(t, tab.getNodeLocally(n.ID))
+
+	// without the strategy the query waits for the answer
+	tab.cfg.latencyAware = false
+	tab.findNodeCallback(ctx.Background(), n, randHashForTest(), reply, nil)
+	assert.Len(t, <-reply, 1)
+}
@@ -0,0 +1,582 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// key layout of LevelDBStore
+const (
+	levelItemPrefix        = "n:" // Identifier to prefix node entries
+	levelValuePrefix       = "v:" // Identifier to prefix DHT values
+	levelBanPrefix         = "ban:"
+	levelDiscoverRoot      = ":discover"
+	levelDiscoverPing      = levelDiscoverRoot + ":lastping"
+	levelDiscoverPong      = levelDiscoverRoot + ":lastpong"
+	levelDiscoverFindFails = levelDiscoverRoot + ":findfail"
+	levelDiscoverStats     = levelDiscoverRoot + ":stats"
+	levelLocalSeq          = "local:seq"
+	levelSchema            = "local:schema"  // schema version of the database
+	levelSelf              = "local:self"    // id of the local node
+	levelHashLength        = "local:hashlen" // length of the node ids
+)
+
+// levelSchemaVersion is the schema written by this version,
+// databases without a schema key predate versioning and are schema 0
+const levelSchemaVersion = 1
+
+// levelMigrations[i] moves a database from schema i to i+1
+var levelMigrations = []func(db *LevelDBStore) error{
+	(*LevelDBStore).migrateNodes,
+}
+
+// LevelDBStore is the NodeStore kept in a leveldb database,
+// it also implements ValueStore, BanStore and StatsStore
+type LevelDBStore struct {
+	lvl        *leveldb.DB
+	path       string
+	hashLength int
+	rand       io.Reader
+
+	valueMutex   sync.Mutex // keeps the counts in step with the values
+	remoteValues int        // values not published by the local node
+	remoteBytes  int        // and their bytes
+}
+
+// NewLevelDBStore opens the database at path,
+// an empty path keeps it in memory
+func NewLevelDBStore(path string, cfg *Config) (*LevelDBStore, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	var db *leveldb.DB
+	var err error
+	if path == "" {
+		db, err = leveldb.Open(storage.NewMemStorage(), nil)
+	} else {
+		db, err = leveldb.OpenFile(path, nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	store := &LevelDBStore{
+		lvl:        db,
+		path:       path,
+		hashLength: cfg.HashLength,
+		rand:       cfg.randOrDefault(),
+	}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		if serr, ok := err.(*SchemaError); ok {
+			serr.Path = path
+		}
+		return nil, err
+	}
+	store.countValues()
+	return store, nil
+}
+
+// migrate brings the database to levelSchemaVersion, a *SchemaError
+// is returned for databases it can't be used with
+func (db *LevelDBStore) migrate() error {
+	version := db.getInt64(db.makeKey(nil, levelSchema))
+	if version > levelSchemaVersion {
+		return &SchemaError{Key: "schema version", Stored: fmt.Sprint(version), Want: fmt.Sprint(levelSchemaVersion)}
+	}
+	if length := db.storedHashLength(); length != 0 && length != db.hashLength {
+		return &SchemaError{Key: "hash length", Stored: fmt.Sprint(length), Want: fmt.Sprint(db.hashLength)}
+	}
+	for ; version < levelSchemaVersion; version++ {
+		if err := levelMigrations[version](db); err != nil {
+			return errors.Wrapf(err, "migrate node database to schema %v", version+1)
+		}
+		if err := db.storeInt64(db.makeKey(nil, levelSchema), version+1); err != nil {
+			return err
+		}
+	}
+	return db.storeInt64(db.makeKey(nil, levelHashLength), int64(db.hashLength))
+}
+
+// storedHashLength is the id length the database was written with,
+// guessed from its first node when it predates the hash length key
+func (db *LevelDBStore) storedHashLength() int {
+	if length := db.getInt64(db.makeKey(nil, levelHashLength)); length != 0 {
+		return int(length)
+	}
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelItemPrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		if key := it.Key(); bytes.HasSuffix(key, []byte(levelDiscoverRoot)) {
+			return len(key) - len(levelItemPrefix) - len(levelDiscoverRoot)
+		}
+	}
+	return 0
+}
+
+// BindSelf refuses with a *SchemaError the database written for another
+// local node, see Rebind
+func (db *LevelDBStore) BindSelf(self Hash) error {
+	stored, err := db.lvl.Get(db.makeKey(nil, levelSelf), nil)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	case bytes.Equal(stored, self):
+		return nil
+	default:
+		return &SchemaError{Path: db.path, Key: "local node id", Stored: fmt.Sprintf("%x", stored), Want: fmt.Sprintf("%x", self)}
+	}
+	return db.lvl.Put(db.makeKey(nil, levelSelf), self, nil)
+}
+
+// Rebind drops what was stored for another local node, the bans aside,
+// and binds the database to self
+func (db *LevelDBStore) Rebind(self Hash) error {
+	if err := db.clear(); err != nil {
+		return err
+	}
+	db.countValues()
+	return db.lvl.Put(db.makeKey(nil, levelSelf), self, nil)
+}
+
+// clear deletes everything but the schema keys and the bans
+func (db *LevelDBStore) clear() error {
+	batch := new(leveldb.Batch)
+	it := db.lvl.NewIterator(nil, nil)
+	for it.Next() {
+		switch string(it.Key()) {
+		case levelSchema, levelHashLength:
+			continue
+		}
+		if bytes.HasPrefix(it.Key(), []byte(levelBanPrefix)) {
+			continue
+		}
+		batch.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return db.lvl.Write(batch, nil)
+}
+
+// migrateNodes rewrites the nodes stored as json with the binary encoding
+func (db *LevelDBStore) migrateNodes() error {
+	batch := new(leveldb.Batch)
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelItemPrefix)), nil)
+	for it.Next() {
+		if _, field := db.splitKey(it.Key()); field != levelDiscoverRoot || !isLegacyNode(it.Value()) {
+			continue
+		}
+		n := &Node{}
+		if err := n.Unmarshal(it.Value()); err != nil {
+			log.Println("Failed to decode node", "err", err)
+			continue
+		}
+		dbvalue, err := n.Marshal()
+		if err != nil {
+			it.Release()
+			return err
+		}
+		batch.Put(append([]byte{}, it.Key()...), dbvalue)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return db.lvl.Write(batch, nil)
+}
+
+func (db *LevelDBStore) makeKey(id Hash, field string) []byte {
+	if id == nil {
+		return []byte(field)
+	}
+	// a fresh slice, appending to the prefix would share its array between calls
+	key := make([]byte, 0, len(levelItemPrefix)+len(id)+len(field))
+	key = append(key, levelItemPrefix...)
+	key = append(key, id...)
+	return append(key, field...)
+}
+
+func (db *LevelDBStore) splitKey(key []byte) (id Hash, field string) {
+	if !bytes.HasPrefix(key, []byte(levelItemPrefix)) {
+		return nil, string(key)
+	}
+	item := key[len(levelItemPrefix):]
+	if len(item) < db.hashLength {
+		return nil, string(key)
+	}
+	id.Copy(item[:db.hashLength])
+	field = string(item[len(id):])
+
+	return id, field
+}
+
+func (db *LevelDBStore) Node(id Hash) *Node {
+	dbvalue, err := db.lvl.Get(db.makeKey(id, levelDiscoverRoot), nil)
+	if err != nil {
+		return nil
+	}
+	node := &Node{}
+	if err := node.Unmarshal(dbvalue); err != nil {
+		log.Println("Failed to decode node", "err", err)
+		return nil
+	}
+	return node
+}
+
+func (db *LevelDBStore) UpdateNode(node *Node) error {
+	dbvalue, err := node.Marshal()
+	if err != nil {
+		return err
+	}
+	return db.lvl.Put(db.makeKey(node.GetID(), levelDiscoverRoot), dbvalue, nil)
+}
+
+func (db *LevelDBStore) DeleteNode(id Hash) error {
+	deleter := db.lvl.NewIterator(util.BytesPrefix(db.makeKey(id, "")), nil)
+	defer deleter.Release()
+	for deleter.Next() {
+		if err := db.lvl.Delete(deleter.Key(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *LevelDBStore) getInt64(key []byte) int64 {
+	dbvalue, err := db.lvl.Get(key, nil)
+	if err != nil {
+		return 0
+	}
+	val, nbyte := binary.Varint(dbvalue)
+	if nbyte <= 0 {
+		return 0
+	}
+	return val
+}
+
+func (db *LevelDBStore) storeInt64(key []byte, n int64) error {
+	dbvalue := make([]byte, binary.MaxVarintLen64)
+	dbvalue = dbvalue[:binary.PutVarint(dbvalue, n)]
+
+	return db.lvl.Put(key, dbvalue, nil)
+}
+
+func (db *LevelDBStore) LastPingReceived(id Hash) time.Time {
+	return time.Unix(db.getInt64(db.makeKey(id, levelDiscoverPing)), 0)
+}
+
+func (db *LevelDBStore) UpdateLastPingReceived(id Hash, instance time.Time) error {
+	return db.storeInt64(db.makeKey(id, levelDiscoverPing), instance.Unix())
+}
+
+func (db *LevelDBStore) LastPongReceived(id Hash) time.Time {
+	return time.Unix(db.getInt64(db.makeKey(id, levelDiscoverPong)), 0)
+}
+
+func (db *LevelDBStore) UpdateLastPongReceived(id Hash, instance time.Time) error {
+	return db.storeInt64(db.makeKey(id, levelDiscoverPong), instance.Unix())
+}
+
+func (db *LevelDBStore) FindFails(id Hash) int {
+	return int(db.getInt64(db.makeKey(id, levelDiscoverFindFails)))
+}
+
+func (db *LevelDBStore) UpdateFindFails(id Hash, fails int) error {
+	return db.storeInt64(db.makeKey(id, levelDiscoverFindFails), int64(fails))
+}
+
+func (db *LevelDBStore) NodeStats(id Hash) *NodeStats {
+	dbvalue, err := db.lvl.Get(db.makeKey(id, levelDiscoverStats), nil)
+	if err != nil {
+		return nil
+	}
+	s := &NodeStats{}
+	if err := s.Unmarshal(dbvalue); err != nil {
+		log.Println("Failed to decode node stats", "err", err)
+		return nil
+	}
+	return s
+}
+
+func (db *LevelDBStore) UpdateNodeStats(id Hash, s *NodeStats) error {
+	return db.lvl.Put(db.makeKey(id, levelDiscoverStats), s.Marshal(), nil)
+}
+
+func (db *LevelDBStore) LocalSeq() uint64 {
+	return uint64(db.getInt64(db.makeKey(nil, levelLocalSeq)))
+}
+
+func (db *LevelDBStore) StoreLocalSeq(seq uint64) error {
+	return db.storeInt64(db.makeKey(nil, levelLocalSeq), int64(seq))
+}
+
+func (db *LevelDBStore) QuerySeeds(n int, seen time.Time) []*Node {
+	var (
+		nodes = make([]*Node, 0, n)
+		it    = db.lvl.NewIterator(nil, nil)
+		id    = NewHashN(db.hashLength)
+	)
+
+seek:
+	for seeks := 0; len(nodes) < n && seeks < n*5; seeks++ {
+		// Seek to a random entry. The first byte is incremented by a
+		// random amount each time in order to increase the likelihood
+		// of hitting all existing nodes in very small databases.
+		ctr := id[0]
+		io.ReadFull(db.rand, id[:])
+		id[0] = ctr + id[0]%16
+		it.Seek(db.makeKey(id, levelDiscoverRoot))
+
+		node := db.nextNode(it)
+		if node == nil {
+			id[0] = 0
+			continue seek // iterator exhausted
+		}
+		if db.LastPongReceived(node.GetID()).Before(seen) {
+			continue seek
+		}
+		for i := range nodes {
+			if nodes[i].GetID().Equal(node.GetID()) {
+				continue seek // duplicate
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	it.Release()
+	return nodes
+}
+
+func (db *LevelDBStore) Iterate(fn func(n *Node) bool) error {
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelItemPrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		if node := db.nextNode(it); node == nil || !fn(node) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+// reads the next node record from the iterator, skipping over other
+// database entries.
+func (db *LevelDBStore) nextNode(it iterator.Iterator) *Node {
+	for end := false; !end; end = !it.Next() {
+		id, field := db.splitKey(it.Key())
+		if field != levelDiscoverRoot {
+			continue
+		}
+		n := &Node{}
+		if err := n.Unmarshal(it.Value()); err != nil {
+			log.Println("Failed to decode node", "id", id, "err", err)
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+// ExpireNodes drops the nodes not answering since threshold, and the
+// fields of the ids without a node not seen since then
+func (db *LevelDBStore) ExpireNodes(threshold time.Time) error {
+	// Find discovered nodes that are older than the allowance
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelItemPrefix)), nil)
+	defer it.Release()
+
+	var last Hash
+	for it.Next() {
+		// the node sorts first of the fields of its id
+		id, field := db.splitKey(it.Key())
+		if id == nil || id.Equal(last) {
+			continue
+		}
+		last = id
+		// Skip the node if not expired yet
+		if field == levelDiscoverRoot && db.LastPongReceived(id).After(threshold) {
+			continue
+		}
+		if field != levelDiscoverRoot && db.lastSeen(id).After(threshold) {
+			continue
+		}
+		// Otherwise delete all associated information
+		if err := db.DeleteNode(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastSeen is the last time id was heard of
+func (db *LevelDBStore) lastSeen(id Hash) time.Time {
+	seen := db.LastPingReceived(id)
+	if pong := db.LastPongReceived(id); pong.After(seen) {
+		seen = pong
+	}
+	if s := db.NodeStats(id); s != nil && s.LastSeen.After(seen) {
+		seen = s.LastSeen
+	}
+	return seen
+}
+
+func (db *LevelDBStore) valueKey(key Hash) []byte {
+	k := make([]byte, 0, len(levelValuePrefix)+len(key))
+	k = append(k, levelValuePrefix...)
+	return append(k, key...)
+}
+
+// countValues counts the values of remote nodes from scratch
+func (db *LevelDBStore) countValues() {
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	db.remoteValues, db.remoteBytes = 0, 0
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelValuePrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		db.countValue(decodeValue(nil, it.Value()), 1)
+	}
+}
+
+// countValue adds sv to the counts of remote values, or removes it for
+// a negative sign. db.valueMutex must be held
+func (db *LevelDBStore) countValue(sv *StoredValue, sign int) {
+	if sv != nil && !sv.Origin {
+		db.remoteValues += sign
+		db.remoteBytes += sign * len(sv.Data)
+	}
+}
+
+func (db *LevelDBStore) RemoteValues() (num, bytes int) {
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	return db.remoteValues, db.remoteBytes
+}
+
+// PutValue stores a value as: expires(varint) | origin(1) | data
+func (db *LevelDBStore) PutValue(sv *StoredValue) error {
+	dbvalue := make([]byte, binary.MaxVarintLen64+1+len(sv.Data))
+	n := binary.PutVarint(dbvalue, sv.Expires.UnixNano())
+	if sv.Origin {
+		dbvalue[n] = 1
+	}
+	n++
+	n += copy(dbvalue[n:], sv.Data)
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	old := db.Value(sv.Key)
+	if err := db.lvl.Put(db.valueKey(sv.Key), dbvalue[:n], nil); err != nil {
+		return err
+	}
+	db.countValue(old, -1)
+	db.countValue(sv, 1)
+	return nil
+}
+
+func decodeValue(key Hash, dbvalue []byte) *StoredValue {
+	expires, n := binary.Varint(dbvalue)
+	if n <= 0 || n >= len(dbvalue) {
+		return nil
+	}
+	return &StoredValue{
+		Key:     key,
+		Expires: time.Unix(0, expires),
+		Origin:  dbvalue[n] == 1,
+		Data:    append([]byte{}, dbvalue[n+1:]...),
+	}
+}
+
+func (db *LevelDBStore) Value(key Hash) *StoredValue {
+	dbvalue, err := db.lvl.Get(db.valueKey(key), nil)
+	if err != nil {
+		return nil
+	}
+	return decodeValue(key, dbvalue)
+}
+
+func (db *LevelDBStore) DeleteValue(key Hash) error {
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	old := db.Value(key)
+	if err := db.lvl.Delete(db.valueKey(key), nil); err != nil {
+		return err
+	}
+	db.countValue(old, -1)
+	return nil
+}
+
+func (db *LevelDBStore) OriginValues() []*StoredValue {
+	var values []*StoredValue
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelValuePrefix)), nil)
+	for it.Next() {
+		key := Hash(append([]byte{}, it.Key()[len(levelValuePrefix):]...))
+		if sv := decodeValue(key, it.Value()); sv != nil && sv.Origin {
+			values = append(values, sv)
+		}
+	}
+	it.Release()
+	return values
+}
+
+func (db *LevelDBStore) ExpireValues(now time.Time) error {
+	db.valueMutex.Lock()
+	defer db.valueMutex.Unlock()
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelValuePrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		sv := decodeValue(nil, it.Value())
+		if sv != nil && sv.Expires.After(now) {
+			continue
+		}
+		if err := db.lvl.Delete(it.Key(), nil); err != nil {
+			return err
+		}
+		db.countValue(sv, -1)
+	}
+	return nil
+}
+
+// PutBan stores b as json under its key
+func (db *LevelDBStore) PutBan(b *Ban) error {
+	dbvalue, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return db.lvl.Put([]byte(levelBanPrefix+b.Key()), dbvalue, nil)
+}
+
+func (db *LevelDBStore) DeleteBan(key string) error {
+	return db.lvl.Delete([]byte(levelBanPrefix+key), nil)
+}
+
+func (db *LevelDBStore) Bans() []*Ban {
+	var bans []*Ban
+	it := db.lvl.NewIterator(util.BytesPrefix([]byte(levelBanPrefix)), nil)
+	for it.Next() {
+		b := &Ban{}
+		if err := json.Unmarshal(it.Value(), b); err != nil {
+			log.Println("Failed to decode ban", "err", err)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	it.Release()
+	return bans
+}
+
+// Close flushes and closes the database files.
+func (db *LevelDBStore) Close() error {
+	return db.lvl.Close()
+}
@@ -0,0 +1,322 @@
+package routing
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a NodeStore kept in maps, it's lost on exit.
+// It also implements ValueStore, BanStore and StatsStore
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	rand     io.Reader
+	nodes    map[HashKey]*memoryEntry
+	values   map[HashKey]*StoredValue
+	bans     map[string]*Ban
+	localSeq uint64
+}
+
+type memoryEntry struct {
+	node      *Node
+	lastPing  time.Time
+	lastPong  time.Time
+	findFails int
+	stats     *NodeStats
+}
+
+func NewMemoryStore(cfg *Config) *MemoryStore {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	return &MemoryStore{
+		rand:   cfg.randOrDefault(),
+		nodes:  make(map[HashKey]*memoryEntry),
+		values: make(map[HashKey]*StoredValue),
+		bans:   make(map[string]*Ban),
+	}
+}
+
+// entry returns the entry of id, created if missing, s.mutex must be held
+func (s *MemoryStore) entry(id Hash) *memoryEntry {
+	e, ok := s.nodes[id.AsKey()]
+	if !ok {
+		e = &memoryEntry{lastPing: time.Unix(0, 0), lastPong: time.Unix(0, 0)}
+		s.nodes[id.AsKey()] = e
+	}
+	return e
+}
+
+func (s *MemoryStore) Node(id Hash) *Node {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if e, ok := s.nodes[id.AsKey()]; ok && e.node != nil {
+		n := *e.node
+		return &n
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateNode(n *Node) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cp := *n
+	cp.ID = ToHashN(n.ID, len(n.ID))
+	cp.Endpoints = append([]Endpoint(nil), n.Endpoints...)
+	s.entry(n.GetID()).node = &cp
+	return nil
+}
+
+func (s *MemoryStore) DeleteNode(id Hash) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.nodes, id.AsKey())
+	return nil
+}
+
+// times are kept to the second, as LevelDBStore does
+func (s *MemoryStore) LastPingReceived(id Hash) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if e, ok := s.nodes[id.AsKey()]; ok {
+		return e.lastPing
+	}
+	return time.Unix(0, 0)
+}
+
+func (s *MemoryStore) UpdateLastPingReceived(id Hash, instance time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entry(id).lastPing = time.Unix(instance.Unix(), 0)
+	return nil
+}
+
+func (s *MemoryStore) LastPongReceived(id Hash) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lastPong(id)
+}
+
+func (s *MemoryStore) lastPong(id Hash) time.Time {
+	if e, ok := s.nodes[id.AsKey()]; ok {
+		return e.lastPong
+	}
+	return time.Unix(0, 0)
+}
+
+func (s *MemoryStore) UpdateLastPongReceived(id Hash, instance time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entry(id).lastPong = time.Unix(instance.Unix(), 0)
+	return nil
+}
+
+func (s *MemoryStore) FindFails(id Hash) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if e, ok := s.nodes[id.AsKey()]; ok {
+		return e.findFails
+	}
+	return 0
+}
+
+func (s *MemoryStore) UpdateFindFails(id Hash, fails int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entry(id).findFails = fails
+	return nil
+}
+
+func (s *MemoryStore) NodeStats(id Hash) *NodeStats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if e, ok := s.nodes[id.AsKey()]; ok && e.stats != nil {
+		cp := *e.stats
+		return &cp
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateNodeStats(id Hash, st *NodeStats) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cp := *st
+	s.entry(id).stats = &cp
+	return nil
+}
+
+func (s *MemoryStore) LocalSeq() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.localSeq
+}
+
+func (s *MemoryStore) StoreLocalSeq(seq uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.localSeq = seq
+	return nil
+}
+
+func (s *MemoryStore) QuerySeeds(n int, seen time.Time) []*Node {
+	s.mutex.RLock()
+	var nodes []*Node
+	for _, e := range s.nodes {
+		if e.node != nil && !e.lastPong.Before(seen) {
+			cp := *e.node
+			nodes = append(nodes, &cp)
+		}
+	}
+	s.mutex.RUnlock()
+	// partial shuffle, map order is not random enough
+	for i := 0; i < len(nodes) && i < n; i++ {
+		j := i + s.intn(len(nodes)-i)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (s *MemoryStore) intn(n int) int {
+	var b [8]byte
+	io.ReadFull(s.rand, b[:])
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n))
+}
+
+func (s *MemoryStore) Iterate(fn func(n *Node) bool) error {
+	s.mutex.RLock()
+	var nodes []*Node
+	for _, e := range s.nodes {
+		if e.node != nil {
+			cp := *e.node
+			nodes = append(nodes, &cp)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, n := range nodes {
+		if !fn(n) {
+			break
+		}
+	}
+	return nil
+}
+
+// ExpireNodes drops the nodes not answering since threshold,
+// and the entries without a node not seen since then
+func (s *MemoryStore) ExpireNodes(threshold time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, e := range s.nodes {
+		if e.node != nil && !e.lastPong.After(threshold) || e.node == nil && !e.lastSeen().After(threshold) {
+			delete(s.nodes, k)
+		}
+	}
+	return nil
+}
+
+// lastSeen is the last time the node was heard of
+func (e *memoryEntry) lastSeen() time.Time {
+	seen := e.lastPing
+	if e.lastPong.After(seen) {
+		seen = e.lastPong
+	}
+	if e.stats != nil && e.stats.LastSeen.After(seen) {
+		seen = e.stats.LastSeen
+	}
+	return seen
+}
+
+func (s *MemoryStore) PutValue(sv *StoredValue) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cp := *sv
+	cp.Data = append([]byte{}, sv.Data...)
+	s.values[sv.Key.AsKey()] = &cp
+	return nil
+}
+
+func (s *MemoryStore) Value(key Hash) *StoredValue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if sv, ok := s.values[key.AsKey()]; ok {
+		cp := *sv
+		return &cp
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteValue(key Hash) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key.AsKey())
+	return nil
+}
+
+func (s *MemoryStore) OriginValues() []*StoredValue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var values []*StoredValue
+	for _, sv := range s.values {
+		if sv.Origin {
+			cp := *sv
+			values = append(values, &cp)
+		}
+	}
+	return values
+}
+
+func (s *MemoryStore) RemoteValues() (num, bytes int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, sv := range s.values {
+		if !sv.Origin {
+			num++
+			bytes += len(sv.Data)
+		}
+	}
+	return num, bytes
+}
+
+func (s *MemoryStore) ExpireValues(now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, sv := range s.values {
+		if !sv.Expires.After(now) {
+			delete(s.values, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) PutBan(b *Ban) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cp := *b
+	s.bans[b.Key()] = &cp
+	return nil
+}
+
+func (s *MemoryStore) DeleteBan(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bans, key)
+	return nil
+}
+
+func (s *MemoryStore) Bans() []*Ban {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	bans := make([]*Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		cp := *b
+		bans = append(bans, &cp)
+	}
+	return bans
+}
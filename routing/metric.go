@@ -0,0 +1,116 @@
+package routing
+
+// Metric is the notion of closeness a Table is built on: its buckets,
+// the nodes it answers with and the order lookups ask them in.
+// XORMetric, the Kademlia metric, is the default, see Config.Metric.
+// Distance is the log of the distance Compare orders by, a node at
+// a smaller Distance of a target must be closer by Compare
+type Metric interface {
+	// Distance returns the log distance from a to b,
+	// from 0 when a equals b to the bits of a hash
+	Distance(a, b Hash) int
+	// BucketIndex returns the bucket of the nodes at distance d of the
+	// local node, for hashes of bits bits spread in nbuckets buckets
+	BucketIndex(d, bits, nbuckets int) int
+	// Compare returns -1 when a is closer to target than b,
+	// 1 when b is closer and 0 when they are as close
+	Compare(target, a, b Hash) int
+}
+
+// XORMetric is the Kademlia metric, the distance of two ids is their xor
+type XORMetric struct{}
+
+func (XORMetric) Distance(a, b Hash) int {
+	return distance(a, b)
+}
+
+// BucketIndex puts each of the farthest distances in its own bucket,
+// the first bucket holds all the closer ones
+func (XORMetric) BucketIndex(d, bits, nbuckets int) int {
+	min := bits - nbuckets
+	if d <= min {
+		return 0
+	}
+	return d - min - 1
+}
+
+func (XORMetric) Compare(target, a, b Hash) int {
+	return distcmp(target, a, b)
+}
+
+// distcmp compares the xor distances of a and b to target,
+// -1 when a is closer, 1 when b is closer and 0 when a equals b.
+// Unlike distance it tells apart the nodes of the same bucket.
+// An id not as long as target is farther than any other
+func distcmp(target, a, b Hash) int {
+	switch {
+	case len(a) != len(target) && len(b) != len(target):
+		return 0
+	case len(a) != len(target):
+		return 1
+	case len(b) != len(target):
+		return -1
+	}
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			if da < db {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// distance returns the log distance of a and b, the bit length of
+// their xor. It places nodes in buckets, lookups order by distcmp
+func distance(a Hash, b Hash) int {
+	lz := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			lz += 8
+		} else {
+			lz += lzcount[x]
+			break
+		}
+	}
+	return len(a)*8 - lz
+
+}
+
+var lzcount = [256]int{
+	8, 7, 6, 6, 5, 5, 5, 5,
+	4, 4, 4, 4, 4, 4, 4, 4,
+	3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+}
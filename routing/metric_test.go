@@ -0,0 +1,105 @@
+package routing
+
+import (
+	ctx "context"
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ringMetricForTest is the clockwise distance of chord,
+// the closest nodes to a target are its predecessors
+type ringMetricForTest struct {
+	XORMetric
+}
+
+// ringDistForTest returns the clockwise distance from a to b
+func ringDistForTest(a, b Hash) *big.Int {
+	d := new(big.Int).Sub(new(big.Int).SetBytes(b), new(big.Int).SetBytes(a))
+	return d.Mod(d, new(big.Int).Lsh(big.NewInt(1), uint(len(a)*8)))
+}
+
+func (ringMetricForTest) Distance(a, b Hash) int {
+	return ringDistForTest(a, b).BitLen()
+}
+
+func (ringMetricForTest) Compare(target, a, b Hash) int {
+	return ringDistForTest(a, target).Cmp(ringDistForTest(b, target))
+}
+
+func TestXORMetric(t *testing.T) {
+	var m XORMetric
+	cases := []struct{ d, bucket int }{{320, 20}, {319, 19}, {300, 0}, {299, 0}, {0, 0}}
+	for _, c := range cases {
+		assert.Equal(t, c.bucket, m.BucketIndex(c.d, 320, 21), "distance %v", c.d)
+	}
+	a, b := Hash{0x00, 0x01}, Hash{0x00, 0x02}
+	assert.Equal(t, 2, m.Distance(a, b))
+	assert.Equal(t, -1, m.Compare(Hash{0x10, 0x00}, a, b))
+}
+
+func TestTableMetric(t *testing.T) {
+	initTest()
+	ring := ringMetricForTest{}
+	cfg := DefaultConfig()
+	cfg.Metric = ring
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	var ids []Hash
+	for i := 0; i < 50; i++ {
+		n := NewNode(randHashForTest(), genIPForTest(i+1))
+		require.Nil(t, tab.add(n))
+		if tab.getNodeLocally(n.ID) != nil {
+			ids = append(ids, n.ID)
+			d := ring.Distance(TEST_SELF_ID, n.ID)
+			assert.Equal(t, ring.BucketIndex(d, tab.cfg.hashBits, tab.cfg.nBuckets), tab.bucketIndex(n.ID))
+		}
+	}
+	require.True(t, len(ids) > tab.cfg.findsize, "%v nodes in the table", len(ids))
+
+	target := randHashForTest()
+	want := closestIDsForTest(ring, ids, target, tab.cfg.findsize)
+	for _, nodes := range [][]*Node{tab.getNodesLocally(target), tab.closest(target, tab.cfg.findsize).entries} {
+		require.Len(t, nodes, len(want))
+		for i := range want {
+			assert.True(t, nodes[i].ID.Equal(want[i]), "node %v", i)
+		}
+	}
+}
+
+func TestLookupRingMetric(t *testing.T) {
+	initTest()
+	ids, known := idsForTest(150)
+	// every node knows its successors
+	for i := range ids {
+		succ := rand.Perm(len(ids))
+		sort.Slice(succ, func(a, b int) bool {
+			return ringDistForTest(ids[i], ids[succ[a]]).Cmp(ringDistForTest(ids[i], ids[succ[b]])) < 0
+		})
+		known[i] = append(known[i], succ[1:17]...)
+	}
+	cfg := DefaultConfig()
+	cfg.Metric = ringMetricForTest{}
+	lt := lyingNetForTest(t, ids, known, 0, cfg)
+	defer closeLyingNetForTest(lt)
+
+	tab := lt.table(genIPForTest(1))
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 10; i++ {
+		target := NewHash()
+		r.Read(target)
+		want := closestIDsForTest(cfg.Metric, ids, target, tab.cfg.findsize)
+		nodes, err := tab.LookupContext(ctx.Background(), target)
+		require.Nil(t, err)
+		require.Len(t, nodes, len(want))
+		for j := range want {
+			assert.True(t, nodes[j].ID.Equal(want[j]), "target %v: node %v", i, j)
+		}
+	}
+}
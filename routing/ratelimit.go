@@ -0,0 +1,251 @@
+package routing
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxRateBuckets bounds the buckets kept by a limiter of addresses or ids,
+// the idle ones are dropped first when it's reached
+const maxRateBuckets = 4096
+
+var (
+	RATE_LIMIT_ERR = errors.New("inbound request rate limited")
+)
+
+// RateLimit is a token bucket refilled with Rate requests per second
+// up to Burst requests. A zero Rate is no limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// RateLimitDrops counts the inbound requests dropped by each limit,
+// a request is counted once, by the first limit it exceeds
+type RateLimitDrops struct {
+	Addr   uint64
+	ID     uint64
+	Global uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(l.Burst), last: now}
+}
+
+// refill adds the tokens earned since the last refill,
+// true is returned when one can be taken
+func (b *tokenBucket) refill(l RateLimit, now time.Time) bool {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.Rate
+		if b.tokens > float64(l.Burst) {
+			b.tokens = float64(l.Burst)
+		}
+		b.last = now
+	}
+	return b.tokens >= 1
+}
+
+// level is the tokens the bucket would have after a refill at now
+func (b *tokenBucket) level(l RateLimit, now time.Time) float64 {
+	if tokens := b.tokens + now.Sub(b.last).Seconds()*l.Rate; tokens < float64(l.Burst) {
+		return tokens
+	}
+	return float64(l.Burst)
+}
+
+// full reports whether a new bucket would be the same
+func (b *tokenBucket) full(l RateLimit, now time.Time) bool {
+	return b.level(l, now) >= float64(l.Burst)
+}
+
+// keyedBuckets keeps a token bucket for each address or id
+type keyedBuckets struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func (k *keyedBuckets) get(key string, now time.Time) *tokenBucket {
+	if b, ok := k.buckets[key]; ok {
+		return b
+	}
+	if len(k.buckets) >= maxRateBuckets {
+		k.prune(now)
+	}
+	b := newTokenBucket(k.limit, now)
+	k.buckets[key] = b
+	return b
+}
+
+// take takes a token of the bucket of key, false is returned
+// when there is none
+func (k *keyedBuckets) take(key string, now time.Time) bool {
+	b := k.get(key, now)
+	if !b.refill(k.limit, now) {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets refilled to the burst, which are the same as
+// new ones. When too few are, the ones with the most tokens, the most
+// idle, are dropped until a quarter of the room is free, so that busy
+// sources can't get a new bucket by pushing many others in
+func (k *keyedBuckets) prune(now time.Time) {
+	type level struct {
+		key    string
+		tokens float64
+	}
+	levels := make([]level, 0, len(k.buckets))
+	for key, b := range k.buckets {
+		if b.full(k.limit, now) {
+			delete(k.buckets, key)
+		} else {
+			levels = append(levels, level{key, b.level(k.limit, now)})
+		}
+	}
+	if len(k.buckets) < maxRateBuckets {
+		return
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].tokens > levels[j].tokens })
+	for _, l := range levels[:len(levels)-maxRateBuckets*3/4] {
+		delete(k.buckets, l.key)
+	}
+}
+
+// inboundLimiter bounds the inbound requests of each source
+// address, of each sender id and of all of them
+type inboundLimiter struct {
+	mutex  sync.Mutex
+	addrs  keyedBuckets
+	ids    keyedBuckets
+	global RateLimit
+	all    *tokenBucket
+	drops  RateLimitDrops
+}
+
+func newInboundLimiter(cfg *Config, now time.Time) *inboundLimiter {
+	return &inboundLimiter{
+		addrs:  keyedBuckets{limit: cfg.AddrRateLimit, buckets: make(map[string]*tokenBucket)},
+		ids:    keyedBuckets{limit: cfg.IDRateLimit, buckets: make(map[string]*tokenBucket)},
+		global: cfg.GlobalRateLimit,
+		all:    newTokenBucket(cfg.GlobalRateLimit, now),
+	}
+}
+
+// allow takes a token of every limit of from, a nil from is only
+// under the global limit and the id limit applies to authenticated
+// ids only. The address and global limits are checked first and the
+// record of from is verified out of the mutex, so that the requests
+// they drop cost no verification and don't hold the others back.
+// Nothing is taken when a limit is exceeded
+func (l *inboundLimiter) allow(from INode, now time.Time) error {
+	withID := from != nil && l.ids.limit.enabled()
+	if withID {
+		l.mutex.Lock()
+		err := l.check(from, now, false, false)
+		l.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		withID = authenticatedID(from)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.check(from, now, withID, true)
+}
+
+// check checks the address, global and, withID, id limits of from in
+// this order, a drop is counted by the first one exceeded. When none
+// is and take is set, a token of each is taken. l.mutex must be held
+func (l *inboundLimiter) check(from INode, now time.Time, withID, take bool) error {
+	var addr, id *tokenBucket
+	if from != nil && l.addrs.limit.enabled() {
+		addr = l.addrs.get(hostOf(from.GetAddr()), now)
+		if !addr.refill(l.addrs.limit, now) {
+			l.drops.Addr++
+			return errors.Wrapf(RATE_LIMIT_ERR, "address %v", from.GetAddr())
+		}
+	}
+	if l.global.enabled() && !l.all.refill(l.global, now) {
+		l.drops.Global++
+		return errors.Wrap(RATE_LIMIT_ERR, "global")
+	}
+	if withID {
+		id = l.ids.get(string(from.GetID()), now)
+		if !id.refill(l.ids.limit, now) {
+			l.drops.ID++
+			return errors.Wrapf(RATE_LIMIT_ERR, "id %v", from.GetID())
+		}
+	}
+	if !take {
+		return nil
+	}
+	if l.global.enabled() {
+		l.all.tokens--
+	}
+	if addr != nil {
+		addr.tokens--
+	}
+	if id != nil {
+		id.tokens--
+	}
+	return nil
+}
+
+// AuthenticatedNode is implemented by INodes whose id the transport
+// authenticated, as the sessions of ListenUDPAuth do
+type AuthenticatedNode interface {
+	INode
+	Authenticated() bool
+}
+
+// authenticatedID reports whether the id of from can't be claimed by
+// anyone else: the transport authenticated it, or it comes with a
+// valid record of its own. Other ids cost nothing to change, a limit
+// of each of them would only waste buckets
+func authenticatedID(from INode) bool {
+	if an, ok := from.(AuthenticatedNode); ok && an.Authenticated() {
+		return true
+	}
+	if rn, ok := from.(RecordNode); ok {
+		r := rn.GetRecord()
+		return r != nil && r.ID.Equal(from.GetID()) && r.Verify() == nil
+	}
+	return false
+}
+
+// hostOf strips the port of addr, the ports of a host share its limit
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// allowInbound is called by the inbound handler before a request
+// of from touches the table, RATE_LIMIT_ERR is returned to drop it
+func (t *Table) allowInbound(from INode) error {
+	return t.limiter.allow(from, t.cfg.clock.Now())
+}
+
+// RateLimited returns the number of inbound requests dropped by the rate limits
+func (t *Table) RateLimited() RateLimitDrops {
+	t.limiter.mutex.Lock()
+	defer t.limiter.mutex.Unlock()
+	return t.limiter.drops
+}
@@ -0,0 +1,151 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInboundLimiter(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AddrRateLimit = RateLimit{Rate: 1, Burst: 2}
+	cfg.IDRateLimit = RateLimit{Rate: 1, Burst: 3}
+	cfg.GlobalRateLimit = RateLimit{Rate: 10, Burst: 5}
+	now := time.Unix(1000000, 0)
+	l := newInboundLimiter(cfg, now)
+
+	a := sessionNode{NewNode(randHashForTest(), "1.2.3.4:30303")}
+	require.Nil(t, l.allow(a, now))
+	require.Nil(t, l.allow(a, now))
+	assert.Equal(t, RATE_LIMIT_ERR, errors.Cause(l.allow(a, now)))
+	// the port doesn't matter, the id has its own limit
+	assert.NotNil(t, l.allow(NewNode(randHashForTest(), "1.2.3.4:30304"), now))
+	require.Nil(t, l.allow(sessionNode{NewNode(a.GetID(), "5.6.7.8:30303")}, now))
+	assert.Equal(t, RateLimitDrops{Addr: 2}, l.drops)
+	assert.NotNil(t, l.allow(sessionNode{NewNode(a.GetID(), "9.9.9.9:30303")}, now), "id over its burst")
+	assert.Equal(t, uint64(1), l.drops.ID)
+	// an id anyone can claim is not limited, nor counted
+	require.Nil(t, l.allow(NewNode(a.GetID(), "9.9.9.9:30303"), now))
+	assert.Len(t, l.ids.buckets, 1)
+
+	// refilled after a second
+	now = now.Add(time.Second)
+	require.Nil(t, l.allow(a, now))
+	assert.NotNil(t, l.allow(a, now))
+
+	// the global limit counts every sender, the unknown ones too
+	for i := 0; i < 4; i++ {
+		require.Nil(t, l.allow(nil, now), "request %v", i)
+	}
+	assert.NotNil(t, l.allow(nil, now))
+	assert.NotNil(t, l.allow(NewNode(randHashForTest(), "10.0.0.1:30303"), now))
+	assert.Equal(t, RateLimitDrops{Addr: 3, ID: 1, Global: 2}, l.drops)
+	// a dropped request takes no token
+	now = now.Add(100 * time.Millisecond)
+	require.Nil(t, l.allow(NewNode(randHashForTest(), "10.0.0.1:30303"), now))
+}
+
+// countedRecordNode counts the reads of its record
+type countedRecordNode struct {
+	*Node
+	reads *int
+}
+
+func (n countedRecordNode) GetRecord() *Record {
+	*n.reads++
+	return n.Record
+}
+
+func TestInboundLimiterOrder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AddrRateLimit = RateLimit{Rate: 1, Burst: 1}
+	cfg.IDRateLimit = RateLimit{Rate: 1, Burst: 1}
+	cfg.GlobalRateLimit = RateLimit{Rate: 1, Burst: 1}
+	now := time.Unix(1000000, 0)
+	l := newInboundLimiter(cfg, now)
+
+	reads := 0
+	n := countedRecordNode{recordNodeForTest(t), &reads}
+	require.Nil(t, l.allow(n, now))
+	assert.Equal(t, 1, reads)
+	assert.Len(t, l.ids.buckets, 1)
+	// over the global limit, the record isn't verified
+	other := recordNodeForTest(t)
+	other.Addr = "1.2.3.4:30303"
+	assert.NotNil(t, l.allow(countedRecordNode{other, &reads}, now))
+	assert.Equal(t, 1, reads)
+	assert.Equal(t, RateLimitDrops{Global: 1}, l.drops)
+	// nor over the address limit
+	now = now.Add(time.Second)
+	require.Nil(t, l.allow(n, now))
+	assert.NotNil(t, l.allow(n, now))
+	assert.Equal(t, 2, reads)
+	assert.Equal(t, RateLimitDrops{Addr: 1, Global: 1}, l.drops)
+}
+
+func TestInboundLimiterBuckets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AddrRateLimit = RateLimit{Rate: 1, Burst: 1}
+	cfg.IDRateLimit = RateLimit{}
+	cfg.GlobalRateLimit = RateLimit{}
+	now := time.Unix(1000000, 0)
+	l := newInboundLimiter(cfg, now)
+	for i := 0; i < 2*maxRateBuckets; i++ {
+		require.Nil(t, l.allow(NewNode(randHashForTest(), fmt.Sprintf("%v:1", i)), now))
+	}
+	assert.True(t, len(l.addrs.buckets) <= maxRateBuckets)
+	assert.Empty(t, l.ids.buckets)
+
+	// the most idle buckets are dropped first
+	cfg.AddrRateLimit = RateLimit{Rate: 1, Burst: 2}
+	l = newInboundLimiter(cfg, now)
+	busy := NewNode(randHashForTest(), "10.0.0.1:1")
+	require.Nil(t, l.allow(busy, now))
+	require.Nil(t, l.allow(busy, now))
+	for i := 0; i < 4*maxRateBuckets; i++ {
+		require.Nil(t, l.allow(NewNode(randHashForTest(), fmt.Sprintf("%v:1", i)), now))
+	}
+	assert.True(t, len(l.addrs.buckets) <= maxRateBuckets)
+	assert.NotNil(t, l.allow(busy, now), "busy source got a new bucket")
+}
+
+func TestTableRateLimit(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.AddrRateLimit = RateLimit{Rate: 1, Burst: 5}
+	cfg.IDRateLimit = RateLimit{}
+	cfg.GlobalRateLimit = RateLimit{Rate: 100, Burst: 20}
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	h := NewTableHandler(tab)
+
+	noisy := NewNode(randHashForTest(), "1.2.3.4:30303")
+	var answered int
+	for i := 0; i < 100; i++ {
+		if _, err := h.HandleFindNode(noisy, randHashForTest()); err == nil {
+			answered++
+		} else {
+			assert.Equal(t, RATE_LIMIT_ERR, errors.Cause(err))
+		}
+	}
+	assert.Equal(t, 5, answered)
+	assert.Equal(t, uint64(95), tab.RateLimited().Addr)
+	// the noisy peer didn't take the tokens of the others
+	for i := 0; i < 15; i++ {
+		from := NewNode(randHashForTest(), fmt.Sprintf("5.6.7.%v:30303", i))
+		require.Nil(t, h.HandlePing(from), "peer %v", i)
+	}
+	assert.NotNil(t, tab.OnReceiveReq(NewNode(randHashForTest(), "9.9.9.9:30303")))
+	assert.Equal(t, uint64(1), tab.RateLimited().Global)
+
+	clock.Advance(time.Second)
+	_, err = h.HandleFindNode(noisy, randHashForTest())
+	assert.Nil(t, err)
+}
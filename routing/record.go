@@ -0,0 +1,388 @@
+package routing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"sort"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/pkg/errors"
+)
+
+const (
+	SchemeEd25519   = "ed25519"
+	SchemeSecp256k1 = "secp256k1"
+)
+
+// RecordNetworkKey is the record attribute naming the network of the node
+const RecordNetworkKey = "net"
+
+// recordDomain separates record signatures from anything else signed by the key
+const recordDomain = "routing-node-record"
+
+var (
+	RECORD_SCHEME_ERR  = errors.New("unknown identity scheme")
+	RECORD_KEY_ERR     = errors.New("record key invalid")
+	RECORD_SIG_ERR     = errors.New("record signature invalid")
+	RECORD_ID_ERR      = errors.New("record id not derived from its key")
+	RECORD_SEQ_ERR     = errors.New("record older than the stored one")
+	RECORD_MISSING_ERR = errors.New("node has no signed record")
+	RECORD_ADDR_ERR    = errors.New("node address or endpoint not signed in its record")
+)
+
+// PrivKey is the secret half of a node identity
+type PrivKey interface {
+	Scheme() string
+	PubKey() []byte
+	// Bytes returns the key in the form accepted by LoadKey
+	Bytes() []byte
+	Sign(msg []byte) ([]byte, error)
+}
+
+func GenerateKey(scheme string) (PrivKey, error) {
+	switch scheme {
+	case SchemeEd25519:
+		_, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519Key(priv), nil
+	case SchemeSecp256k1:
+		priv, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		return &secp256k1Key{priv}, nil
+	}
+	return nil, RECORD_SCHEME_ERR
+}
+
+func LoadKey(scheme string, priv []byte) (PrivKey, error) {
+	switch scheme {
+	case SchemeEd25519:
+		if len(priv) != ed25519.PrivateKeySize {
+			return nil, RECORD_KEY_ERR
+		}
+		return ed25519Key(append([]byte{}, priv...)), nil
+	case SchemeSecp256k1:
+		if len(priv) != secp256k1.PrivKeyBytesLen {
+			return nil, RECORD_KEY_ERR
+		}
+		return &secp256k1Key{secp256k1.PrivKeyFromBytes(priv)}, nil
+	}
+	return nil, RECORD_SCHEME_ERR
+}
+
+type ed25519Key ed25519.PrivateKey
+
+func (k ed25519Key) Scheme() string { return SchemeEd25519 }
+func (k ed25519Key) PubKey() []byte {
+	return []byte(ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+func (k ed25519Key) Bytes() []byte { return append([]byte{}, k...) }
+func (k ed25519Key) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), msg), nil
+}
+
+type secp256k1Key struct {
+	priv *secp256k1.PrivateKey
+}
+
+func (k *secp256k1Key) Scheme() string { return SchemeSecp256k1 }
+func (k *secp256k1Key) PubKey() []byte { return k.priv.PubKey().SerializeCompressed() }
+func (k *secp256k1Key) Bytes() []byte  { return k.priv.Serialize() }
+func (k *secp256k1Key) Sign(msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return ecdsa.Sign(k.priv, digest[:]).Serialize(), nil
+}
+
+// verifySig checks sig of msg made by the key pub of scheme
+func verifySig(scheme string, pub, msg, sig []byte) error {
+	switch scheme {
+	case SchemeEd25519:
+		if len(pub) != ed25519.PublicKeySize {
+			return RECORD_KEY_ERR
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+			return RECORD_SIG_ERR
+		}
+		return nil
+	case SchemeSecp256k1:
+		pk, err := secp256k1.ParsePubKey(pub)
+		if err != nil {
+			return errors.Wrap(RECORD_KEY_ERR, err.Error())
+		}
+		esig, err := ecdsa.ParseDERSignature(sig)
+		if err != nil {
+			return errors.Wrap(RECORD_SIG_ERR, err.Error())
+		}
+		digest := sha256.Sum256(msg)
+		if !esig.Verify(digest[:], pk) {
+			return RECORD_SIG_ERR
+		}
+		return nil
+	}
+	return RECORD_SCHEME_ERR
+}
+
+// IDFromPubKey derives a node id of length bytes from a public key
+func IDFromPubKey(pub []byte, length int) Hash {
+	id := make(Hash, 0, length+sha512.Size)
+	for i := 0; len(id) < length; i++ {
+		sum := sha512.Sum512(append([]byte{byte(i)}, pub...))
+		id = append(id, sum[:]...)
+	}
+	return id[:length]
+}
+
+// Record is the signed description of a node,
+// a newer record of the same node has a bigger Seq
+type Record struct {
+	Seq    uint64
+	ID     Hash
+	Addrs  []string
+	Attrs  map[string][]byte `json:",omitempty"`
+	Scheme string
+	PubKey []byte
+	Sig    []byte
+}
+
+// NewRecord makes an unsigned record for key with an id of hashLength bytes
+func NewRecord(key PrivKey, hashLength int) *Record {
+	pub := key.PubKey()
+	return &Record{
+		ID:     IDFromPubKey(pub, hashLength),
+		Scheme: key.Scheme(),
+		PubKey: pub,
+	}
+}
+
+// Set stores an attribute, the record must be signed again afterwards
+func (r *Record) Set(key string, value []byte) {
+	if r.Attrs == nil {
+		r.Attrs = make(map[string][]byte)
+	}
+	r.Attrs[key] = value
+	r.Sig = nil
+}
+
+func (r *Record) Get(key string) []byte {
+	return r.Attrs[key]
+}
+
+func (r *Record) Sign(key PrivKey) error {
+	if key.Scheme() != r.Scheme || !bytes.Equal(key.PubKey(), r.PubKey) {
+		return RECORD_KEY_ERR
+	}
+	sig, err := key.Sign(r.signingPayload())
+	if err != nil {
+		return err
+	}
+	r.Sig = sig
+	return nil
+}
+
+// Verify checks the signature and that the id belongs to the key
+func (r *Record) Verify() error {
+	if len(r.ID) == 0 || !r.ID.Equal(IDFromPubKey(r.PubKey, len(r.ID))) {
+		return RECORD_ID_ERR
+	}
+	return verifySig(r.Scheme, r.PubKey, r.signingPayload(), r.Sig)
+}
+
+// signingPayload is a deterministic encoding of every field but Sig
+func (r *Record) signingPayload() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(recordDomain)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], r.Seq)
+	buf.Write(seq[:])
+	writeBytes(&buf, r.ID)
+	writeUvarint(&buf, uint64(len(r.Addrs)))
+	for _, addr := range r.Addrs {
+		writeBytes(&buf, []byte(addr))
+	}
+	keys := r.attrKeys()
+	writeUvarint(&buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeBytes(&buf, []byte(k))
+		writeBytes(&buf, r.Attrs[k])
+	}
+	writeBytes(&buf, []byte(r.Scheme))
+	writeBytes(&buf, r.PubKey)
+	return buf.Bytes()
+}
+
+// attrKeys returns the keys of the attributes in order,
+// the encodings of a record must not depend on the map order
+func (r *Record) attrKeys() []string {
+	keys := make([]string, 0, len(r.Attrs))
+	for k := range r.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+// RecordNode is implemented by INodes carrying a signed record
+type RecordNode interface {
+	INode
+	GetRecord() *Record
+}
+
+// NewNodeFromRecord makes a node reachable at the first address of r
+func NewNodeFromRecord(r *Record) *Node {
+	var addr string
+	endpoints := endpointsFromAddrs(r.Addrs)
+	if len(endpoints) > 0 {
+		addr = endpoints[0].UDPAddr()
+	} else if len(r.Addrs) > 0 {
+		addr = r.Addrs[0]
+	}
+	n := NewNode(r.ID, addr)
+	n.Endpoints = endpoints
+	n.Record = r
+	n.Network = string(r.Get(RecordNetworkKey))
+	return n
+}
+
+// NetworkNode is implemented by INodes telling their network
+type NetworkNode interface {
+	INode
+	GetNetwork() string
+}
+
+// nodeFromINode copies in, keeping its record and network if it has them
+func nodeFromINode(in INode) *Node {
+	n := NewNode(in.GetID(), in.GetAddr())
+	if rn, ok := in.(RecordNode); ok {
+		n.Record = rn.GetRecord()
+	}
+	if nn, ok := in.(NetworkNode); ok {
+		n.Network = nn.GetNetwork()
+	}
+	if en, ok := in.(EndpointsNode); ok && len(en.GetEndpoints()) != 0 {
+		n.Endpoints = append([]Endpoint(nil), en.GetEndpoints()...)
+	}
+	return n
+}
+
+// newSelfRecord signs the record of the local node n,
+// its seq is one more than the one of the previous run
+func newSelfRecord(cfg *Config, db *nodeDB, n *Node) (*Record, error) {
+	r := NewRecord(cfg.PrivateKey, cfg.HashLength)
+	if !r.ID.Equal(n.GetID()) {
+		return nil, RECORD_ID_ERR
+	}
+	r.Seq = db.localSeq() + 1
+	r.Addrs = []string{n.GetAddr()}
+	if len(n.Endpoints) != 0 {
+		r.Addrs = make([]string, len(n.Endpoints))
+		for i, e := range n.Endpoints {
+			r.Addrs[i] = e.String()
+		}
+	}
+	if cfg.NetworkID != "" {
+		r.Set(RecordNetworkKey, []byte(cfg.NetworkID))
+	}
+	if err := r.Sign(cfg.PrivateKey); err != nil {
+		return nil, err
+	}
+	if err := db.storeLocalSeq(r.Seq); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkRecord decides whether n may replace what the table knows about its id:
+// a record must verify, belong to n, sign its address and endpoints and be at
+// least as new as the stored one
+func (t *Table) checkRecord(n *Node) error {
+	stored := t.storedRecord(n.GetID())
+	if n.Record == nil {
+		if t.cfg.requireRecords || stored != nil {
+			return RECORD_MISSING_ERR
+		}
+		return nil
+	}
+	if !n.Record.ID.Equal(n.GetID()) {
+		return RECORD_ID_ERR
+	}
+	if err := n.Record.Verify(); err != nil {
+		return err
+	}
+	if !n.Record.hasAddr(n.GetAddr()) {
+		// a replayed record must not move the node elsewhere
+		return RECORD_ADDR_ERR
+	}
+	for _, e := range n.Endpoints {
+		if !n.Record.hasEndpoint(e) {
+			return RECORD_ADDR_ERR
+		}
+	}
+	if stored != nil && stored.Seq > n.Record.Seq {
+		return RECORD_SEQ_ERR
+	}
+	return nil
+}
+
+// hasAddr reports whether addr is one of the signed addresses of r,
+// or the discovery address of one of its endpoints
+func (r *Record) hasAddr(addr string) bool {
+	for _, a := range r.Addrs {
+		if a == addr {
+			return true
+		}
+	}
+	for _, e := range endpointsFromAddrs(r.Addrs) {
+		if e.UDPAddr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEndpoint reports whether e is one of the signed endpoints of r
+func (r *Record) hasEndpoint(e Endpoint) bool {
+	for _, signed := range endpointsFromAddrs(r.Addrs) {
+		if signed.String() == e.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// storedRecord returns the newest record known for id, in the table or in db
+func (t *Table) storedRecord(id Hash) (rec *Record) {
+	t.mutex.Lock()
+	b := t.bucket(id)
+	for _, list := range [][]*Node{b.entries, b.replacements} {
+		for _, e := range list {
+			if e.GetID().Equal(id) && e.Record != nil {
+				rec = e.Record
+			}
+		}
+	}
+	t.mutex.Unlock()
+	if dbn := t.db.getNode(id); dbn != nil && dbn.Record != nil {
+		if rec == nil || dbn.Record.Seq > rec.Seq {
+			rec = dbn.Record
+		}
+	}
+	return rec
+}
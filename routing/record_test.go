@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRecordForTest(t *testing.T, key PrivKey, seq uint64, addr string) *Record {
+	r := NewRecord(key, DefaultHashLength)
+	r.Seq = seq
+	r.Addrs = []string{addr}
+	require.Nil(t, r.Sign(key), "sign record err")
+	return r
+}
+
+func TestRecordSignVerify(t *testing.T) {
+	for _, scheme := range []string{SchemeEd25519, SchemeSecp256k1} {
+		key, err := GenerateKey(scheme)
+		require.Nil(t, err, "generate %v key err", scheme)
+
+		r := NewRecord(key, DefaultHashLength)
+		r.Seq = 3
+		r.Addrs = []string{"127.0.0.1:30303", "[::1]:30303"}
+		r.Set("chain", []byte("main"))
+		assert.Equal(t, IDFromPubKey(key.PubKey(), DefaultHashLength), r.ID)
+		require.Nil(t, r.Sign(key))
+		require.Nil(t, r.Verify(), scheme)
+
+		// survives json, as it travels inside Node
+		bys, err := json.Marshal(NewNodeFromRecord(r))
+		require.Nil(t, err)
+		n := &Node{}
+		require.Nil(t, n.Unmarshal(bys))
+		require.NotNil(t, n.Record)
+		assert.Nil(t, n.Record.Verify(), scheme)
+		assert.Equal(t, "127.0.0.1:30303", n.Addr)
+
+		// any change breaks the signature
+		r.Addrs[0] = "10.0.0.1:30303"
+		assert.Equal(t, RECORD_SIG_ERR, errors.Cause(r.Verify()), scheme)
+		r.Addrs[0] = "127.0.0.1:30303"
+		r.Seq++
+		assert.Equal(t, RECORD_SIG_ERR, errors.Cause(r.Verify()), scheme)
+		r.Seq--
+		r.ID[0]++
+		assert.Equal(t, RECORD_ID_ERR, r.Verify(), scheme)
+		r.ID[0]--
+
+		// keys reload from their bytes
+		loaded, err := LoadKey(scheme, key.Bytes())
+		require.Nil(t, err)
+		assert.Equal(t, key.PubKey(), loaded.PubKey())
+		other, _ := GenerateKey(scheme)
+		assert.Equal(t, RECORD_KEY_ERR, r.Sign(other))
+	}
+	_, err := GenerateKey("rsa")
+	assert.Equal(t, RECORD_SCHEME_ERR, err)
+}
+
+func TestTableAddRecord(t *testing.T) {
+	initTest()
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	key, _ := GenerateKey(SchemeEd25519)
+	r2 := signedRecordForTest(t, key, 2, "10.0.0.2:30303")
+	require.Nil(t, tab.add(NewNodeFromRecord(r2)))
+	got := tab.getNodeLocally(r2.ID)
+	require.NotNil(t, got)
+	assert.Equal(t, uint64(2), got.Record.Seq)
+
+	// older seq is refused, even from another address
+	r1 := signedRecordForTest(t, key, 1, "10.0.0.1:30303")
+	assert.Equal(t, RECORD_SEQ_ERR, tab.add(NewNodeFromRecord(r1)))
+	// and so is a node claiming the id without the record
+	assert.Equal(t, RECORD_MISSING_ERR, tab.add(NewNode(r2.ID, "10.0.0.1:30303")))
+	// a forged signature too
+	forged := *r2
+	forged.Seq = 5
+	assert.Equal(t, RECORD_SIG_ERR, errors.Cause(tab.add(NewNodeFromRecord(&forged))))
+	// the record must belong to the node
+	other, _ := GenerateKey(SchemeSecp256k1)
+	ro := signedRecordForTest(t, other, 1, "10.0.0.3:30303")
+	stolen := NewNode(r2.ID, "10.0.0.3:30303")
+	stolen.Record = ro
+	assert.Equal(t, RECORD_ID_ERR, tab.add(stolen))
+	// a valid record replayed next to another address
+	replayed := NewNode(r2.ID, "10.0.0.9:30303")
+	replayed.Record = r2
+	assert.Equal(t, RECORD_ADDR_ERR, tab.add(replayed))
+	assert.Equal(t, "10.0.0.2:30303", tab.getNodeLocally(r2.ID).Addr)
+	// or next to unsigned endpoints
+	e, err := ParseEndpoint("10.0.0.9:30303/26656")
+	require.Nil(t, err)
+	replayed = NewNodeFromRecord(r2)
+	replayed.Endpoints = append(replayed.Endpoints, e)
+	assert.Equal(t, RECORD_ADDR_ERR, tab.add(replayed))
+
+	r3 := signedRecordForTest(t, key, 3, "10.0.0.3:30303")
+	require.Nil(t, tab.add(NewNodeFromRecord(r3)))
+	got = tab.getNodeLocally(r2.ID)
+	require.NotNil(t, got)
+	assert.Equal(t, uint64(3), got.Record.Seq)
+	assert.Equal(t, "10.0.0.3:30303", got.Addr)
+
+	// the stored seq outlives the table entry
+	tab.delete(got)
+	assert.Equal(t, RECORD_SEQ_ERR, tab.add(NewNodeFromRecord(r2)))
+}
+
+func TestRecordPersisted(t *testing.T) {
+	initTest()
+	cfg := DefaultConfig()
+	cfg.TableIPLimit = 1
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	key, _ := GenerateKey(SchemeEd25519)
+	entry := NewNodeFromRecord(signedRecordForTest(t, key, 1, "1.2.3.1:30303"))
+	require.Nil(t, tab.add(entry))
+	assert.NotNil(t, tab.db.getNode(entry.ID), "table entry not stored")
+
+	// over the subnet limit, the node waits in the replacements
+	other, _ := GenerateKey(SchemeEd25519)
+	r2 := signedRecordForTest(t, other, 2, "1.2.3.2:30303")
+	require.Nil(t, tab.add(NewNodeFromRecord(r2)))
+	assert.Nil(t, tab.getNodeLocally(r2.ID))
+	assert.Nil(t, tab.db.getNode(r2.ID), "replacement stored")
+	// its seq is still enforced
+	r1 := signedRecordForTest(t, other, 1, "1.2.3.2:30303")
+	assert.Equal(t, RECORD_SEQ_ERR, tab.add(NewNodeFromRecord(r1)))
+}
+
+func TestRequireRecords(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RequireRecords = true
+	cfg.PrivateKey, _ = GenerateKey(SchemeSecp256k1)
+	selfID := IDFromPubKey(cfg.PrivateKey.PubKey(), cfg.HashLength)
+
+	_, err := NewTable(testNet, ToHash([]byte{41}), "na", "", nil, cfg)
+	assert.Equal(t, RECORD_ID_ERR, err, "id not matching the key accepted")
+
+	tab, err := NewTable(testNet, selfID, "na", "", nil, cfg)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+	require.NotNil(t, tab.self.Record)
+	assert.Nil(t, tab.self.Record.Verify())
+	assert.Equal(t, uint64(1), tab.self.Record.Seq)
+
+	assert.Equal(t, RECORD_MISSING_ERR, tab.add(NewNode(ToHash([]byte{43}), "nb")))
+	key, _ := GenerateKey(SchemeEd25519)
+	assert.Nil(t, tab.add(NewNodeFromRecord(signedRecordForTest(t, key, 1, "nb"))))
+}
@@ -0,0 +1,229 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oj01ol/annchaincopy/routing"
+)
+
+// Clock is a virtual routing.Clock, its time only moves
+// when the simulation advances it
+type Clock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers timerHeap
+	seq    uint64
+
+	// activity counts the operations on the clock,
+	// the simulation watches it to know when the tables are idle
+	activity uint64
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) routing.Timer {
+	t := &timer{clock: c, c: make(chan time.Time, 1), index: -1}
+	c.schedule(t, d)
+	return t
+}
+
+func (c *Clock) NewTicker(d time.Duration) routing.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &timer{clock: c, c: make(chan time.Time, 1), period: d, index: -1}
+	c.schedule(t, d)
+	return ticker{t}
+}
+
+// AfterFunc calls f from Advance once d has passed
+func (c *Clock) AfterFunc(d time.Duration, f func()) routing.Timer {
+	t := &timer{clock: c, fn: f, index: -1}
+	c.schedule(t, d)
+	return t
+}
+
+// Next returns when the earliest timer fires
+func (c *Clock) Next() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].when, true
+}
+
+// AdvanceTo moves the time to end, firing the timers due
+// on the way in the order of their deadlines
+func (c *Clock) AdvanceTo(end time.Time) {
+	for c.fireNext(end) {
+	}
+	c.mutex.Lock()
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.mutex.Unlock()
+}
+
+// fireNext fires the earliest timer if it's due by end,
+// and reports whether it did
+func (c *Clock) fireNext(end time.Time) bool {
+	c.mutex.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		c.mutex.Unlock()
+		return false
+	}
+	{
+		t := heap.Pop(&c.timers).(*timer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			c.push(t)
+		}
+		now := c.now
+		c.touch()
+		c.mutex.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			select {
+			case t.c <- now:
+			default:
+				// like time.Ticker, ticks are dropped for slow receivers
+			}
+		}
+	}
+	return true
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+func (c *Clock) touch() {
+	atomic.AddUint64(&c.activity, 1)
+}
+
+func (c *Clock) activityCount() uint64 {
+	return atomic.LoadUint64(&c.activity)
+}
+
+func (c *Clock) schedule(t *timer, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	t.when = c.now.Add(d)
+	c.push(t)
+	c.touch()
+}
+
+func (c *Clock) push(t *timer) {
+	c.seq++
+	t.seq = c.seq
+	heap.Push(&c.timers, t)
+}
+
+// unschedule reports whether t was pending, c.mutex must be held
+func (c *Clock) unschedule(t *timer) bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+type timer struct {
+	clock  *Clock
+	when   time.Time
+	period time.Duration // set for tickers
+	c      chan time.Time
+	fn     func()
+	index  int // position in the heap, -1 when not pending
+	seq    uint64
+}
+
+func (t *timer) C() <-chan time.Time { return t.c }
+
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.touch()
+	t.drain()
+	return c.unschedule(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mutex.Lock()
+	active := c.unschedule(t)
+	t.drain()
+	c.mutex.Unlock()
+	c.schedule(t, d)
+	return active
+}
+
+// drain drops a value not received yet, as time.Timer does since go1.23
+func (t *timer) drain() {
+	if t.c == nil {
+		return
+	}
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+type ticker struct {
+	*timer
+}
+
+func (t ticker) Stop() { t.timer.Stop() }
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
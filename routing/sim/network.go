@@ -0,0 +1,281 @@
+package sim
+
+import (
+	ctx "context"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oj01ol/annchaincopy/routing"
+	"github.com/pkg/errors"
+)
+
+var (
+	SIM_TIMEOUT_ERR = errors.New("sim request timed out")
+	SIM_DOWN_ERR    = errors.New("sim node is down")
+)
+
+// Network carries the requests between the simulated tables,
+// every delivery waits on the virtual clock
+type Network struct {
+	clock *Clock
+	cfg   *Config
+
+	mutex     sync.Mutex
+	endpoints map[string]*endpoint    // addr -> endpoint of the running table
+	groups    map[string]int          // addr -> partition, nil when healed
+	trackers  map[string]*lookupTrack // from addr + target -> lookup tracked
+
+	requests uint64
+	lost     uint64
+	handling int64 // requests being handled by their destination
+}
+
+func newNetwork(clock *Clock, cfg *Config) *Network {
+	return &Network{
+		clock:     clock,
+		cfg:       cfg,
+		endpoints: make(map[string]*endpoint),
+		trackers:  make(map[string]*lookupTrack),
+	}
+}
+
+// endpoint is the routing.Transport of one table
+type endpoint struct {
+	net     *Network
+	self    routing.INode
+	handler routing.Handler
+	down    chan struct{}
+}
+
+func (n *Network) newEndpoint(addr string) *endpoint {
+	e := &endpoint{net: n, down: make(chan struct{})}
+	n.mutex.Lock()
+	n.endpoints[addr] = e
+	n.mutex.Unlock()
+	return e
+}
+
+// remove takes e off the network, its pending requests fail at once
+func (n *Network) remove(addr string, e *endpoint) {
+	n.mutex.Lock()
+	if n.endpoints[addr] == e {
+		delete(n.endpoints, addr)
+	}
+	n.mutex.Unlock()
+	close(e.down)
+}
+
+// reachable finds the endpoint at addr if from can talk to it
+func (n *Network) reachable(from, addr string) *endpoint {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	e := n.endpoints[addr]
+	if e == nil || e.handler == nil {
+		return nil
+	}
+	if n.groups != nil && n.groups[from] != n.groups[addr] {
+		return nil
+	}
+	return e
+}
+
+// busy reports whether a table is handling a request, which
+// ends without the clock
+func (n *Network) busy() bool {
+	return atomic.LoadInt64(&n.handling) != 0
+}
+
+func (n *Network) partition(groups map[string]int) {
+	n.mutex.Lock()
+	n.groups = groups
+	n.mutex.Unlock()
+}
+
+// link draws the one way latency and the loss of a request.
+// The draw depends on the seed, the peers and the virtual time only,
+// not on the order goroutines happen to run in
+func (n *Network) link(from, to, kind string) (time.Duration, bool) {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n.cfg.Seed))
+	h.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], uint64(n.clock.Now().UnixNano()))
+	h.Write(b[:])
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	h.Write([]byte(to))
+	h.Write([]byte{0})
+	h.Write([]byte(kind))
+	x := h.Sum64()
+
+	delay := n.cfg.Latency
+	if n.cfg.Jitter > 0 {
+		delay += time.Duration(splitmix(&x) % uint64(n.cfg.Jitter))
+	}
+	if n.slow(from) || n.slow(to) {
+		delay += n.cfg.SlowLatency
+	}
+	lost := float64(splitmix(&x)>>11)/(1<<53) < n.cfg.Loss
+	return delay, lost
+}
+
+// slow reports whether the node at addr has a slow link,
+// which depends on the seed and the address only
+func (n *Network) slow(addr string) bool {
+	if n.cfg.SlowNodes <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n.cfg.Seed))
+	h.Write(b[:])
+	h.Write([]byte(addr))
+	x := h.Sum64()
+	return float64(splitmix(&x)>>11)/(1<<53) < n.cfg.SlowNodes
+}
+
+func splitmix(x *uint64) uint64 {
+	*x += 0x9e3779b97f4a7c15
+	z := *x
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (n *Network) track(from string, target routing.Hash) *lookupTrack {
+	lt := &lookupTrack{target: target, depth: make(map[string]int), hops: -1}
+	n.mutex.Lock()
+	n.trackers[from+string(target)] = lt
+	n.mutex.Unlock()
+	return lt
+}
+
+func (n *Network) untrack(from string, target routing.Hash) {
+	n.mutex.Lock()
+	delete(n.trackers, from+string(target))
+	n.mutex.Unlock()
+}
+
+func (n *Network) tracker(from string, target routing.Hash) *lookupTrack {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.trackers[from+string(target)]
+}
+
+func (e *endpoint) Serve(self routing.INode, h routing.Handler) {
+	e.net.mutex.Lock()
+	e.self = self
+	e.handler = h
+	e.net.mutex.Unlock()
+}
+
+func (e *endpoint) Ping(addr string) error {
+	_, err := e.request(ctx.Background(), addr, "ping", func(h routing.Handler) ([]routing.INode, error) {
+		return nil, h.HandlePing(e.self)
+	})
+	return err
+}
+
+func (e *endpoint) FindNode(cctx ctx.Context, addr string, target routing.Hash) ([]routing.INode, error) {
+	nodes, err := e.request(cctx, addr, "findnode", func(h routing.Handler) ([]routing.INode, error) {
+		return h.HandleFindNode(e.self, target)
+	})
+	if err == nil {
+		if lt := e.net.tracker(e.self.GetAddr(), target); lt != nil {
+			lt.reply(addr, nodes)
+		}
+	}
+	return nodes, err
+}
+
+// request delivers call to addr after the link latency
+// and returns its answer after the same latency
+func (e *endpoint) request(cctx ctx.Context, addr, kind string, call func(h routing.Handler) ([]routing.INode, error)) ([]routing.INode, error) {
+	n := e.net
+	atomic.AddUint64(&n.requests, 1)
+	n.clock.touch()
+	defer n.clock.touch()
+
+	from := e.self.GetAddr()
+	delay, lost := n.link(from, addr, kind)
+	if lost {
+		atomic.AddUint64(&n.lost, 1)
+		if err := e.sleep(cctx, n.cfg.Timeout); err != nil {
+			return nil, err
+		}
+		return nil, SIM_TIMEOUT_ERR
+	}
+	if err := e.sleep(cctx, delay); err != nil {
+		return nil, err
+	}
+	dst := n.reachable(from, addr)
+	if dst == nil {
+		if err := e.sleep(cctx, n.cfg.Timeout-delay); err != nil {
+			return nil, err
+		}
+		return nil, SIM_TIMEOUT_ERR
+	}
+	atomic.AddInt64(&n.handling, 1)
+	nodes, err := call(dst.handler)
+	atomic.AddInt64(&n.handling, -1)
+	if serr := e.sleep(cctx, delay); serr != nil {
+		return nil, serr
+	}
+	return nodes, err
+}
+
+// sleep waits for d of virtual time
+func (e *endpoint) sleep(cctx ctx.Context, d time.Duration) error {
+	t := e.net.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-cctx.Done():
+		return cctx.Err()
+	case <-e.down:
+		return SIM_DOWN_ERR
+	}
+}
+
+// lookupTrack follows one lookup to count its hops,
+// a node learned from a reply is one hop farther than the replier
+type lookupTrack struct {
+	mutex  sync.Mutex
+	target routing.Hash
+	depth  map[string]int // addr -> hops
+	hops   int            // hops to the node that returned target, -1 before
+}
+
+func (lt *lookupTrack) reply(from string, nodes []routing.INode) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	d, ok := lt.depth[from]
+	if !ok {
+		// from came out of the local table
+		d = 1
+		lt.depth[from] = d
+	}
+	for _, n := range nodes {
+		if _, ok := lt.depth[n.GetAddr()]; !ok {
+			lt.depth[n.GetAddr()] = d + 1
+		}
+		if lt.hops < 0 && lt.target.Equal(n.GetID()) {
+			lt.hops = d
+		}
+	}
+}
+
+// result returns the hops of a lookup that found its target
+func (lt *lookupTrack) result() int {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if lt.hops < 0 {
+		// found in the local table
+		return 0
+	}
+	return lt.hops
+}
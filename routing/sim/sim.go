@@ -0,0 +1,456 @@
+// Package sim runs many routing tables over an in-memory network
+// driven by a virtual clock. Latency, loss, churn and partitions
+// are applied by the network and the runs report how well lookups
+// work and whether the routing tables split.
+//
+// Node ids, latencies, losses and the randomness of the tables
+// derive from Config.Seed. The tables still run on goroutines: the
+// simulation runs them on a single processor, fires one timer at a
+// time and waits for the tables to be idle before firing the next,
+// so runs of the same Config give the same Report.
+package sim
+
+import (
+	ctx "context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oj01ol/annchaincopy/routing"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	Nodes         int           // tables in the network
+	Bootnodes     int           // nodes a table knows when it starts
+	Seed          int64         // every random choice derives from it
+	Latency       time.Duration // one way latency of every link
+	Jitter        time.Duration // up to this much is added to Latency
+	SlowNodes     float64       // share of the nodes with a slow link
+	SlowLatency   time.Duration // added to the one way latency of the links of slow nodes
+	Loss          float64       // probability a request gets no answer
+	Timeout       time.Duration // time before an unanswered request fails
+	LookupTimeout time.Duration // time given to each lookup of Lookups
+	Resolution    time.Duration // timers closer than it fire in one step
+	SettleRounds  int           // scheduler rounds without activity meaning the tables are idle
+	// Table configures every table, its Clock and Rand are replaced
+	// by the clock of the simulation and sources seeded from Seed
+	Table *routing.Config
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Nodes:         256,
+		Bootnodes:     3,
+		Seed:          1,
+		Latency:       20 * time.Millisecond,
+		Jitter:        30 * time.Millisecond,
+		Timeout:       500 * time.Millisecond,
+		LookupTimeout: 10 * time.Second,
+		Resolution:    10 * time.Millisecond,
+		SettleRounds:  8,
+		Table:         routing.DefaultConfig(),
+	}
+}
+
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.Nodes < 2:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim nodes %v less than 2", cfg.Nodes)
+	case cfg.Bootnodes < 1 || cfg.Bootnodes >= cfg.Nodes:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim bootnodes %v out of [1, nodes)", cfg.Bootnodes)
+	case cfg.Latency < 0 || cfg.Jitter < 0 || cfg.SlowLatency < 0:
+		return errors.Wrapf(routing.CONFIG_ERR, "negative sim latency %v, jitter %v or slow latency %v", cfg.Latency, cfg.Jitter, cfg.SlowLatency)
+	case cfg.SlowNodes < 0 || cfg.SlowNodes > 1:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim slow nodes %v out of [0, 1]", cfg.SlowNodes)
+	case cfg.Loss < 0 || cfg.Loss >= 1:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim loss %v out of [0, 1)", cfg.Loss)
+	case cfg.Timeout <= 2*(cfg.Latency+cfg.Jitter+cfg.SlowLatency):
+		return errors.Wrapf(routing.CONFIG_ERR, "sim timeout %v shorter than a round trip", cfg.Timeout)
+	case cfg.LookupTimeout <= 0:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim lookup timeout %v not positive", cfg.LookupTimeout)
+	case cfg.Resolution <= 0 || cfg.SettleRounds <= 0:
+		return errors.Wrapf(routing.CONFIG_ERR, "sim resolution %v or settle rounds %v not positive", cfg.Resolution, cfg.SettleRounds)
+	case cfg.Table == nil:
+		return errors.Wrap(routing.CONFIG_ERR, "sim table config missing")
+	}
+	return cfg.Table.Validate()
+}
+
+// Report sums up a simulation since its start
+type Report struct {
+	Time        time.Duration // virtual time elapsed
+	Up          int           // nodes running
+	Lookups     int
+	Found       int
+	SuccessRate float64
+	AvgHops     float64 // over the lookups that found their target
+	MaxHops     int
+	AvgTime     time.Duration // virtual time of the lookups that found their target
+	Requests    uint64        // requests sent between tables
+	Lost        uint64
+	Components  int  // connected parts of the routing graph, see components
+	Partitioned bool // the routing graph is split
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("time:%v up:%v lookups:%v/%v (%.1f%%) hops:%.2f max:%v lookup time:%v requests:%v lost:%v components:%v",
+		r.Time, r.Up, r.Found, r.Lookups, 100*r.SuccessRate, r.AvgHops, r.MaxHops, r.AvgTime, r.Requests, r.Lost, r.Components)
+}
+
+type simNode struct {
+	id   routing.Hash
+	addr string
+	tab  *routing.Table
+	ep   *endpoint
+}
+
+func (n *simNode) up() bool {
+	return n.tab != nil
+}
+
+type Simulation struct {
+	cfg   *Config
+	clock *Clock
+	net   *Network
+	rand  *rand.Rand
+	start time.Time
+	nodes []*simNode
+	stops sync.WaitGroup
+
+	lookups int
+	found   int
+	hops    int
+	maxHops int
+	time    time.Duration
+}
+
+// New starts cfg.Nodes tables, each knowing cfg.Bootnodes others
+func New(cfg *Config) (*Simulation, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	start := time.Unix(0, 0).UTC()
+	s := &Simulation{
+		cfg:   cfg,
+		clock: NewClock(start),
+		rand:  rand.New(rand.NewSource(cfg.Seed)),
+		start: start,
+		nodes: make([]*simNode, cfg.Nodes),
+	}
+	s.net = newNetwork(s.clock, cfg)
+	for i := range s.nodes {
+		id := make(routing.Hash, cfg.Table.HashLength)
+		s.rand.Read(id)
+		s.nodes[i] = &simNode{
+			id:   id,
+			addr: fmt.Sprintf("10.%d.%d.%d:30303", byte(i>>16), byte(i>>8), byte(i)),
+		}
+	}
+	for _, n := range s.nodes {
+		if err := s.boot(n, s.nodes); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	for _, n := range s.nodes {
+		n.tab.Start()
+	}
+	return s, nil
+}
+
+// boot makes a fresh table for n knowing some of peers
+func (s *Simulation) boot(n *simNode, peers []*simNode) error {
+	var candidates []*simNode
+	for _, o := range peers {
+		if o != n {
+			candidates = append(candidates, o)
+		}
+	}
+	var bootnodes []routing.INode
+	for _, i := range s.rand.Perm(len(candidates)) {
+		if len(bootnodes) == s.cfg.Bootnodes {
+			break
+		}
+		bootnodes = append(bootnodes, routing.NewNode(candidates[i].id, candidates[i].addr))
+	}
+	tcfg := *s.cfg.Table
+	tcfg.Clock = s.clock
+	tcfg.Rand = &lockedRand{r: rand.New(rand.NewSource(s.rand.Int63()))}
+	ep := s.net.newEndpoint(n.addr)
+	tab, err := routing.NewTable(ep, n.id, n.addr, "", bootnodes, &tcfg)
+	if err != nil {
+		s.net.remove(n.addr, ep)
+		return err
+	}
+	n.tab, n.ep = tab, ep
+	return nil
+}
+
+// lockedRand lets the goroutines of a table share a seeded source
+type lockedRand struct {
+	mutex sync.Mutex
+	r     *rand.Rand
+}
+
+func (l *lockedRand) Read(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.r.Read(p)
+}
+
+// shutdown stops the table of n, the network first drops
+// its endpoint so that its lookups end without the clock
+func (s *Simulation) shutdown(n *simNode) {
+	s.net.remove(n.addr, n.ep)
+	tab := n.tab
+	n.tab = nil
+	s.stops.Add(1)
+	go func() {
+		defer s.stops.Done()
+		tab.Stop()
+	}()
+}
+
+// drive runs the tables on a single processor while the simulation moves
+// the clock, so that yielding to the scheduler lets all of them run, see
+// settle. The previous setting is restored when it returns
+func (s *Simulation) drive() func() {
+	procs := runtime.GOMAXPROCS(1)
+	return func() { runtime.GOMAXPROCS(procs) }
+}
+
+// Run lets d of virtual time pass
+func (s *Simulation) Run(d time.Duration) {
+	defer s.drive()()
+	end := s.clock.Now().Add(d)
+	for {
+		s.settle()
+		next, ok := s.clock.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		s.step(next, end)
+	}
+	s.clock.AdvanceTo(end)
+	s.settle()
+}
+
+// step fires the timers due until next plus the resolution one at a
+// time, letting the tables settle after each of them so that the order
+// in which they act doesn't depend on the scheduler
+func (s *Simulation) step(next, end time.Time) {
+	to := next.Add(s.cfg.Resolution)
+	if to.After(end) {
+		to = end
+	}
+	for s.clock.fireNext(to) {
+		s.settle()
+	}
+	s.clock.AdvanceTo(to)
+}
+
+// settle waits until the tables are idle: no request is being handled and
+// they didn't touch the clock or the network for cfg.SettleRounds yields
+// to the scheduler. On a single processor the goroutines made runnable
+// run before a yield returns, so it doesn't depend on wall time or on
+// the load of the host
+func (s *Simulation) settle() {
+	last := s.clock.activityCount()
+	for quiet := 0; quiet < s.cfg.SettleRounds; {
+		runtime.Gosched()
+		if cur := s.clock.activityCount(); cur != last || s.net.busy() {
+			last = cur
+			quiet = 0
+		} else {
+			quiet++
+		}
+	}
+}
+
+// Lookups resolves num random running nodes from other running nodes
+// at the same time, and waits for all of them to end
+func (s *Simulation) Lookups(num int) {
+	defer s.drive()()
+	up := s.upNodes()
+	if len(up) < 2 {
+		return
+	}
+	type result struct {
+		from string
+		lt   *lookupTrack
+		time time.Duration
+		err  error
+	}
+	results := make(chan result, num)
+	for i := 0; i < num; i++ {
+		from := up[s.rand.Intn(len(up))]
+		to := from
+		for to == from {
+			to = up[s.rand.Intn(len(up))]
+		}
+		lt := s.net.track(from.addr, to.id)
+		cctx, cancel := ctx.WithCancel(ctx.Background())
+		timeout := s.clock.AfterFunc(s.cfg.LookupTimeout, cancel)
+		start := s.clock.Now()
+		go func(from *simNode, tab *routing.Table, id routing.Hash) {
+			_, err := tab.ResolveContext(cctx, id)
+			took := s.clock.Now().Sub(start)
+			timeout.Stop()
+			cancel()
+			results <- result{from: from.addr, lt: lt, time: took, err: err}
+		}(from, from.tab, to.id)
+	}
+	for done := 0; done < num; {
+		select {
+		case r := <-results:
+			done++
+			s.net.untrack(r.from, r.lt.target)
+			s.lookups++
+			if r.err == nil {
+				hops := r.lt.result()
+				s.found++
+				s.hops += hops
+				s.time += r.time
+				if hops > s.maxHops {
+					s.maxHops = hops
+				}
+			}
+			continue
+		default:
+		}
+		s.settle()
+		if next, ok := s.clock.Next(); ok {
+			s.step(next, next.Add(s.cfg.Resolution))
+		}
+	}
+}
+
+// Churn stops num running nodes and restarts num of the nodes
+// stopped before, restarted nodes come back with an empty table
+func (s *Simulation) Churn(num int) error {
+	var down []*simNode
+	for _, n := range s.nodes {
+		if !n.up() {
+			down = append(down, n)
+		}
+	}
+	up := s.upNodes()
+	for i, j := range s.rand.Perm(len(up)) {
+		if i == num || len(up)-i <= s.cfg.Bootnodes {
+			break
+		}
+		s.shutdown(up[j])
+	}
+	up = s.upNodes()
+	for i, j := range s.rand.Perm(len(down)) {
+		if i == num {
+			break
+		}
+		if err := s.boot(down[j], up); err != nil {
+			return err
+		}
+		down[j].tab.Start()
+	}
+	return nil
+}
+
+// Partition splits the network in groups that can't talk
+// to each other until Heal
+func (s *Simulation) Partition(groups int) {
+	assign := make(map[string]int, len(s.nodes))
+	for i, j := range s.rand.Perm(len(s.nodes)) {
+		assign[s.nodes[j].addr] = i % groups
+	}
+	s.net.partition(assign)
+}
+
+func (s *Simulation) Heal() {
+	s.net.partition(nil)
+}
+
+func (s *Simulation) upNodes() []*simNode {
+	var up []*simNode
+	for _, n := range s.nodes {
+		if n.up() {
+			up = append(up, n)
+		}
+	}
+	return up
+}
+
+// components counts the connected parts of the graph linking every
+// running node to the nodes in its table it can currently reach
+func (s *Simulation) components(up []*simNode) int {
+	index := make(map[string]int, len(up))
+	for i, n := range up {
+		index[n.addr] = i
+	}
+	parent := make([]int, len(up))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	count := len(up)
+	for i, n := range up {
+		for _, e := range n.tab.ReadRandomNodes(nil, len(s.nodes)) {
+			j, ok := index[e.GetAddr()]
+			if !ok || s.net.reachable(n.addr, e.GetAddr()) == nil {
+				continue
+			}
+			if ri, rj := find(i), find(j); ri != rj {
+				parent[ri] = rj
+				count--
+			}
+		}
+	}
+	return count
+}
+
+func (s *Simulation) Report() Report {
+	defer s.drive()()
+	s.settle()
+	up := s.upNodes()
+	r := Report{
+		Time:     s.clock.Now().Sub(s.start),
+		Up:       len(up),
+		Lookups:  s.lookups,
+		Found:    s.found,
+		MaxHops:  s.maxHops,
+		Requests: atomic.LoadUint64(&s.net.requests),
+		Lost:     atomic.LoadUint64(&s.net.lost),
+	}
+	if s.lookups > 0 {
+		r.SuccessRate = float64(s.found) / float64(s.lookups)
+	}
+	if s.found > 0 {
+		r.AvgHops = float64(s.hops) / float64(s.found)
+		r.AvgTime = s.time / time.Duration(s.found)
+	}
+	r.Components = s.components(up)
+	r.Partitioned = r.Components > 1
+	return r
+}
+
+// Close stops every table
+func (s *Simulation) Close() {
+	for _, n := range s.nodes {
+		if n.up() {
+			s.shutdown(n)
+		}
+	}
+	s.stops.Wait()
+}
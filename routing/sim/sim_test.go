@@ -0,0 +1,241 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oj01ol/annchaincopy/routing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(100, 0)
+	c := NewClock(start)
+	t1 := c.NewTimer(2 * time.Second)
+	t2 := c.NewTimer(time.Second)
+	tk := c.NewTicker(time.Second)
+	var fired []time.Duration
+	c.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, c.Now().Sub(start)) })
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-t2.C())
+	assert.Equal(t, start.Add(time.Second), <-tk.C())
+	assert.Len(t, t1.C(), 0)
+
+	c.Advance(time.Second)
+	assert.Equal(t, []time.Duration{1500 * time.Millisecond}, fired)
+	assert.Equal(t, start.Add(2*time.Second), <-t1.C())
+	assert.Equal(t, start.Add(2*time.Second), <-tk.C())
+	assert.False(t, t1.Stop())
+
+	// an unread tick is dropped by Reset and Stop
+	assert.False(t, t2.Reset(time.Second))
+	c.Advance(time.Second)
+	assert.Len(t, t2.C(), 1)
+	t2.Reset(time.Minute)
+	assert.Len(t, t2.C(), 0)
+	assert.True(t, t2.Stop())
+
+	// ticks are dropped for slow receivers
+	c.Advance(10 * time.Second)
+	assert.Len(t, tk.C(), 1)
+	tk.Stop()
+	next, ok := c.Next()
+	assert.False(t, ok, "timer left at %v", next)
+	assert.Equal(t, start.Add(13*time.Second), c.Now())
+}
+
+func testConfig(nodes int) *Config {
+	cfg := DefaultConfig()
+	cfg.Nodes = nodes
+	cfg.LookupTimeout = 5 * time.Second
+	return cfg
+}
+
+func TestSimulation(t *testing.T) {
+	s, err := New(testConfig(64))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Run(time.Minute)
+	s.Lookups(40)
+	r := s.Report()
+	t.Log(r)
+	assert.Equal(t, time.Minute, r.Time.Truncate(time.Minute))
+	assert.Equal(t, 64, r.Up)
+	assert.Equal(t, 40, r.Lookups)
+	assert.True(t, r.SuccessRate >= 0.9, "success rate %v", r.SuccessRate)
+	assert.True(t, r.AvgHops > 0)
+	assert.True(t, r.MaxHops >= 1)
+	assert.False(t, r.Partitioned)
+	assert.True(t, r.Requests > 0)
+	assert.Zero(t, r.Lost)
+}
+
+func TestSimulationLoss(t *testing.T) {
+	cfg := testConfig(32)
+	cfg.Loss = 0.2
+	s, err := New(cfg)
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Run(time.Minute)
+	s.Lookups(20)
+	r := s.Report()
+	t.Log(r)
+	assert.True(t, r.Lost > 0)
+	assert.True(t, r.SuccessRate >= 0.7, "success rate %v", r.SuccessRate)
+}
+
+func TestSimulationChurn(t *testing.T) {
+	s, err := New(testConfig(48))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Run(time.Minute)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, s.Churn(8))
+		s.Run(time.Minute)
+	}
+	assert.Equal(t, 40, s.Report().Up)
+	s.Lookups(30)
+	r := s.Report()
+	t.Log(r)
+	assert.True(t, r.SuccessRate >= 0.8, "success rate %v", r.SuccessRate)
+}
+
+func TestSimulationPartition(t *testing.T) {
+	s, err := New(testConfig(32))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Run(time.Minute)
+	require.False(t, s.Report().Partitioned)
+
+	s.Partition(2)
+	s.Run(10 * time.Second)
+	r := s.Report()
+	assert.True(t, r.Partitioned)
+	assert.True(t, r.Components >= 2)
+
+	// the tables still know nodes of the other side and merge again
+	s.Heal()
+	s.Run(time.Minute)
+	s.Lookups(20)
+	r = s.Report()
+	t.Log(r)
+	assert.False(t, r.Partitioned)
+	assert.True(t, r.SuccessRate >= 0.9, "success rate %v", r.SuccessRate)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	require.Nil(t, cfg.Validate())
+	cfg.Timeout = cfg.Latency
+	assert.Equal(t, routing.CONFIG_ERR, errors.Cause(cfg.Validate()))
+	_, err := New(cfg)
+	assert.Equal(t, routing.CONFIG_ERR, errors.Cause(err))
+}
+
+func BenchmarkLookups(b *testing.B) {
+	s, err := New(DefaultConfig())
+	require.Nil(b, err)
+	defer s.Close()
+	s.Run(time.Minute)
+
+	b.ResetTimer()
+	s.Lookups(b.N)
+	b.StopTimer()
+	r := s.Report()
+	b.ReportMetric(r.SuccessRate, "success")
+	b.ReportMetric(r.AvgHops, "hops")
+}
+
+// BenchmarkLatencyAware compares the lookup time of the
+// two lookup strategies when some nodes are slow
+func BenchmarkLatencyAware(b *testing.B) {
+	for _, aware := range []bool{false, true} {
+		name := "plain"
+		if aware {
+			name = "aware"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := lookupTime(b, slowConfig(256, aware), b.N)
+			b.ReportMetric(r.SuccessRate, "success")
+			b.ReportMetric(float64(r.AvgTime)/float64(time.Millisecond), "ms/lookup")
+		})
+	}
+}
+
+// slowConfig has a third of the nodes slow, which a latency
+// aware lookup learns to avoid, trading closeness for speed
+func slowConfig(nodes int, latencyAware bool) *Config {
+	cfg := testConfig(nodes)
+	cfg.SlowNodes = 0.3
+	cfg.SlowLatency = 150 * time.Millisecond
+	cfg.Loss = 0.1
+	table := *cfg.Table
+	table.BucketSize = 3
+	table.LatencyAware = latencyAware
+	table.LatencyTradeoff = latencyAware
+	cfg.Table = &table
+	return cfg
+}
+
+func lookupTime(t testing.TB, cfg *Config, lookups int) Report {
+	s, err := New(cfg)
+	require.Nil(t, err)
+	defer s.Close()
+	s.Run(2 * time.Minute)
+	s.Lookups(lookups)
+	return s.Report()
+}
+
+// TestSimulationLatencyAware compares runs of a fixed seed, which are
+// reproducible, see TestSimulationRepeat
+func TestSimulationLatencyAware(t *testing.T) {
+	plainCfg, awareCfg := slowConfig(128, false), slowConfig(128, true)
+	plainCfg.Seed, awareCfg.Seed = 7, 7
+	plain := lookupTime(t, plainCfg, 100)
+	aware := lookupTime(t, awareCfg, 100)
+	t.Log("plain", plain)
+	t.Log("aware", aware)
+	assert.True(t, aware.SuccessRate >= plain.SuccessRate-0.05, "success rate %v", aware.SuccessRate)
+	assert.True(t, aware.AvgTime < plain.AvgTime, "lookup time %v, %v before", aware.AvgTime, plain.AvgTime)
+}
+
+func TestSimulationRepeat(t *testing.T) {
+	var reports []Report
+	for i := 0; i < 3; i++ {
+		cfg := testConfig(64)
+		cfg.Loss = 0.1
+		s, err := New(cfg)
+		require.Nil(t, err)
+		s.Run(time.Minute)
+		s.Lookups(40)
+		reports = append(reports, s.Report())
+		s.Close()
+	}
+	t.Log(reports[0])
+	assert.Equal(t, reports[0], reports[1])
+	assert.Equal(t, reports[0], reports[2])
+}
+
+func TestSimulationLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large simulation")
+	}
+	s, err := New(testConfig(2000))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Run(30 * time.Second)
+	s.Lookups(50)
+	r := s.Report()
+	t.Log(r)
+	assert.Equal(t, 2000, r.Up)
+	assert.True(t, r.SuccessRate >= 0.95, "success rate %v", r.SuccessRate)
+	assert.Equal(t, 1, r.Components)
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 )
 
+// SortNode is a node with its log distance to the target of the heap,
+// the nodes at the same log distance are ordered by the metric
 type SortNode struct {
 	dis int
 	*Node
@@ -19,11 +21,20 @@ type SortNodeHeap struct {
 	entries  []SortNode
 	size     int
 	targetID Hash
+	metric   Metric
 }
 
+// Init empties the heap for the size nodes closest to targetID by xor
 func (snh *SortNodeHeap) Init(size int, targetID Hash) {
+	snh.InitMetric(size, targetID, XORMetric{})
+}
+
+// InitMetric empties the heap for the size nodes closest to targetID by metric
+func (snh *SortNodeHeap) InitMetric(size int, targetID Hash, metric Metric) {
 	snh.entries = make([]SortNode, size)
+	snh.size = 0
 	snh.targetID = targetID
+	snh.metric = metric
 }
 
 func (snh SortNodeHeap) Len() int {
@@ -31,7 +42,21 @@ func (snh SortNodeHeap) Len() int {
 }
 
 func (snh SortNodeHeap) Less(i, j int) bool {
-	return snh.entries[i].dis >= snh.entries[j].dis
+	return snh.compare(snh.entries[i], snh.entries[j]) >= 0
+}
+
+// compare returns -1 when a is closer to the target than b,
+// 1 when b is closer and 0 when they are as close
+func (snh *SortNodeHeap) compare(a, b SortNode) int {
+	switch {
+	case a.dis < b.dis:
+		return -1
+	case a.dis > b.dis:
+		return 1
+	case a.Node == nil || b.Node == nil:
+		return 0
+	}
+	return snh.metric.Compare(snh.targetID, a.GetID(), b.GetID())
 }
 
 func (snh SortNodeHeap) Swap(i, j int) {
@@ -48,7 +73,7 @@ func (snh *SortNodeHeap) Push(x interface{}) {
 
 func (snh *SortNodeHeap) PushNode(n *Node) {
 	sn := SortNode{
-		dis:  distance(n.GetID(), snh.targetID),
+		dis:  snh.metric.Distance(n.GetID(), snh.targetID),
 		Node: n,
 	}
 	snh.PushSNode(sn)
@@ -56,7 +81,7 @@ func (snh *SortNodeHeap) PushNode(n *Node) {
 
 func (snh *SortNodeHeap) PushSNode(sn SortNode) {
 	if snh.size == len(snh.entries) {
-		if snh.entries[0].dis < sn.dis {
+		if snh.compare(snh.entries[0], sn) < 0 {
 			return
 		}
 		snh.PopNode()
@@ -123,11 +148,9 @@ func (snh *SortNodeHeap) GetMin() (sn SortNode, minIndex int) {
 	}
 	lastP := (snh.size)>>2 - 1
 	minIndex = snh.size - 1
-	min := snh.entries[minIndex].dis
 	for i := minIndex; i > lastP; i-- {
-		if snh.entries[i].dis < min {
+		if snh.compare(snh.entries[i], snh.entries[minIndex]) < 0 {
 			minIndex = i
-			min = snh.entries[minIndex].dis
 		}
 	}
 	sn = snh.entries[minIndex]
@@ -190,15 +213,22 @@ func (l *NodeRoundQueue) DataSlc() []*Node {
 
 ////////////////////////////////////////////////////////////////
 
+// nodesByDistance keeps its entries ordered by their distance to the target,
+// by xor when metric is nil
 type nodesByDistance struct {
 	entries []*Node
 	target  Hash
+	metric  Metric
 }
 
 func (h *nodesByDistance) push(n *Node, maxElems int) {
+	metric := h.metric
+	if metric == nil {
+		metric = XORMetric{}
+	}
 	h.entries = append(h.entries, n)
 	for i, node := range h.entries {
-		if distance(node.GetID(), h.target) > distance(n.GetID(), h.target) {
+		if metric.Compare(h.target, node.GetID(), n.GetID()) > 0 {
 			copy(h.entries[i+1:], h.entries[i:])
 			h.entries[i] = n
 			break
@@ -161,6 +161,25 @@ func TestNodsByDisAndSortHeap(t *testing.T) {
 			return
 		}
 	}
+
+	// both keep the same nodes by the full xor distance,
+	// nodeByDis has them sorted
+	inHeap := make(map[HashKey]bool)
+	for _, n := range sh.ToNodeSlc() {
+		inHeap[n.ID.AsKey()] = true
+	}
+	for i, n := range nodeByDis.entries {
+		if !inHeap[n.ID.AsKey()] {
+			t.Error("node of nodeByDis not in nodeHeap", i)
+		}
+		if i > 0 && distcmp(targetID, nodeByDis.entries[i-1].ID, n.ID) >= 0 {
+			t.Error("nodeByDis not sorted at", i)
+		}
+	}
+	min, _ := sh.GetMin()
+	if !min.ID.Equal(nodeByDis.entries[0].ID) {
+		t.Error("wrong heap minimum")
+	}
 }
 
 var sortBenchSlc []*Node
@@ -172,7 +191,6 @@ const (
 )
 
 func init() {
-	Init(NewConfigurable())
 	sortBenchSlc = make([]*Node, BENCH_DATA_SIZE)
 	for i := range sortBenchSlc {
 		sortBenchSlc[i] = genNodeForTest()
@@ -0,0 +1,202 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NodeStats is what the table measured about a remote node
+type NodeStats struct {
+	FirstSeen time.Time     // first answer or request from the node
+	LastSeen  time.Time     // last answer or request from the node
+	RTT       time.Duration // moving average of the ping and findnode round trips
+	RTTJitter time.Duration // moving average of the deviation from RTT
+	PingOK    uint64
+	PingFail  uint64
+	FindOK    uint64
+	FindFail  uint64
+}
+
+// PingRatio is the share of pings answered, 0 before any ping
+func (s *NodeStats) PingRatio() float64 {
+	return ratio(s.PingOK, s.PingFail)
+}
+
+// FindRatio is the share of findnodes answered, 0 before any findnode
+func (s *NodeStats) FindRatio() float64 {
+	return ratio(s.FindOK, s.FindFail)
+}
+
+func ratio(ok, fail uint64) float64 {
+	if ok+fail == 0 {
+		return 0
+	}
+	return float64(ok) / float64(ok+fail)
+}
+
+// seen records an answer or a request from the node at now
+func (s *NodeStats) seen(now time.Time) {
+	if s.FirstSeen.IsZero() {
+		s.FirstSeen = now
+	}
+	s.LastSeen = now
+}
+
+// addRTT folds a round trip in the averages,
+// with the weights of the tcp retransmission timer (rfc 6298)
+func (s *NodeStats) addRTT(rtt time.Duration) {
+	if s.RTT == 0 {
+		s.RTT = rtt
+		s.RTTJitter = rtt / 2
+		return
+	}
+	dev := s.RTT - rtt
+	if dev < 0 {
+		dev = -dev
+	}
+	s.RTTJitter = (3*s.RTTJitter + dev) / 4
+	s.RTT = (7*s.RTT + rtt) / 8
+}
+
+// statsEncodingVersion leads the encoding of NodeStats
+const statsEncodingVersion byte = 1
+
+// Marshal encodes the stats as a version byte followed by the varints of
+// first seen, last seen (unix nano), rtt, jitter and the four counters
+func (s *NodeStats) Marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(statsEncodingVersion)
+	var b [binary.MaxVarintLen64]byte
+	for _, v := range []int64{unixNano(s.FirstSeen), unixNano(s.LastSeen), int64(s.RTT), int64(s.RTTJitter)} {
+		buf.Write(b[:binary.PutVarint(b[:], v)])
+	}
+	for _, v := range []uint64{s.PingOK, s.PingFail, s.FindOK, s.FindFail} {
+		writeUvarint(&buf, v)
+	}
+	return buf.Bytes()
+}
+
+func (s *NodeStats) Unmarshal(bys []byte) error {
+	if len(bys) == 0 || bys[0] != statsEncodingVersion {
+		return errors.Wrap(NODE_ENCODING_ERR, "stats version")
+	}
+	d := nodeDecoder{buf: bys[1:]}
+	st := NodeStats{
+		FirstSeen: fromUnixNano(d.varint()),
+		LastSeen:  fromUnixNano(d.varint()),
+		RTT:       time.Duration(d.varint()),
+		RTTJitter: time.Duration(d.varint()),
+		PingOK:    d.uvarint(),
+		PingFail:  d.uvarint(),
+		FindOK:    d.uvarint(),
+		FindFail:  d.uvarint(),
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*s = st
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// StatsStore is implemented by node stores able to keep NodeStats,
+// with other stores no stats are kept
+type StatsStore interface {
+	// NodeStats returns the stats of id or nil
+	NodeStats(id Hash) *NodeStats
+	UpdateNodeStats(id Hash, s *NodeStats) error
+}
+
+// updateStats applies fn to the stats of id and stores them.
+func (db *nodeDB) updateStats(id Hash, fn func(s *NodeStats)) error {
+	ss, ok := db.store.(StatsStore)
+	if !ok {
+		return nil
+	}
+	db.statsMutex.Lock()
+	defer db.statsMutex.Unlock()
+	s := ss.NodeStats(id)
+	if s == nil {
+		s = &NodeStats{}
+	}
+	fn(s)
+	return ss.UpdateNodeStats(id, s)
+}
+
+// nodeStats retrieves the stats of id, nil when there are none.
+func (db *nodeDB) nodeStats(id Hash) *NodeStats {
+	if ss, ok := db.store.(StatsStore); ok {
+		return ss.NodeStats(id)
+	}
+	return nil
+}
+
+// recordPing records the answer of a ping to id, rtt is ignored on failure.
+func (db *nodeDB) recordPing(id Hash, rtt time.Duration, ok bool) error {
+	now := db.cfg.clock.Now()
+	return db.updateStats(id, func(s *NodeStats) {
+		if !ok {
+			s.PingFail++
+			return
+		}
+		s.PingOK++
+		s.addRTT(rtt)
+		s.seen(now)
+	})
+}
+
+// recordFind records the answer of a findnode to id, rtt is ignored on failure.
+func (db *nodeDB) recordFind(id Hash, rtt time.Duration, ok bool) error {
+	now := db.cfg.clock.Now()
+	return db.updateStats(id, func(s *NodeStats) {
+		if !ok {
+			s.FindFail++
+			return
+		}
+		s.FindOK++
+		s.addRTT(rtt)
+		s.seen(now)
+	})
+}
+
+// statsSeenInterval is the time within which the requests of a node are
+// recorded once, so that busy peers don't cost writes for each request
+const statsSeenInterval = time.Second
+
+// recordSeen records a request received from id.
+func (db *nodeDB) recordSeen(id Hash) error {
+	now := db.cfg.clock.Now()
+	if s := db.nodeStats(id); s != nil && now.Sub(s.LastSeen) < statsSeenInterval {
+		return nil
+	}
+	if err := db.updateLastPingReceived(id, now); err != nil {
+		return err
+	}
+	return db.updateStats(id, func(s *NodeStats) { s.seen(now) })
+}
+
+// NodeStats returns what the table measured about id,
+// false when it never heard from it or asked it
+func (t *Table) NodeStats(id Hash) (NodeStats, bool) {
+	s := t.db.nodeStats(id)
+	if s == nil {
+		return NodeStats{}, false
+	}
+	return *s, true
+}
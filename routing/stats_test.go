@@ -0,0 +1,100 @@
+package routing
+
+import (
+	ctx "context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeStatsRTT(t *testing.T) {
+	s := &NodeStats{}
+	s.addRTT(80 * time.Millisecond)
+	assert.Equal(t, 80*time.Millisecond, s.RTT)
+	assert.Equal(t, 40*time.Millisecond, s.RTTJitter)
+	s.addRTT(160 * time.Millisecond)
+	assert.Equal(t, 90*time.Millisecond, s.RTT)
+	assert.Equal(t, 50*time.Millisecond, s.RTTJitter)
+
+	assert.Equal(t, 0.0, s.PingRatio())
+	s.PingOK, s.PingFail = 3, 1
+	assert.Equal(t, 0.75, s.PingRatio())
+
+	s.FirstSeen = time.Unix(1000, 5)
+	s.FindFail = 2
+	got := &NodeStats{}
+	require.Nil(t, got.Unmarshal(s.Marshal()))
+	assert.True(t, s.FirstSeen.Equal(got.FirstSeen))
+	assert.True(t, got.LastSeen.IsZero())
+	got.FirstSeen = s.FirstSeen
+	assert.Equal(t, s, got)
+	assert.NotNil(t, got.Unmarshal(s.Marshal()[:5]))
+}
+
+// slowTransport answers after moving clock by delay
+type slowTransport struct {
+	clock *manualClockForTest
+	delay time.Duration
+}
+
+func (st slowTransport) Ping(addr string) error {
+	st.clock.Advance(st.delay)
+	return nil
+}
+
+func (st slowTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	st.clock.Advance(st.delay)
+	return []INode{NewNode(randHashForTest(), "1.2.3.9:30303")}, nil
+}
+
+func TestNodeStats(t *testing.T) {
+	initTest()
+	clock := newManualClockForTest()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	n := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	tab, err := NewTable(slowTransport{clock, 20 * time.Millisecond}, TEST_SELF_ID, TEST_SELF_ADDR, "", []INode{n}, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	_, ok := tab.NodeStats(n.ID)
+	assert.False(t, ok)
+
+	start := clock.Now()
+	// revalidates a random bucket, until n got pinged
+	for ok := false; !ok; _, ok = tab.NodeStats(n.ID) {
+		tab.doRevalidate(make(chan struct{}, 1))
+	}
+	tab.findNodeCallback(ctx.Background(), n, randHashForTest(), make(chan []*Node, 1), nil)
+	st, ok := tab.NodeStats(n.ID)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), st.PingOK)
+	assert.Equal(t, uint64(1), st.FindOK)
+	assert.Equal(t, 20*time.Millisecond, st.RTT)
+	assert.Equal(t, 7500*time.Microsecond, st.RTTJitter)
+	assert.True(t, st.FirstSeen.After(start))
+	assert.True(t, !st.LastSeen.Before(st.FirstSeen))
+
+	// failures and inbound requests
+	tab.net = deadTransport{}
+	tab.findNodeCallback(ctx.Background(), n, randHashForTest(), make(chan []*Node, 1), nil)
+	clock.Advance(time.Minute)
+	require.Nil(t, tab.OnReceiveReq(n))
+	st, _ = tab.NodeStats(n.ID)
+	assert.Equal(t, uint64(1), st.FindFail)
+	assert.Equal(t, 0.5, st.FindRatio())
+	assert.Equal(t, clock.Now(), st.LastSeen)
+	assert.Equal(t, clock.Now().Unix(), tab.db.lastPingReceived(n.ID).Unix())
+
+	// requests within statsSeenInterval are recorded once
+	seen := st.LastSeen
+	clock.Advance(statsSeenInterval / 2)
+	require.Nil(t, tab.OnReceiveReq(n))
+	st, _ = tab.NodeStats(n.ID)
+	assert.Equal(t, seen, st.LastSeen)
+	clock.Advance(statsSeenInterval)
+	require.Nil(t, tab.OnReceiveReq(n))
+	st, _ = tab.NodeStats(n.ID)
+	assert.Equal(t, clock.Now(), st.LastSeen)
+}
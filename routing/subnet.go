@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// subnetOf returns the /24 of an ipv4 address or the /64 of an ipv6 one.
+// Nodes on a LAN and addresses without an ip aren't limited, ok is false for them
+func subnetOf(addr string) (subnet string, ok bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%v/24", ip4.Mask(net.CIDRMask(24, 32))), true
+	}
+	return fmt.Sprintf("%v/64", ip.Mask(net.CIDRMask(64, 128))), true
+}
+
+// subnetSet counts the nodes of each subnet
+type subnetSet map[string]int
+
+func (s subnetSet) fits(subnet string, limit int) bool {
+	return limit <= 0 || s[subnet] < limit
+}
+
+func (s subnetSet) remove(subnet string) {
+	if s[subnet] <= 1 {
+		delete(s, subnet)
+	} else {
+		s[subnet]--
+	}
+}
+
+// addIP counts n in the subnets of the table and bucket b,
+// false is returned when either is full.
+// It must be called with the table mutex held
+func (t *Table) addIP(b *bucket, n *Node) bool {
+	subnet, ok := subnetOf(n.GetAddr())
+	if !ok {
+		return true
+	}
+	if !t.ips.fits(subnet, t.cfg.tableIPLimit) || !b.ips.fits(subnet, t.cfg.bucketIPLimit) {
+		atomic.AddUint64(&t.subnetRejected, 1)
+		return false
+	}
+	t.ips[subnet]++
+	b.ips[subnet]++
+	return true
+}
+
+// removeIP undoes addIP, it must be called with the table mutex held
+func (t *Table) removeIP(b *bucket, n *Node) {
+	subnet, ok := subnetOf(n.GetAddr())
+	if !ok {
+		return
+	}
+	t.ips.remove(subnet)
+	b.ips.remove(subnet)
+}
+
+// SubnetRejected returns the number of nodes kept out
+// of the table by the subnet limits
+func (t *Table) SubnetRejected() uint64 {
+	return atomic.LoadUint64(&t.subnetRejected)
+}
@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnetOf(t *testing.T) {
+	cases := []struct {
+		addr   string
+		subnet string
+	}{
+		{"1.2.3.4:30303", "1.2.3.0/24"},
+		{"1.2.3.4", "1.2.3.0/24"},
+		{"[2001:db8:1:2:3::1]:30303", "2001:db8:1:2::/64"},
+		{"127.0.0.1:30303", ""},
+		{"10.0.0.1:30303", ""},
+		{"[fe80::1]:30303", ""},
+		{"na", ""},
+	}
+	for _, c := range cases {
+		subnet, ok := subnetOf(c.addr)
+		assert.Equal(t, c.subnet != "", ok, c.addr)
+		assert.Equal(t, c.subnet, subnet, c.addr)
+	}
+}
+
+// subnetNodeForTest makes a node of the bucket level of self at addr
+func subnetNodeForTest(self Hash, level, i int, addr string) *Node {
+	id := ToHash(self)
+	id[0] ^= 0x80 >> uint(level)
+	id[len(id)-1] = byte(i)
+	return NewNode(id, addr)
+}
+
+func TestSubnetLimits(t *testing.T) {
+	initTest()
+	cfg := DefaultConfig()
+	cfg.BucketIPLimit = 2
+	cfg.TableIPLimit = 3
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 0, i, fmt.Sprintf("1.2.3.%v:30303", i))))
+	}
+	assert.Equal(t, 2, tab.len())
+	assert.Equal(t, uint64(1), tab.SubnetRejected())
+	// the node left out waits in the replacements
+	tab.mutex.Lock()
+	assert.Len(t, tab.bucket(subnetNodeForTest(TEST_SELF_ID, 0, 3, "").ID).replacements, 1)
+	tab.mutex.Unlock()
+
+	// the table limit holds across buckets
+	for i := 1; i <= 2; i++ {
+		require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 1, i, fmt.Sprintf("1.2.3.%v:30304", i))))
+	}
+	assert.Equal(t, 3, tab.len())
+	assert.Equal(t, uint64(2), tab.SubnetRejected())
+
+	// other subnets and LAN nodes aren't limited
+	require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 1, 3, "1.2.4.1:30303")))
+	require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 1, 4, "10.0.0.1:30303")))
+	require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 1, 5, "10.0.0.2:30303")))
+	assert.Equal(t, 6, tab.len())
+
+	// deleting makes room
+	tab.delete(subnetNodeForTest(TEST_SELF_ID, 0, 1, ""))
+	require.Nil(t, tab.add(subnetNodeForTest(TEST_SELF_ID, 1, 6, "1.2.3.6:30303")))
+	assert.Equal(t, 6, tab.len())
+	assert.Equal(t, uint64(2), tab.SubnetRejected())
+}
+
+func TestSubnetReplace(t *testing.T) {
+	initTest()
+	cfg := DefaultConfig()
+	cfg.BucketSize = 2
+	cfg.BucketIPLimit = 1
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+
+	a := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	b := subnetNodeForTest(TEST_SELF_ID, 0, 2, "5.6.7.1:30303")
+	c := subnetNodeForTest(TEST_SELF_ID, 0, 3, "1.2.3.2:30303")
+	d := subnetNodeForTest(TEST_SELF_ID, 0, 4, "9.9.9.1:30303")
+	for _, n := range []*Node{b, a, c, d} {
+		require.Nil(t, tab.add(n))
+	}
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	bk := tab.bucket(a.ID)
+	require.Len(t, bk.entries, 2)
+	require.Len(t, bk.replacements, 2)
+
+	// a new address of a is refused while b holds the subnet
+	moved := NewNode(a.ID, "5.6.7.2:30303")
+	assert.True(t, tab.bump(bk, moved))
+	assert.Equal(t, "1.2.3.1:30303", bk.entries[0].Addr)
+
+	// c shares the subnet of a, only d can be promoted
+	last := bk.entries[len(bk.entries)-1]
+	require.True(t, last.ID.Equal(b.ID))
+	assert.True(t, d.ID.Equal(tab.replace(bk, last).ID))
+	assert.Nil(t, tab.replace(bk, d))
+	require.Len(t, bk.entries, 1)
+	assert.True(t, bk.entries[0].ID.Equal(a.ID))
+	assert.Len(t, bk.replacements, 1)
+}
@@ -6,10 +6,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
 	"sync"
 	"time"
 
-	crand "crypto/rand"
 	"encoding/binary"
 	"math/rand"
 
@@ -17,43 +18,69 @@ import (
 )
 
 var (
-	HASH_FORMAT_ERR = errors.New("hash format err")
+	HASH_FORMAT_ERR    = errors.New("hash format err")
+	LOOKUP_TIMEOUT_ERR = errors.New("lookup timeout")
+	NODE_NOT_FOUND_ERR = errors.New("node not found")
+	NO_PEERS_ERR       = errors.New("no peers to ask")
+	TABLE_CLOSED_ERR   = errors.New("table closed")
+	NETWORK_ERR        = errors.New("node of another network")
 )
 
 type Hash []byte
 type HashKey = string
 type DealOnGetNodeFunc func(string)
 
+// ToHash makes a hash of DefaultHashLength from ori,
+// use Table.ToHash for tables configured with another length
 func ToHash(ori []byte) Hash {
+	return ToHashN(ori, DefaultHashLength)
+}
+
+// ToHashN makes a hash of length bytes from ori,
+// ori is cut or padded with 0xff to fit
+func ToHashN(ori []byte, length int) Hash {
 	var h Hash
-	h.Copy(ori)
+	h.CopyN(ori, length)
 	return h
 }
 
+// NewHash makes a hash of DefaultHashLength with all bits set,
+// use Table.NewHash for tables configured with another length
 func NewHash() Hash {
-	h := make([]byte, c.HashLength)
+	return NewHashN(DefaultHashLength)
+}
+
+func NewHashN(length int) Hash {
+	h := make([]byte, length)
 	for i := range h {
 		h[i] = 0xff
 	}
 	return h
 }
 
-func (h Hash) Check() error {
-	if len(h) != c.HashLength {
+func (h Hash) Check(length int) error {
+	if len(h) != length {
 		return HASH_FORMAT_ERR
 	}
 	hex := hex.EncodeToString(h)
-	if len(hex) != c.HashLength*2 {
+	if len(hex) != length*2 {
 		return HASH_FORMAT_ERR
 	}
 	return nil
 }
 
+// Copy sets h to a copy of ch
 func (h *Hash) Copy(ch []byte) {
-	(*h) = make([]byte, c.HashLength)
+	(*h) = make([]byte, len(ch))
+	copy(*h, ch)
+}
+
+// CopyN sets h to a copy of ch cut or padded with 0xff to length bytes
+func (h *Hash) CopyN(ch []byte, length int) {
+	(*h) = make([]byte, length)
 	copy(*h, ch)
 	i := len(ch)
-	for ; i < c.HashLength; i++ {
+	for ; i < length; i++ {
 		(*h)[i] = 0xff
 	}
 }
@@ -69,6 +96,7 @@ func (h Hash) AsKey() HashKey {
 type bucket struct {
 	entries      []*Node
 	replacements []*Node
+	ips          subnetSet // subnets of the entries
 }
 
 // TODO use buffer
@@ -90,9 +118,15 @@ func (b *bucket) String() string {
 
 //node used in other modules
 type Node struct {
-	Time int64
-	ID   Hash
-	Addr string
+	Time    int64
+	ID      Hash
+	Addr    string
+	Record  *Record // signed description of the node, optional
+	Network string  // network the node claims, see GetNetwork
+
+	// Endpoints are all the addresses the node advertises,
+	// Addr is the one the table sends discovery requests to
+	Endpoints []Endpoint
 }
 
 func NewNode(id Hash, addr string) *Node {
@@ -107,17 +141,6 @@ func (n *Node) Equal(nn *Node) bool {
 	return n.Time == nn.Time && n.ID.Equal(nn.ID) && n.Addr == nn.Addr
 }
 
-func (n *Node) Marshal() ([]byte, error) {
-	return json.Marshal(n)
-}
-
-func (n *Node) Unmarshal(bys []byte) error {
-	if n == nil {
-		n = &Node{}
-	}
-	return json.Unmarshal(bys, n)
-}
-
 func (n *Node) AddedAt() time.Time {
 	return time.Unix(n.Time, 0)
 }
@@ -134,28 +157,50 @@ func (n *Node) GetID() Hash {
 	return n.ID
 }
 
+func (n *Node) GetRecord() *Record {
+	return n.Record
+}
+
+// GetNetwork returns the network of n, the one signed in
+// its record when it has a record, "" when unknown
+func (n *Node) GetNetwork() string {
+	if n.Record != nil {
+		return string(n.Record.Get(RecordNetworkKey))
+	}
+	return n.Network
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("ID:%x,Addr:%v,Time:%v", n.ID, n.Addr, n.Time)
 }
 
 func (n *Node) MarshalJSON() ([]byte, error) {
 	st := struct {
-		Time string
-		ID   string
-		Addr string
+		Time      string
+		ID        string
+		Addr      string
+		Record    *Record    `json:",omitempty"`
+		Network   string     `json:",omitempty"`
+		Endpoints []Endpoint `json:",omitempty"`
 	}{
-		Time: time.Unix(n.Time, 0).Format(time.RFC3339),
-		ID:   fmt.Sprintf("%x", n.ID),
-		Addr: n.Addr,
+		Time:      time.Unix(n.Time, 0).Format(time.RFC3339),
+		ID:        fmt.Sprintf("%x", n.ID),
+		Addr:      n.Addr,
+		Record:    n.Record,
+		Network:   n.Network,
+		Endpoints: n.Endpoints,
 	}
 	return json.Marshal(&st)
 }
 
 func (n *Node) UnmarshalJSON(bys []byte) error {
 	st := struct {
-		Time string
-		ID   string
-		Addr string
+		Time      string
+		ID        string
+		Addr      string
+		Record    *Record
+		Network   string
+		Endpoints []Endpoint
 	}{}
 	if err := json.Unmarshal(bys, &st); err != nil {
 		return err
@@ -171,6 +216,9 @@ func (n *Node) UnmarshalJSON(bys []byte) error {
 	}
 	n.Time = ttm.Unix()
 	n.Addr = st.Addr
+	n.Record = st.Record
+	n.Network = st.Network
+	n.Endpoints = st.Endpoints
 	return nil
 }
 
@@ -179,12 +227,52 @@ type INode interface {
 	GetID() Hash
 }
 
-type transport interface {
+// Transport is the outbound half of the discovery protocol,
+// the table sends its requests to remote nodes through it
+type Transport interface {
 	Ping(string) error
 	FindNode(ctx.Context, string, Hash) ([]INode, error)
 }
 
+// ContextPinger is implemented by transports whose pings take a
+// context, the table pings through it to pass the id of the node
+type ContextPinger interface {
+	PingContext(ctx.Context, string) error
+}
+
+type nodeIDKey struct{}
+
+// WithNodeID tells the transport the id of the node a request is sent to,
+// transports authenticating the nodes refuse another one answering
+func WithNodeID(parent ctx.Context, id Hash) ctx.Context {
+	return ctx.WithValue(parent, nodeIDKey{}, id)
+}
+
+// NodeIDFromContext returns the id set by WithNodeID, nil when there is none
+func NodeIDFromContext(cctx ctx.Context) Hash {
+	id, _ := cctx.Value(nodeIDKey{}).(Hash)
+	return id
+}
+
+// Handler is the inbound half of the discovery protocol,
+// a transport hands the requests received from remote nodes to it
+type Handler interface {
+	// HandlePing is called when from pinged us
+	HandlePing(from INode) error
+	// HandleFindNode returns the nodes closest to target known locally
+	HandleFindNode(from INode, target Hash) ([]INode, error)
+}
+
+// Server is implemented by transports that also receive requests,
+// NewTable serves itself on such a transport
+type Server interface {
+	Serve(self INode, h Handler)
+}
+
 type Table struct {
+	subnetRejected    uint64 // first for atomic alignment
+	admissionRejected uint64
+
 	buckets []*bucket
 	//bucket	[]Node
 	mutex sync.Mutex
@@ -192,42 +280,76 @@ type Table struct {
 	db       *nodeDB
 	self     *Node
 	nursery  []*Node
-	net      transport
+	net      Transport
 	rand     *rand.Rand
 	closeReq chan struct{}
 	closed   chan struct{}
+	cfg      *tbConfig
+	ips      subnetSet // subnets of the entries of all buckets
+
+	subMutex sync.Mutex
+	subs     map[*Subscription]struct{}
+
+	boot    *bootState
+	bans    *banList
+	limiter *inboundLimiter
 
 	//rsp		chan Packet
 }
 
-func NewTable(t transport, selfID Hash, selfAddr string, nodeDBPath string, bootnodes []INode) (*Table, error) {
-	if err := selfID.Check(); err != nil {
+// NewTable creates a table with cfg,
+// the default config is used when cfg is nil
+func NewTable(t Transport, selfID Hash, selfAddr string, nodeDBPath string, bootnodes []INode, cfg *Config) (*Table, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := selfID.Check(cfg.HashLength); err != nil {
 		return nil, err
 	}
 
-	db, err := newNodeDB(nodeDBPath, selfID)
+	db, err := openNodeDB(nodeDBPath, selfID, cfg)
 	if err != nil {
 		return nil, err
 	}
 	n := NewNode(selfID, selfAddr)
+	n.Network = cfg.NetworkID
+	n.Endpoints = cfg.Endpoints
+	if cfg.PrivateKey != nil {
+		if n.Record, err = newSelfRecord(cfg, db, n); err != nil {
+			db.close()
+			return nil, err
+		}
+	}
 	tab := &Table{
-		buckets:  make([]*bucket, c.nBuckets),
+		cfg:      newTbConfig(cfg),
 		net:      t,
 		db:       db,
 		self:     n,
 		rand:     rand.New(rand.NewSource(0)),
 		closeReq: make(chan struct{}),
 		closed:   make(chan struct{}),
+		boot:     newBootState(),
+		bans:     newBanList(cfg.AllowIDs, db.bans(), cfg.clockOrDefault().Now()),
+		ips:      make(subnetSet),
+		limiter:  newInboundLimiter(cfg, cfg.clockOrDefault().Now()),
 	}
 	if err := tab.setFallbackNodes(_inodesToNodes(bootnodes)); err != nil {
+		db.close()
 		return nil, err
 	}
+	tab.buckets = make([]*bucket, tab.cfg.nBuckets)
 	for i := range tab.buckets {
-		tab.buckets[i] = &bucket{}
+		tab.buckets[i] = &bucket{ips: make(subnetSet)}
 	}
 	tab.seedRand()
 	tab.loadSeedNodes()
 	tab.db.ensureExpirer() //expire db
+	if s, ok := t.(Server); ok {
+		s.Serve(tab.self, NewTableHandler(tab))
+	}
 	return tab, nil
 }
 
@@ -239,6 +361,21 @@ func (t *Table) Stop() {
 	t.closeReq <- struct{}{}
 }
 
+// NewHash makes a hash of the table's length with all bits set
+func (t *Table) NewHash() Hash {
+	return NewHashN(t.cfg.HashLength)
+}
+
+// ToHash makes a hash of the table's length from ori
+func (t *Table) ToHash(ori []byte) Hash {
+	return ToHashN(ori, t.cfg.HashLength)
+}
+
+// CheckHash reports whether h has the table's length
+func (t *Table) CheckHash(h Hash) error {
+	return h.Check(t.cfg.HashLength)
+}
+
 func (t *Table) String() string {
 	//str := "buckets"
 	//for i := range t.buckets {
@@ -285,12 +422,16 @@ func (t *Table) setFallbackNodes(nodes []*Node) error {
 }
 
 func (t *Table) loadSeedNodes() {
-	seeds := t.db.querySeeds(c.seedCount, c.seedMaxAge) //if reboot after one week, will get nothing
+	seeds := t.db.querySeeds(t.cfg.seedCount, t.cfg.seedMaxAge) //if reboot after one week, will get nothing
 	seeds = append(seeds, t.nursery...)
+	loaded := 0
 	for i := range seeds {
 		seed := seeds[i]
-		t.add(seed)
+		if t.add(seed) == nil {
+			loaded++
+		}
 	}
+	t.bootLoaded(loaded)
 }
 
 func (t *Table) add(n *Node) error {
@@ -300,20 +441,47 @@ func (t *Table) add(n *Node) error {
 	if n.InComplete() {
 		return errors.New("add node incomplete")
 	}
+	if err := n.checkEndpoints(); err != nil {
+		return err
+	}
+	if err := t.CheckHash(n.GetID()); err != nil {
+		return err
+	}
+	if err := t.checkBan(n); err != nil {
+		return err
+	}
+	if err := t.checkRecord(n); err != nil {
+		return err
+	}
+	if err := t.checkNetwork(n); err != nil {
+		return err
+	}
+	if err := t.checkAdmission(n); err != nil {
+		return err
+	}
+	t.mutex.Lock()
 	entries := t.closestFaster(n.GetID(), 1)
+	t.mutex.Unlock()
 	if len(entries) != 0 {
 		dutyn := entries[0]
-		if distance(t.self.GetID(), n.GetID()) <= distance(dutyn.GetID(), n.GetID()) {
+		if t.cfg.metric.Distance(t.self.GetID(), n.GetID()) <= t.cfg.metric.Distance(dutyn.GetID(), n.GetID()) {
 			t.mutex.Lock()
 			nb := t.bucket(n.GetID())
-			if len(nb.entries) >= 2*c.bucketSize {
+			if t.bump(nb, n) {
+				// already in the bucket
+			} else if len(nb.entries) >= 2*t.cfg.bucketSize {
+				t.addReplacement(nb, n)
+			} else if !t.addIP(nb, n) {
+				// over the subnet limits, it may be promoted later
 				t.addReplacement(nb, n)
 			} else {
-				n.UpdateAddTime(time.Now())
-				nb.entries = pushNode(nb.entries, n, 2*c.bucketSize)
+				n.UpdateAddTime(t.cfg.clock.Now())
+				nb.entries = pushNode(nb.entries, n, 2*t.cfg.bucketSize)
 				nb.replacements = deleteNode(nb.replacements, n)
+				t.emit(TableEvent{Type: NodeAdded, Node: n, Bucket: t.bucketIndex(n.GetID())})
 			}
 			t.mutex.Unlock()
+			t.persist(n)
 			return nil
 		}
 	}
@@ -324,49 +492,120 @@ func (t *Table) add(n *Node) error {
 		t.addReplacement(b, n)
 	}
 	t.mutex.Unlock()
+	t.persist(n)
 	return nil
 }
 
+// persist stores the record of n once n is an entry of the table, so that
+// db only grows with the nodes we keep. The newest seq of the replacements
+// is kept in memory by the bucket
+func (t *Table) persist(n *Node) {
+	if n.Record == nil {
+		return
+	}
+	t.mutex.Lock()
+	entered := false
+	for _, e := range t.bucket(n.GetID()).entries {
+		entered = entered || e == n
+	}
+	t.mutex.Unlock()
+	if entered {
+		t.db.updateNode(n)
+	}
+}
+
+// checkNetwork refuses the nodes of other networks,
+// bootnodes are trusted as they may serve several networks
+func (t *Table) checkNetwork(n *Node) error {
+	if t.cfg.networkID == "" || n.GetNetwork() == t.cfg.networkID || t.isBootnode(n.GetID()) {
+		return nil
+	}
+	return NETWORK_ERR
+}
+
+// checkReplied refuses the nodes of a lookup reply which can't be
+// compared with the nodes of the lookup or which the table would refuse,
+// so that the lookups don't query them
+func (t *Table) checkReplied(n *Node) error {
+	if err := t.CheckHash(n.GetID()); err != nil {
+		return err
+	}
+	if err := t.checkBan(n); err != nil {
+		return err
+	}
+	if err := t.checkNetwork(n); err != nil {
+		return err
+	}
+	return t.checkAdmission(n)
+}
+
+func (t *Table) isBootnode(id Hash) bool {
+	for _, bn := range t.nursery {
+		if bn.GetID().Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *Node) InComplete() bool {
 	return n.GetAddr() == "" || n.GetID().Equal(Hash{})
 }
 
 func (t *Table) bucket(id Hash) *bucket {
-	d := distance(t.self.GetID(), id)
-	if d <= c.bucketMinDistance {
-		return t.buckets[0]
-	}
-	return t.buckets[d-c.bucketMinDistance-1]
+	return t.buckets[t.bucketIndex(id)]
 }
 
+func (t *Table) bucketIndex(id Hash) int {
+	d := t.cfg.metric.Distance(t.self.GetID(), id)
+	return t.cfg.metric.BucketIndex(d, t.cfg.hashBits, t.cfg.nBuckets)
+}
+
+// bumpOrAdd puts n in b unless b is full or n is over
+// the subnet limits, false is returned when it didn't
 func (t *Table) bumpOrAdd(b *bucket, n *Node) bool {
-	if b.bump(n) {
+	if t.bump(b, n) {
 		return true
 	}
-	if len(b.entries) >= c.bucketSize {
+	if len(b.entries) >= t.cfg.bucketSize {
+		return false
+	}
+	if !t.addIP(b, n) {
 		return false
 	}
 
-	n.UpdateAddTime(time.Now())
-	b.entries = pushNode(b.entries, n, c.bucketSize)
+	n.UpdateAddTime(t.cfg.clock.Now())
+	b.entries = pushNode(b.entries, n, t.cfg.bucketSize)
 	b.replacements = deleteNode(b.replacements, n)
+	t.emit(TableEvent{Type: NodeAdded, Node: n, Bucket: t.bucketIndex(n.GetID())})
 
 	return true
 
 }
 
 func (t *Table) addReplacement(b *bucket, n *Node) {
-	for _, e := range b.replacements {
+	for i, e := range b.replacements {
 		if e.GetID().Equal(n.GetID()) {
+			b.replacements[i] = n
 			return
 		}
 	}
-	b.replacements = pushNode(b.replacements, n, c.maxReplacements)
+	b.replacements = pushNode(b.replacements, n, t.cfg.maxReplacements)
+	t.emit(TableEvent{Type: NodeMovedToReplacements, Node: n, Bucket: t.bucketIndex(n.GetID())})
 }
 
-func (b *bucket) bump(n *Node) bool {
+// bump moves n to the front of b if it's in it,
+// a new address of n is only taken when it fits the subnet limits
+func (t *Table) bump(b *bucket, n *Node) bool {
 	for i := range b.entries {
-		if b.entries[i].GetID().Equal(n.GetID()) {
+		if old := b.entries[i]; old.GetID().Equal(n.GetID()) {
+			if old.GetAddr() != n.GetAddr() {
+				t.removeIP(b, old)
+				if !t.addIP(b, n) {
+					t.addIP(b, old)
+					n = old
+				}
+			}
 			copy(b.entries[1:], b.entries[:i])
 			b.entries[0] = n
 			return true
@@ -395,7 +634,7 @@ func deleteNode(list []*Node, n *Node) []*Node {
 
 func (t *Table) seedRand() {
 	var b [8]byte
-	crand.Read(b[:])
+	io.ReadFull(t.cfg.rand, b[:])
 
 	t.mutex.Lock()
 	t.rand.Seed(int64(binary.BigEndian.Uint64(b[:])))
@@ -404,10 +643,13 @@ func (t *Table) seedRand() {
 
 func (t *Table) loop() {
 	var (
-		revalidate     = time.NewTimer(t.nextRevalidateTime())
-		refresh        = time.NewTicker(c.refreshInterval)
+		revalidate     = t.cfg.clock.NewTimer(t.nextRevalidateTime())
+		refresh        = t.cfg.clock.NewTicker(t.cfg.refreshInterval)
+		republish      = t.cfg.clock.NewTicker(t.cfg.republishInterval)
+		bootRetry      = t.cfg.clock.NewTicker(t.cfg.bootstrapRetry)
 		revalidateDone = make(chan struct{})
 		refreshDone    = make(chan struct{})
+		republishDone  chan struct{}
 	)
 
 	go t.doRefresh(refreshDone)
@@ -415,7 +657,7 @@ func (t *Table) loop() {
 loop:
 	for {
 		select {
-		case <-refresh.C:
+		case <-refresh.C():
 			t.seedRand()
 			if refreshDone == nil {
 				refreshDone = make(chan struct{})
@@ -423,7 +665,23 @@ loop:
 			}
 		case <-refreshDone:
 			refreshDone = nil
-		case <-revalidate.C:
+		case <-republish.C():
+			if republishDone == nil {
+				republishDone = make(chan struct{})
+				go t.doRepublish(republishDone)
+			}
+		case <-republishDone:
+			republishDone = nil
+		case <-bootRetry.C():
+			// every node was dropped, start over from the seeds
+			if t.len() == 0 {
+				t.loadSeedNodes()
+				if refreshDone == nil {
+					refreshDone = make(chan struct{})
+					go t.doRefresh(refreshDone)
+				}
+			}
+		case <-revalidate.C():
 			go t.doRevalidate(revalidateDone)
 		case <-revalidateDone:
 			revalidate.Reset(t.nextRevalidateTime())
@@ -436,7 +694,12 @@ loop:
 	if refreshDone != nil {
 		<-refreshDone
 	}
+	if republishDone != nil {
+		<-republishDone
+	}
 	refresh.Stop()
+	republish.Stop()
+	bootRetry.Stop()
 	revalidate.Stop()
 	t.db.close()
 	close(t.closed)
@@ -444,7 +707,7 @@ loop:
 }
 
 func (t *Table) nextRevalidateTime() time.Duration {
-	return time.Duration(t.rand.Int63n(int64(c.revalidateInterval)))
+	return time.Duration(t.rand.Int63n(int64(t.cfg.revalidateInterval)))
 }
 
 func (t *Table) doRefresh(done chan struct{}) {
@@ -454,8 +717,8 @@ func (t *Table) doRefresh(done chan struct{}) {
 func (t *Table) doRefreshCallback(done chan struct{}, deal func(addr string)) {
 	t.getNodesByNetCallback(t.self.GetID(), deal, false)
 	for i := 0; i < 3; i++ {
-		target := NewHash()
-		crand.Read(target[:])
+		target := t.NewHash()
+		io.ReadFull(t.cfg.rand, target[:])
 		t.getNodesByNetCallback(target, deal, false)
 	}
 	close(done)
@@ -463,40 +726,69 @@ func (t *Table) doRefreshCallback(done chan struct{}, deal func(addr string)) {
 
 func (t *Table) doRevalidate(done chan struct{}) {
 	defer func() { done <- struct{}{} }()
+	t.mutex.Lock()
 	bi := t.rand.Intn(len(t.buckets)) //need seeds
 	b := t.buckets[bi]
 	if len(b.entries) == 0 {
+		t.mutex.Unlock()
 		return
 	}
 	last := b.entries[len(b.entries)-1]
+	t.mutex.Unlock()
 	if last == nil {
 		return
 	}
-	err := t.net.Ping(last.GetAddr())
+	start := t.cfg.clock.Now()
+	err := t.ping(last)
+	t.db.recordPing(last.GetID(), t.cfg.clock.Now().Sub(start), err == nil)
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	b = t.buckets[bi]
 	if err == nil {
-		t.db.updateLastPongReceived(last.GetID(), time.Now())
-		b.bump(last)
+		if last.Record != nil {
+			// it answered, the record is worth keeping
+			t.db.updateNode(last)
+		}
+		t.db.updateLastPongReceived(last.GetID(), t.cfg.clock.Now())
+		t.bump(b, last)
 		return
 	}
+	t.emit(TableEvent{Type: RevalidationFailed, Node: last, Bucket: bi})
 	t.replace(b, last)
 
 }
 
+// ping pings n, with its id when the transport takes it
+func (t *Table) ping(n *Node) error {
+	if cp, ok := t.net.(ContextPinger); ok {
+		return cp.PingContext(WithNodeID(ctx.Background(), n.GetID()), n.GetAddr())
+	}
+	return t.net.Ping(n.GetAddr())
+}
+
 func (t *Table) replace(b *bucket, last *Node) *Node {
 	if len(b.entries) == 0 || !b.entries[len(b.entries)-1].GetID().Equal(last.GetID()) {
 		return nil
 	}
-	if len(b.replacements) == 0 {
-		b.entries = deleteNode(b.entries, last)
-		return nil
+	bi := t.bucketIndex(last.GetID())
+	t.removeIP(b, last)
+	// promote a random replacement fitting the subnet limits
+	if n := len(b.replacements); n > 0 {
+		start := t.rand.Intn(n)
+		for i := 0; i < n; i++ {
+			r := b.replacements[(start+i)%n]
+			if !t.addIP(b, r) {
+				continue
+			}
+			b.replacements = deleteNode(b.replacements, r)
+			b.entries[len(b.entries)-1] = r
+			t.emit(TableEvent{Type: NodeReplaced, Node: r, Old: last, Bucket: bi})
+			return r
+		}
 	}
-	r := b.replacements[t.rand.Intn(len(b.replacements))]
-	b.replacements = deleteNode(b.replacements, r)
-	b.entries[len(b.entries)-1] = r
-	return r
+	b.entries = deleteNode(b.entries, last)
+	t.emit(TableEvent{Type: NodeRemoved, Node: last, Bucket: bi})
+	return nil
 }
 
 //get node address by Nodeid
@@ -504,11 +796,17 @@ func (t *Table) replace(b *bucket, last *Node) *Node {
 //2.findnode in the network
 
 func (t *Table) GetNodesLocally(targetID Hash) []INode {
+	if t.CheckHash(targetID) != nil {
+		return nil
+	}
 	nodes := t.getNodesLocally(targetID)
 	return _nodesToINodes(nodes)
 }
 
 func (t *Table) getNodeLocally(targetID Hash) (ret *Node) {
+	if t.CheckHash(targetID) != nil {
+		return nil
+	}
 	t.mutex.Lock()
 	bk := t.bucket(targetID)
 	for _, n := range bk.entries {
@@ -523,7 +821,7 @@ func (t *Table) getNodeLocally(targetID Hash) (ret *Node) {
 
 func (t *Table) getNodesLocally(targetID Hash) []*Node {
 	t.mutex.Lock()
-	entries := t.closestFaster(targetID, c.findsize)
+	entries := t.closestFaster(targetID, t.cfg.findsize)
 	t.mutex.Unlock()
 	return entries
 }
@@ -539,58 +837,105 @@ func _nodesToINodes(nodes []*Node) []INode {
 func _inodesToNodes(inodes []INode) []*Node {
 	nodes := make([]*Node, len(inodes))
 	for i := range inodes {
-		nodes[i] = NewNode(inodes[i].GetID(), inodes[i].GetAddr())
+		nodes[i] = nodeFromINode(inodes[i])
 	}
 	return nodes
 }
 
+// GetNodeAddr returns the address of targetID, or "" when it can't be found.
+// It may block for long if peers hang, see ResolveContext
 func (t *Table) GetNodeAddr(targetID Hash) string {
-	node := t.getNodeLocally(targetID)
-	if node == nil {
-		nodes := t.getNodesByNetCallback(targetID, nil, true)
-		if len(nodes) > 0 {
-			node = nodes[0]
-		}
+	node, err := t.ResolveContext(ctx.Background(), targetID)
+	if err != nil {
+		return ""
 	}
-	if node != nil {
-		return node.Addr
+	return node.Addr
+}
+
+// ResolveContext finds the node with id, in the table first and
+// then in the network, until it's found or cctx is done
+func (t *Table) ResolveContext(cctx ctx.Context, id Hash) (*Node, error) {
+	if err := t.CheckHash(id); err != nil {
+		return nil, err
+	}
+	if node := t.getNodeLocally(id); node != nil {
+		return node, nil
+	}
+	nodes, err := t.lookup(cctx, id, nil, true)
+	if err != nil {
+		return nil, err
 	}
-	return ""
+	return nodes[0], nil
 }
 
+// OnReceiveReq offers the sender of an inbound request to the table,
+// under the rate limits of the config. The request is recorded in the
+// stats of the sender when it's in the table or in the database
 func (t *Table) OnReceiveReq(node INode) error {
-	n := NewNode(node.GetID(), node.GetAddr())
-	return t.add(n)
+	if err := t.allowInbound(node); err != nil {
+		return err
+	}
+	n := nodeFromINode(node)
+	if err := t.add(n); err != nil {
+		return err
+	}
+	if !n.GetID().Equal(t.self.GetID()) && (t.getNodeLocally(n.GetID()) != nil || t.db.getNode(n.GetID()) != nil) {
+		t.db.recordSeen(n.GetID())
+	}
+	return nil
 }
 
+// GetNodesByNet returns the nodes closest to targetID in the network.
+// It may block for long if peers hang, see LookupContext
 func (t *Table) GetNodesByNet(targetID Hash) []*Node {
 	return t.getNodesByNetCallback(targetID, nil, false)
 }
 
-func (t *Table) getNodesByNetCallback(targetID Hash, deal DealOnGetNodeFunc, must bool) (ret []*Node) {
+// LookupContext returns the nodes closest to target in the network.
+// When cctx is done first, the closest nodes found so far are
+// returned along with the error
+func (t *Table) LookupContext(cctx ctx.Context, target Hash) ([]*Node, error) {
+	return t.lookup(cctx, target, nil, false)
+}
+
+func (t *Table) getNodesByNetCallback(targetID Hash, deal DealOnGetNodeFunc, must bool) []*Node {
+	ret, _ := t.lookup(ctx.Background(), targetID, deal, must)
+	return ret
+}
+
+// lookup asks the network for the nodes closest to targetID,
+// with must set it stops as soon as targetID itself is found
+// and fails with NODE_NOT_FOUND_ERR if it isn't.
+// It runs the disjoint paths of the config, see lookupPaths
+func (t *Table) lookup(parent ctx.Context, targetID Hash, deal DealOnGetNodeFunc, must bool) ([]*Node, error) {
+	return t.lookupPaths(parent, targetID, t.cfg.disjointPaths, deal, must)
+}
+
+// lookupPath runs one path of a lookup from the nodes of result,
+// it asks the nodes no other path asked. cctx ends the queries,
+// the lookup error comes from parent
+func (t *Table) lookupPath(parent, cctx ctx.Context, result *nodesByDistance, asked *askedSet, deal DealOnGetNodeFunc, must bool) ([]*Node, error) {
 	var (
-		asked          = make(map[HashKey]bool)
-		result         *nodesByDistance
+		targetID       = result.target
 		seen           = make(map[HashKey]bool)
-		reply          = make(chan []*Node, c.alpha)
+		reply          = make(chan []*Node, t.cfg.alpha)
 		pendingQueries = 0
+		costs          map[HashKey]time.Duration
 	)
-
-	asked[t.self.GetID().AsKey()] = true
-
-	t.mutex.Lock()
-	result = t.closest(targetID, c.findsize)
-	t.mutex.Unlock()
-	cctx, cancel := ctx.WithCancel(ctx.Background())
-
-OUT_FOR:
+	for _, n := range result.entries {
+		seen[n.GetID().AsKey()] = true
+	}
+	if t.cfg.latencyAware {
+		costs = make(map[HashKey]time.Duration)
+	}
 	for {
-		for i := 0; i < len(result.entries) && pendingQueries < c.alpha; i++ {
-			n := result.entries[i]
-			nodeKey := n.GetID().AsKey()
-			if !asked[nodeKey] {
-				asked[nodeKey] = true
-				seen[nodeKey] = true
+		candidates := result.entries
+		if costs != nil {
+			candidates = t.queryOrder(result, costs)
+		}
+		for i := 0; i < len(candidates) && pendingQueries < t.cfg.alpha; i++ {
+			n := candidates[i]
+			if asked.ask(n.GetID()) {
 				pendingQueries++
 				go t.findNodeCallback(cctx, n, targetID, reply, deal)
 			}
@@ -600,50 +945,87 @@ OUT_FOR:
 			break
 		}
 		// wait for the next reply
-		for _, n := range <-reply {
+		var nodes []*Node
+		select {
+		case nodes = <-reply:
+		case <-cctx.Done():
+			if must {
+				return nil, lookupErr(parent.Err())
+			}
+			return result.entries, lookupErr(parent.Err())
+		}
+		for _, n := range nodes {
 			if n != nil {
 				nodeKey := n.GetID().AsKey()
 				if must {
 					if targetID.Equal(n.GetID()) {
-						ret = []*Node{n}
-						cancel()
-						break OUT_FOR
+						return []*Node{n}, nil
 					}
 				}
 				if !seen[nodeKey] {
 					seen[nodeKey] = true
-					result.push(n, c.findsize)
+					result.push(n, t.cfg.findsize)
 				}
 			}
 		}
 		pendingQueries--
 	}
-	if !must {
-		ret = result.entries
+	if must {
+		return nil, NODE_NOT_FOUND_ERR
 	}
-	return
+	return result.entries, nil
+}
+
+func lookupErr(err error) error {
+	if err == ctx.DeadlineExceeded {
+		return LOOKUP_TIMEOUT_ERR
+	}
+	return err
 }
 
 //ask n for the *Node info
 func (t *Table) findNodeCallback(cctx ctx.Context, n *Node, targetID Hash, reply chan<- []*Node, deal DealOnGetNodeFunc) {
-	r, err := t.net.FindNode(cctx, n.GetAddr(), targetID)
+	qctx := cctx
+	if t.cfg.latencyAware {
+		var cancel ctx.CancelFunc
+		qctx, cancel = t.withQueryTimeout(cctx, t.queryTimeout(t.db.nodeStats(n.GetID())))
+		defer cancel()
+	}
+	start := t.cfg.clock.Now()
+	r, err := t.net.FindNode(WithNodeID(qctx, n.GetID()), n.GetAddr(), targetID)
+	if cctx.Err() != nil {
+		// the lookup is over, n is not to blame
+		reply <- nil
+		return
+	}
+	t.db.recordFind(n.GetID(), t.cfg.clock.Now().Sub(start), err == nil && len(r) != 0)
 	fails := t.db.findFails(n.GetID())
 
-	if err != nil || len(r) == 0 {
+	if err != nil && qctx.Err() != nil {
+		// only slower than our adaptive timeout, the stats raise
+		// its cost and timeout but n isn't dropped for it
+	} else if err != nil || len(r) == 0 {
 		fails++
 		t.db.updateFindFails(n.GetID(), fails)
-		if fails >= c.maxFindFailures {
+		if fails >= t.cfg.maxFindFailures {
 			t.delete(n)
 		}
-	} else if fails > 0 {
-		t.db.updateLastPongReceived(n.GetID(), time.Now())
-		t.db.updateFindFails(n.GetID(), fails-1)
+	} else {
+		t.bootAnswered(n)
+		if fails > 0 {
+			t.db.updateLastPongReceived(n.GetID(), t.cfg.clock.Now())
+			t.db.updateFindFails(n.GetID(), fails-1)
+		}
 	}
 
-	nodes := make([]*Node, len(r))
+	nodes := make([]*Node, 0, len(r))
 	for i := range r {
-		nodes[i] = NewNode(r[i].GetID(), r[i].GetAddr())
-		t.add(nodes[i])
+		node := nodeFromINode(r[i])
+		if t.checkReplied(node) != nil {
+			continue
+		}
+		t.add(node)
+		nodes = append(nodes, node)
 	}
 	if deal != nil {
 		deal(n.GetAddr())
@@ -704,12 +1086,19 @@ func (t *Table) ReadRandomNodes(buf []Hash, num int) []INode {
 func (t *Table) delete(n *Node) {
 	t.mutex.Lock()
 	b := t.bucket(n.GetID())
-	b.entries = deleteNode(b.entries, n)
+	for _, e := range b.entries {
+		if e.GetID().Equal(n.GetID()) {
+			b.entries = deleteNode(b.entries, e)
+			t.removeIP(b, e)
+			t.emit(TableEvent{Type: NodeRemoved, Node: n, Bucket: t.bucketIndex(n.GetID())})
+			break
+		}
+	}
 	t.mutex.Unlock()
 }
 
 func (t *Table) closest(target Hash, nresults int) *nodesByDistance {
-	closeSet := &nodesByDistance{target: target}
+	closeSet := &nodesByDistance{target: target, metric: t.cfg.metric}
 	//search all buckets
 	for _, b := range t.buckets {
 		for _, n := range b.entries {
@@ -722,9 +1111,11 @@ func (t *Table) closest(target Hash, nresults int) *nodesByDistance {
 	return closeSet
 }
 
+// closestFaster returns the nresults entries closest to target,
+// the closest first
 func (t *Table) closestFaster(target Hash, nresults int) []*Node {
 	heap := &SortNodeHeap{}
-	heap.Init(nresults, target)
+	heap.InitMetric(nresults, target, t.cfg.metric)
 	//search all buckets
 	for _, b := range t.buckets {
 		for _, n := range b.entries {
@@ -733,55 +1124,9 @@ func (t *Table) closestFaster(target Hash, nresults int) []*Node {
 			}
 		}
 	}
-	return heap.ToNodeSlc()
-}
-
-func distance(a Hash, b Hash) int {
-	lz := 0
-	for i := range a {
-		x := a[i] ^ b[i]
-		if x == 0 {
-			lz += 8
-		} else {
-			lz += lzcount[x]
-			break
-		}
-	}
-	return len(a)*8 - lz
-
-}
-
-var lzcount = [256]int{
-	8, 7, 6, 6, 5, 5, 5, 5,
-	4, 4, 4, 4, 4, 4, 4, 4,
-	3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 3, 3, 3, 3, 3,
-	2, 2, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 2, 2, 2, 2,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	1, 1, 1, 1, 1, 1, 1, 1,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
-	0, 0, 0, 0, 0, 0, 0, 0,
+	nodes := heap.ToNodeSlc()
+	sort.Slice(nodes, func(i, j int) bool {
+		return t.cfg.metric.Compare(target, nodes[i].GetID(), nodes[j].GetID()) < 0
+	})
+	return nodes
 }
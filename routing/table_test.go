@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,12 +25,11 @@ var (
 	TEST_SELF_ID           Hash
 	TEST_SELF_ADDR         = "127.0.0.1:666"
 	TEST_DB_NAME           = "lvdb_test"
-	net                    transport
+	testNet                Transport
 	TMP_DIR                = "./tmp_dir_for_test"
 )
 
 func initTest() {
-	Init(NewConfigurable())
 	hash, _ := hex.DecodeString("bc977d652d1853e114ee69bfed4fdaa039149820")
 	TEST_SELF_ID = ToHash(hash)
 }
@@ -53,7 +54,7 @@ func (tf *TransferForTest) fillSpecificData(t *testing.T, nodes []INode, initNum
 		assert.Nil(t, err, "new dbpath err")
 		tf.tmpPath[i] = dbpath
 		choose := chooseFromNodes(nodes /*[:i+1]*/, initNum, i)
-		tb, err := NewTable(tf, tbID, tbIP, dbpath, choose)
+		tb, err := NewTable(tf, tbID, tbIP, dbpath, choose, nil)
 		choosedN := _inodesToNodes(choose)
 		for j := range choosedN {
 			tb.add(choosedN[j])
@@ -171,7 +172,7 @@ func TestNewTable(t *testing.T) {
 	dbpath, err := ioutil.TempDir("", TEST_DB_NAME)
 	defer os.Remove(dbpath)
 	require.Nil(t, err, "get temp dir err")
-	tb, err := NewTable(tsfer, TEST_SELF_ID, TEST_SELF_ADDR, dbpath, bnodes)
+	tb, err := NewTable(tsfer, TEST_SELF_ID, TEST_SELF_ADDR, dbpath, bnodes, nil)
 	require.Nil(t, err, "new table err")
 	tb.Start()
 	nodes := genBootNodes(10)
@@ -187,7 +188,7 @@ func TestNewTable(t *testing.T) {
 
 func Test_GetNodesLocally(t *testing.T) {
 	initTest()
-	tab, _ := NewTable(net, ToHash([]byte{41}), "nc", "", []INode{})
+	tab, _ := NewTable(testNet, ToHash([]byte{41}), "nc", "", []INode{}, nil)
 	n1 := &Node{Addr: "na", ID: ToHash([]byte{43})}
 	n2 := &Node{Addr: "na", ID: ToHash([]byte{44})}
 	n3 := &Node{Addr: "na", ID: ToHash([]byte{45})}
@@ -224,7 +225,7 @@ func Test_GetNodesLocally(t *testing.T) {
 
 func Test_closest(t *testing.T) {
 	initTest()
-	tab, _ := NewTable(net, ToHash([]byte{41}), "nc", "", []INode{})
+	tab, _ := NewTable(testNet, ToHash([]byte{41}), "nc", "", []INode{}, nil)
 	n1 := &Node{Addr: "na", ID: ToHash([]byte{43})}
 	n2 := &Node{Addr: "na", ID: ToHash([]byte{44})}
 	n3 := &Node{Addr: "na", ID: ToHash([]byte{45})}
@@ -264,10 +265,83 @@ func Test_distance(t *testing.T) {
 	}
 }
 
+func TestDistcmp(t *testing.T) {
+	target := Hash{0x10, 0x00}
+	// both in the bucket at log distance 5 of the target
+	a, b := Hash{0x00, 0x01}, Hash{0x00, 0x02}
+	assert.Equal(t, distance(a, target), distance(b, target))
+	assert.Equal(t, -1, distcmp(target, a, b))
+	assert.Equal(t, 1, distcmp(target, b, a))
+	assert.Equal(t, 0, distcmp(target, a, a))
+	assert.Equal(t, -1, distcmp(target, target, a))
+	assert.Equal(t, 1, distcmp(target, Hash{0xff, 0x00}, a))
+	// ids of another length are the farthest
+	assert.Equal(t, 1, distcmp(target, Hash{0x10}, Hash{0xff, 0xff}))
+	assert.Equal(t, -1, distcmp(target, a, Hash{0x10, 0x00, 0x00}))
+	assert.Equal(t, 0, distcmp(target, Hash{0x10}, Hash{}))
+}
+
+// closestIDsForTest returns the num ids closest to target by brute force
+func closestIDsForTest(metric Metric, ids []Hash, target Hash, num int) []Hash {
+	sorted := append([]Hash{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return metric.Compare(target, sorted[i], sorted[j]) < 0
+	})
+	return sorted[:num]
+}
+
+func TestLookupConverges(t *testing.T) {
+	initTest()
+	ids, known := idsForTest(150)
+	// every node knows its closest neighbors, as after a refresh
+	for i := range ids {
+		for _, id := range closestIDsForTest(XORMetric{}, ids, ids[i], 17)[1:] {
+			for j := range ids {
+				if ids[j].Equal(id) {
+					known[i] = append(known[i], j)
+				}
+			}
+		}
+	}
+	lt := lyingNetForTest(t, ids, known, 0, DefaultConfig())
+	defer closeLyingNetForTest(lt)
+
+	// the peers answer with the nodes asking them, the local one included
+	tab := lt.table(genIPForTest(1))
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 10; i++ {
+		target := NewHash()
+		r.Read(target)
+		want := closestIDsForTest(XORMetric{}, ids, target, tab.cfg.findsize)
+		// the same nodes again once the first lookup filled the tables
+		for round := 0; round < 2; round++ {
+			nodes, err := tab.LookupContext(ctx.Background(), target)
+			require.Nil(t, err)
+			require.Len(t, nodes, len(want))
+			for j := range want {
+				assert.True(t, nodes[j].ID.Equal(want[j]), "target %v round %v: node %v is %x, want %x", i, round, j, nodes[j].ID, want[j])
+			}
+		}
+	}
+}
+
+func TestLookupShortIDs(t *testing.T) {
+	initTest()
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, nil)
+	require.Nil(t, err)
+	defer tab.db.close()
+	boot := NewNode(randHashForTest(), genIPForTest(1))
+	tab.net = nodesTransport{nodes: []INode{NewNode(Hash{1, 2}, genIPForTest(2))}}
+	reply := make(chan []*Node, 1)
+	tab.findNodeCallback(ctx.Background(), boot, randHashForTest(), reply, nil)
+	assert.Len(t, <-reply, 0)
+	assert.Nil(t, tab.getNodeLocally(Hash{1, 2}))
+}
+
 func Test_delete(t *testing.T) {
 	initTest()
 	n5 := &Node{Addr: "na", ID: ToHash([]byte{47})}
-	tab, _ := NewTable(net, ToHash([]byte{41}), "nc", "", []INode{})
+	tab, _ := NewTable(testNet, ToHash([]byte{41}), "nc", "", []INode{}, nil)
 	tab.add(n5)
 	nodes := tab.closest(ToHash([]byte{47}), 4)
 	if !nodes.entries[0].ID.Equal(n5.ID) {
@@ -450,3 +524,116 @@ func Test_BrainSplitRate(t *testing.T) {
 		fmt.Println("==============================")
 	}
 }
+
+// hangTransport never answers findnode before the context is done
+type hangTransport struct {
+	inflight int32
+}
+
+func (ht *hangTransport) Ping(addr string) error { return nil }
+
+func (ht *hangTransport) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	atomic.AddInt32(&ht.inflight, 1)
+	defer atomic.AddInt32(&ht.inflight, -1)
+	<-cctx.Done()
+	return nil, cctx.Err()
+}
+
+func TestLookupContext(t *testing.T) {
+	initTest()
+	ht := &hangTransport{}
+	tab, err := NewTable(ht, TEST_SELF_ID, TEST_SELF_ADDR, "", genBootNodes(5), nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+
+	cctx, cancel := ctx.WithTimeout(ctx.Background(), 50*time.Millisecond)
+	defer cancel()
+	nodes, err := tab.LookupContext(cctx, randHashForTest())
+	assert.Equal(t, LOOKUP_TIMEOUT_ERR, err)
+	assert.Len(t, nodes, 5, "partial result lost")
+
+	cctx, cancel = ctx.WithCancel(ctx.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = tab.ResolveContext(cctx, randHashForTest())
+	assert.Equal(t, ctx.Canceled, err)
+
+	// abandoned queries end and don't count against the peers
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&ht.inflight) == 0
+	}, time.Second, 10*time.Millisecond, "queries leaked")
+	for _, n := range nodes {
+		assert.Equal(t, 0, tab.db.findFails(n.GetID()))
+		assert.NotNil(t, tab.getNodeLocally(n.GetID()))
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	initTest()
+	tab, err := NewTable(testNet, TEST_SELF_ID, TEST_SELF_ADDR, "", nil, nil)
+	require.Nil(t, err, "new table err")
+	defer tab.db.close()
+	_, err = tab.LookupContext(ctx.Background(), randHashForTest())
+	assert.Equal(t, NO_PEERS_ERR, err)
+	_, err = tab.LookupContext(ctx.Background(), Hash{1})
+	assert.Equal(t, HASH_FORMAT_ERR, err)
+
+	tsfer := &TransferForTest{}
+	allNodes := genBootNodes(5)
+	tsfer.fillSpecificData(t, allNodes, 2)
+	defer tsfer.Clear()
+	tsfer.ExecAll(func(tb *Table) bool {
+		_, err := tb.ResolveContext(ctx.Background(), randHashForTest())
+		assert.Equal(t, NODE_NOT_FOUND_ERR, err)
+		assert.Equal(t, "", tb.GetNodeAddr(randHashForTest()))
+		tb.db.close()
+		return true
+	})
+}
+
+func TestNetworkIsolation(t *testing.T) {
+	initTest()
+	mainBoot := subnetNodeForTest(TEST_SELF_ID, 0, 1, "1.2.3.1:30303")
+	mainBoot.Network = "mainnet"
+	cfg := DefaultConfig()
+	cfg.NetworkID = "testnet"
+	tab, err := NewTable(deadTransport{}, TEST_SELF_ID, TEST_SELF_ADDR, "", []INode{mainBoot}, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	assert.NotNil(t, tab.getNodeLocally(mainBoot.ID), "shared bootnode refused")
+
+	mainNode := subnetNodeForTest(TEST_SELF_ID, 0, 2, "1.2.4.1:30303")
+	mainNode.Network = "mainnet"
+	unknown := subnetNodeForTest(TEST_SELF_ID, 0, 3, "1.2.5.1:30303")
+	testNode := subnetNodeForTest(TEST_SELF_ID, 0, 4, "1.2.6.1:30303")
+	testNode.Network = "testnet"
+	assert.Equal(t, NETWORK_ERR, tab.add(mainNode))
+	assert.Equal(t, NETWORK_ERR, tab.add(unknown))
+	assert.Equal(t, NETWORK_ERR, NewTableHandler(tab).HandlePing(mainNode))
+	require.Nil(t, tab.add(testNode))
+
+	assert.Equal(t, NETWORK_ERR, tab.db.updateNode(mainNode))
+	assert.Nil(t, tab.db.getNode(mainNode.ID), "node of another network stored")
+	require.Nil(t, tab.db.updateNode(testNode))
+}
+
+func TestNetworkRecord(t *testing.T) {
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	cfg := DefaultConfig()
+	cfg.PrivateKey = key
+	cfg.NetworkID = "testnet"
+	tab, err := NewTable(deadTransport{}, IDFromPubKey(key.PubKey(), cfg.HashLength), "1.2.3.1:30303", "", nil, cfg)
+	require.Nil(t, err)
+	defer tab.db.close()
+	require.NotNil(t, tab.self.Record)
+	assert.Equal(t, []byte("testnet"), tab.self.Record.Get(RecordNetworkKey))
+
+	// the signed network wins over the claimed one
+	n := NewNodeFromRecord(tab.self.Record)
+	assert.Equal(t, "testnet", n.GetNetwork())
+	n.Network = "mainnet"
+	assert.Equal(t, "testnet", n.GetNetwork())
+}
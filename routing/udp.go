@@ -0,0 +1,546 @@
+package routing
+
+import (
+	ctx "context"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	udpPingPacket byte = iota + 1
+	udpPongPacket
+	udpFindNodePacket
+	udpNeighborsPacket
+	udpStorePacket
+	udpStoredPacket
+	udpFindValuePacket
+	udpValuePacket
+	udpHelloPacket
+	udpChallengePacket
+	udpAuthPacket
+	udpAuthAckPacket
+	udpSealedPacket // a packet of a session, see udpSession.seal
+)
+
+const (
+	udpHeaderSize     = 9 // packet type + request id
+	udpMaxPacketSize  = 64 * 1024
+	udpDefaultTimeout = 500 * time.Millisecond
+)
+
+var (
+	UDP_PACKET_ERR  = errors.New("udp packet format err")
+	UDP_TIMEOUT_ERR = errors.New("udp request timeout")
+	UDP_CLOSED_ERR  = errors.New("udp transport closed")
+)
+
+// udpPacket is the body of every discovery packet,
+// unused fields are left out of the encoding
+type udpPacket struct {
+	From   *Node         `json:",omitempty"`
+	Target Hash          `json:",omitempty"`
+	Nodes  []*Node       `json:",omitempty"`
+	Value  []byte        `json:",omitempty"`
+	TTL    time.Duration `json:",omitempty"`
+	Error  string        `json:",omitempty"`
+	// Proven tells in a pong that the pinging endpoint is proven
+	Proven    bool          `json:",omitempty"`
+	Handshake *udpHandshake `json:",omitempty"`
+}
+
+// encodePacket lays out a packet as: type(1) | request id(8) | json body
+func encodePacket(ptype byte, reqID uint64, p *udpPacket) ([]byte, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpHeaderSize, udpHeaderSize+len(body))
+	buf[0] = ptype
+	binary.BigEndian.PutUint64(buf[1:udpHeaderSize], reqID)
+	buf = append(buf, body...)
+	if len(buf) > udpMaxPacketSize {
+		return nil, UDP_PACKET_ERR
+	}
+	return buf, nil
+}
+
+func decodePacket(buf []byte) (ptype byte, reqID uint64, p *udpPacket, err error) {
+	if len(buf) < udpHeaderSize {
+		return 0, 0, nil, UDP_PACKET_ERR
+	}
+	ptype = buf[0]
+	if ptype < udpPingPacket || ptype > udpAuthAckPacket {
+		return 0, 0, nil, UDP_PACKET_ERR
+	}
+	reqID = binary.BigEndian.Uint64(buf[1:udpHeaderSize])
+	p = &udpPacket{}
+	if err = json.Unmarshal(buf[udpHeaderSize:], p); err != nil {
+		return 0, 0, nil, errors.Wrap(UDP_PACKET_ERR, err.Error())
+	}
+	return
+}
+
+// udpPending is a request waiting for its reply
+type udpPending struct {
+	from    string      // address the reply must come from
+	ptype   byte        // expected reply packet type
+	session *udpSession // the reply must come in it, nil for plain packets
+	reply   chan *udpPacket
+}
+
+// UDP is the transport used by Table on a real network.
+// Requests are matched with replies by the request id in the packet header,
+// inbound requests are answered by the handler given to Serve.
+//
+// Findnode, store and findvalue requests are only answered to proven
+// endpoints, which answered a ping, so that the replies can't be sent
+// to a victim spoofing its address. A transport made by ListenUDPAuth
+// also authenticates the nodes: the packets go through sessions opened
+// by a handshake proving the node keys, see udpSession
+type UDP struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	reqID   uint64
+	key     PrivKey // nil for plain packets
+	now     func() time.Time
+
+	mutex       sync.Mutex
+	self        *Node
+	handler     Handler
+	pending     map[uint64]*udpPending
+	proofs      map[string]time.Time // addr -> last pong from it
+	provenBy    map[string]time.Time // addr -> last time it proved our endpoint
+	waiters     map[string][]chan struct{}
+	pingingBack map[string]bool
+	sessions    map[uint64]*udpSession
+	byAddr      map[string]*udpSession // addr -> latest session with it
+	dialing     map[string]*udpDial
+	handshakes  map[string]*udpResponderState // initiator ephemeral key -> state
+	hellos      keyedBuckets                  // hellos of each source host
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	closed    chan struct{}
+}
+
+// ListenUDP binds addr and starts reading packets from it
+func ListenUDP(addr string) (*UDP, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUDP(conn, nil), nil
+}
+
+// ListenUDPAuth is ListenUDP with the packets authenticated by key,
+// the key of the record of the local node. Plain packets are refused
+// and the nodes are known by the ids derived from their keys
+func ListenUDPAuth(addr string, key PrivKey) (*UDP, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUDP(conn, key), nil
+}
+
+func newUDP(conn *net.UDPConn, key PrivKey) *UDP {
+	u := &UDP{
+		conn:        conn,
+		timeout:     udpDefaultTimeout,
+		key:         key,
+		now:         time.Now,
+		pending:     make(map[uint64]*udpPending),
+		proofs:      make(map[string]time.Time),
+		provenBy:    make(map[string]time.Time),
+		waiters:     make(map[string][]chan struct{}),
+		pingingBack: make(map[string]bool),
+		sessions:    make(map[uint64]*udpSession),
+		byAddr:      make(map[string]*udpSession),
+		dialing:     make(map[string]*udpDial),
+		handshakes:  make(map[string]*udpResponderState),
+		hellos:      keyedBuckets{limit: udpHelloLimit, buckets: make(map[string]*tokenBucket)},
+		closing:     make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go u.readLoop()
+	return u
+}
+
+// LocalAddr returns the address the transport is listening on
+func (u *UDP) LocalAddr() string {
+	return u.conn.LocalAddr().String()
+}
+
+// SetTimeout changes how long a request waits for its reply
+// when the context passed in has no earlier deadline
+func (u *UDP) SetTimeout(d time.Duration) {
+	u.mutex.Lock()
+	u.timeout = d
+	u.mutex.Unlock()
+}
+
+// Serve makes the transport answer inbound requests with h,
+// self is sent along with every packet so remote nodes can learn about us
+func (u *UDP) Serve(self INode, h Handler) {
+	u.mutex.Lock()
+	u.self = nodeFromINode(self)
+	u.handler = h
+	u.mutex.Unlock()
+}
+
+func (u *UDP) Close() error {
+	var err error
+	u.closeOnce.Do(func() {
+		close(u.closing)
+		err = u.conn.Close()
+		<-u.closed
+	})
+	return err
+}
+
+func (u *UDP) Ping(addr string) error {
+	return u.PingContext(ctx.Background(), addr)
+}
+
+func (u *UDP) PingContext(cctx ctx.Context, addr string) error {
+	self, _ := u.serving()
+	_, err := u.request(cctx, addr, udpPingPacket, &udpPacket{From: self}, udpPongPacket)
+	return err
+}
+
+func (u *UDP) FindNode(cctx ctx.Context, addr string, target Hash) ([]INode, error) {
+	self, _ := u.serving()
+	req := &udpPacket{From: self, Target: target}
+	rsp, err := u.request(cctx, addr, udpFindNodePacket, req, udpNeighborsPacket)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]INode, 0, len(rsp.Nodes))
+	for _, n := range rsp.Nodes {
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func (u *UDP) Store(cctx ctx.Context, addr string, key Hash, value []byte, ttl time.Duration) error {
+	self, _ := u.serving()
+	req := &udpPacket{From: self, Target: key, Value: value, TTL: ttl}
+	rsp, err := u.request(cctx, addr, udpStorePacket, req, udpStoredPacket)
+	if err != nil {
+		return err
+	}
+	if rsp.Error != "" {
+		return errors.New(rsp.Error)
+	}
+	return nil
+}
+
+func (u *UDP) FindValue(cctx ctx.Context, addr string, key Hash) (*ValueReply, error) {
+	self, _ := u.serving()
+	req := &udpPacket{From: self, Target: key}
+	rsp, err := u.request(cctx, addr, udpFindValuePacket, req, udpValuePacket)
+	if err != nil {
+		return nil, err
+	}
+	vr := &ValueReply{Value: rsp.Value, TTL: rsp.TTL}
+	for _, n := range rsp.Nodes {
+		if n != nil {
+			vr.Nodes = append(vr.Nodes, n)
+		}
+	}
+	return vr, nil
+}
+
+func (u *UDP) serving() (*Node, Handler) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.self, u.handler
+}
+
+// request sends req in the session with addr, or after bonding
+// with it for plain packets, and waits for the reply. The session
+// must be with the node of the id of cctx, if any
+func (u *UDP) request(cctx ctx.Context, addr string, ptype byte, req *udpPacket, replyType byte) (*udpPacket, error) {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var s *udpSession
+	if u.key != nil {
+		id := NodeIDFromContext(cctx)
+		if s, err = u.session(cctx, to, id); err == nil && id != nil && !s.remoteID.Equal(id) {
+			err = errors.Wrapf(UDP_AUTH_ERR, "node %x at %v, not %x", s.remoteID, addr, id)
+		}
+	} else if ptype != udpPingPacket {
+		err = u.bond(cctx, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.send(cctx, to, s, ptype, req, replyType)
+}
+
+// send writes req to to, sealed when s is set, and waits for the reply
+func (u *UDP) send(cctx ctx.Context, to *net.UDPAddr, s *udpSession, ptype byte, req *udpPacket, replyType byte) (*udpPacket, error) {
+	reqID := atomic.AddUint64(&u.reqID, 1)
+	buf, err := encodePacket(ptype, reqID, req)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		if buf, err = s.seal(buf, u.now()); err != nil {
+			return nil, err
+		}
+	}
+	p := &udpPending{
+		from:    to.String(),
+		ptype:   replyType,
+		session: s,
+		reply:   make(chan *udpPacket, 1),
+	}
+	u.mutex.Lock()
+	u.pending[reqID] = p
+	timeout := u.timeout
+	u.mutex.Unlock()
+	defer func() {
+		u.mutex.Lock()
+		delete(u.pending, reqID)
+		u.mutex.Unlock()
+	}()
+
+	if _, err := u.conn.WriteToUDP(buf, to); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rsp := <-p.reply:
+		return rsp, nil
+	case <-timer.C:
+		return nil, UDP_TIMEOUT_ERR
+	case <-cctx.Done():
+		return nil, cctx.Err()
+	case <-u.closing:
+		return nil, UDP_CLOSED_ERR
+	}
+}
+
+func (u *UDP) readLoop() {
+	defer close(u.closed)
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		nbytes, from, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-u.closing:
+			default:
+				log.Println("udp read err", "err", err)
+			}
+			return
+		}
+		packet := buf[:nbytes]
+		var s *udpSession
+		if nbytes > 0 && packet[0] == udpSealedPacket {
+			if s, packet, err = u.openSealed(from, packet); err != nil {
+				log.Println("bad sealed udp packet", "from", from, "err", err)
+				continue
+			}
+		}
+		ptype, reqID, p, err := decodePacket(packet)
+		if err != nil {
+			log.Println("bad udp packet", "from", from, "err", err)
+			continue
+		}
+		u.handlePacket(from, s, ptype, reqID, p)
+	}
+}
+
+// handlePacket answers a packet from the address from,
+// s is the session it came in, nil for a plain packet
+func (u *UDP) handlePacket(from *net.UDPAddr, s *udpSession, ptype byte, reqID uint64, p *udpPacket) {
+	switch ptype {
+	case udpPongPacket, udpNeighborsPacket, udpStoredPacket, udpValuePacket, udpChallengePacket, udpAuthAckPacket:
+		u.mutex.Lock()
+		pd, ok := u.pending[reqID]
+		if ok && ptype == udpPongPacket && pd.session == s && pd.from == from.String() {
+			// recorded before the next packets of from are read
+			u.putProof(u.proofs, pd.from)
+		}
+		u.mutex.Unlock()
+		if !ok || pd.ptype != ptype || pd.from != from.String() || pd.session != s {
+			return
+		}
+		select {
+		case pd.reply <- p:
+		default:
+		}
+		return
+	case udpHelloPacket:
+		if u.key != nil && s == nil {
+			u.handleHello(from, reqID, p.Handshake)
+		}
+		return
+	case udpAuthPacket:
+		if u.key != nil && s == nil {
+			u.handleAuth(from, reqID, p.Handshake)
+		}
+		return
+	}
+
+	if u.key != nil && s == nil {
+		log.Println("udp drop unauthenticated request", "from", from)
+		return
+	}
+	node, ok := u.sender(from, s, p)
+	if !ok {
+		log.Println("udp drop request, sender id not authenticated", "from", from)
+		return
+	}
+	if ptype == udpPingPacket {
+		u.handlePing(from, s, reqID, node)
+		return
+	}
+	if !u.proven(from, s) {
+		// no answer to an address that may be spoofed
+		u.pingBack(from)
+		return
+	}
+	switch ptype {
+	case udpFindNodePacket:
+		self, h := u.serving()
+		if h == nil {
+			return
+		}
+		inodes, err := h.HandleFindNode(node, p.Target)
+		if err != nil {
+			log.Println("udp drop findnode", "from", from, "err", err)
+			return
+		}
+		u.reply(from, s, udpNeighborsPacket, reqID, &udpPacket{From: self, Nodes: toNodes(inodes)})
+	case udpStorePacket:
+		self, h := u.serving()
+		vh, ok := h.(ValueHandler)
+		if !ok {
+			return
+		}
+		rsp := &udpPacket{From: self}
+		if err := vh.HandleStore(node, p.Target, p.Value, p.TTL); err != nil {
+			if errors.Cause(err) == RATE_LIMIT_ERR {
+				return
+			}
+			rsp.Error = err.Error()
+		}
+		u.reply(from, s, udpStoredPacket, reqID, rsp)
+	case udpFindValuePacket:
+		self, h := u.serving()
+		vh, ok := h.(ValueHandler)
+		if !ok {
+			return
+		}
+		vr, err := vh.HandleFindValue(node, p.Target)
+		if err != nil {
+			log.Println("udp drop findvalue", "from", from, "err", err)
+			return
+		}
+		rsp := &udpPacket{From: self, Value: vr.Value, TTL: vr.TTL, Nodes: toNodes(vr.Nodes)}
+		u.reply(from, s, udpValuePacket, reqID, rsp)
+	}
+}
+
+// handlePing answers a ping with a pong and,
+// for plain packets, pings back an unproven sender
+func (u *UDP) handlePing(from *net.UDPAddr, s *udpSession, reqID uint64, sender INode) {
+	self, h := u.serving()
+	if h != nil && sender != nil {
+		if err := h.HandlePing(sender); err != nil {
+			switch errors.Cause(err) {
+			case RATE_LIMIT_ERR, BANNED_ERR, NOT_ALLOWED_ERR, ADMISSION_ERR, NETWORK_ERR:
+				// refused by the table, dropped without a pong and unlogged
+				// as pings are cheap to spoof: the sender gets neither proven
+				// nor pinged back, and mustn't take us for one of its network
+				return
+			}
+		}
+	}
+	proven := u.proven(from, s)
+	u.reply(from, s, udpPongPacket, reqID, &udpPacket{From: self, Proven: proven})
+	if s == nil {
+		u.provedBy(from)
+		if !proven {
+			u.pingBack(from)
+		}
+	}
+}
+
+func toNodes(inodes []INode) []*Node {
+	nodes := make([]*Node, len(inodes))
+	for i := range inodes {
+		nodes[i] = nodeFromINode(inodes[i])
+	}
+	return nodes
+}
+
+// sender is the node that sent p, using the address the packet
+// actually came from rather than the claimed one. In a session the
+// id is the authenticated one, false is returned when p claims another
+func (u *UDP) sender(from *net.UDPAddr, s *udpSession, p *udpPacket) (INode, bool) {
+	if s == nil {
+		return sender(from, p), true
+	}
+	if p.From == nil {
+		return sessionNode{NewNode(s.remoteID, from.String())}, true
+	}
+	if !p.From.GetID().Equal(s.remoteID) {
+		return nil, false
+	}
+	return sessionNode{sender(from, p).(*Node)}, true
+}
+
+// sender is the node of p at the address it came from, the endpoints
+// of a node with a record are taken from the record only. Without a
+// record its network is the one claimed, see Config.NetworkID
+func sender(from *net.UDPAddr, p *udpPacket) INode {
+	if p.From == nil {
+		return nil
+	}
+	n := NewNode(p.From.GetID(), from.String())
+	n.Record = p.From.Record
+	n.Network = p.From.Network
+	if n.Record != nil {
+		n.Endpoints = endpointsFromAddrs(n.Record.Addrs)
+	} else {
+		n.Endpoints = p.From.Endpoints
+	}
+	return n
+}
+
+func (u *UDP) reply(to *net.UDPAddr, s *udpSession, ptype byte, reqID uint64, p *udpPacket) {
+	buf, err := encodePacket(ptype, reqID, p)
+	if err == nil && s != nil {
+		buf, err = s.seal(buf, u.now())
+	}
+	if err != nil {
+		log.Println("udp encode reply err", "err", err)
+		return
+	}
+	if _, err := u.conn.WriteToUDP(buf, to); err != nil {
+		log.Println("udp write reply err", "to", to, "err", err)
+	}
+}
@@ -0,0 +1,570 @@
+package routing
+
+import (
+	"bytes"
+	ctx "context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	udpAuthWindow      = 20 * time.Second // packets stamped farther from now are refused
+	udpSessionLifetime = time.Hour        // a new handshake is done after it
+	udpProofLifetime   = 24 * time.Hour   // an endpoint proven stays so for it
+	udpMaxSessions     = 4096
+	udpMaxHandshakes   = 256  // handshakes waiting for their auth packet, the oldest is dropped
+	udpMaxProofs       = 4096 // endpoints kept as proven each way, the oldest is dropped
+	udpMaxPingBacks    = 64   // pings back in flight, the next ones are skipped
+	udpNonceSize       = 16
+	udpSealHeaderSize  = 1 + 8 + 12 // packet type | session id | gcm nonce
+	udpHandshakeDomain = "routing-udp-handshake"
+)
+
+// udpHelloLimit bounds the hellos answered for each source host,
+// as each of them costs a key generation and a signature
+var udpHelloLimit = RateLimit{Rate: 1, Burst: 8}
+
+var (
+	UDP_AUTH_ERR   = errors.New("udp authentication failed")
+	UDP_REPLAY_ERR = errors.New("udp packet replayed or expired")
+)
+
+// udpHandshake is the body of the handshake packets. The hello carries
+// the ephemeral key, nonce and time of the initiator, the challenge the
+// ones of the responder signed by its key, and the auth the signature of
+// the initiator; both signatures cover the two ephemeral keys and nonces
+type udpHandshake struct {
+	Ephemeral []byte
+	Nonce     []byte `json:",omitempty"`
+	Time      int64
+	Scheme    string `json:",omitempty"`
+	PubKey    []byte `json:",omitempty"`
+	Sig       []byte `json:",omitempty"`
+}
+
+// handshakeTranscript is what each side of a handshake signs, the
+// nonce of the peer makes the signature fresh and the ephemeral keys
+// bind it to the session keys
+func handshakeTranscript(role string, ephA, ephB, nonceA, nonceB []byte, t int64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(udpHandshakeDomain)
+	writeBytes(&buf, []byte(role))
+	for _, b := range [][]byte{ephA, ephB, nonceA, nonceB} {
+		writeBytes(&buf, b)
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(t))
+	buf.Write(ts[:])
+	return buf.Bytes()
+}
+
+// hkdfSHA256 is the key derivation of rfc 5869
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	prk := mac.Sum(nil)
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac = hmac.New(sha256.New, prk)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// udpSession is an authenticated channel with the node at addr,
+// its packets are sealed with a key for each direction
+type udpSession struct {
+	id       uint64
+	addr     string
+	remoteID Hash
+	send     cipher.AEAD
+	recv     cipher.AEAD
+	created  time.Time
+
+	mutex sync.Mutex
+	seen  map[[12]byte]time.Time // nonces received -> when they can be forgotten
+}
+
+// newUDPSession derives the session of a handshake from the shared
+// secret of the ephemeral keys, A being the initiator
+func newUDPSession(addr string, remoteID Hash, shared, ephA, ephB, nonceA, nonceB []byte, initiator bool, now time.Time) (*udpSession, error) {
+	salt := append(append([]byte{}, nonceA...), nonceB...)
+	info := append(append([]byte(udpHandshakeDomain), ephA...), ephB...)
+	okm := hkdfSHA256(shared, salt, info, 8+2*32)
+	toB, err := newGCM(okm[8:40])
+	if err != nil {
+		return nil, err
+	}
+	toA, err := newGCM(okm[40:72])
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{
+		id:       binary.BigEndian.Uint64(okm[:8]),
+		addr:     addr,
+		remoteID: remoteID,
+		send:     toA,
+		recv:     toB,
+		created:  now,
+		seen:     make(map[[12]byte]time.Time),
+	}
+	if initiator {
+		s.send, s.recv = toB, toA
+	}
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal wraps a packet as: type(1) | session id(8) | nonce(12) | sealed(time(8) | packet)
+func (s *udpSession) seal(packet []byte, now time.Time) ([]byte, error) {
+	buf := make([]byte, udpSealHeaderSize, udpSealHeaderSize+8+len(packet)+s.send.Overhead())
+	buf[0] = udpSealedPacket
+	binary.BigEndian.PutUint64(buf[1:9], s.id)
+	if _, err := crand.Read(buf[9:udpSealHeaderSize]); err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 8, 8+len(packet))
+	binary.BigEndian.PutUint64(plain, uint64(now.UnixNano()))
+	plain = append(plain, packet...)
+	return s.send.Seal(buf, buf[9:udpSealHeaderSize], plain, buf[:9]), nil
+}
+
+// open returns the packet sealed in buf, refusing the packets
+// stamped out of the window and the nonces already received
+func (s *udpSession) open(buf []byte, now time.Time) ([]byte, error) {
+	if len(buf) < udpSealHeaderSize {
+		return nil, UDP_PACKET_ERR
+	}
+	var nonce [12]byte
+	copy(nonce[:], buf[9:udpSealHeaderSize])
+	plain, err := s.recv.Open(nil, nonce[:], buf[udpSealHeaderSize:], buf[:9])
+	if err != nil || len(plain) < 8 {
+		return nil, UDP_AUTH_ERR
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(plain)))
+	if !inAuthWindow(sent, now) {
+		return nil, UDP_REPLAY_ERR
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.seen[nonce]; ok {
+		return nil, UDP_REPLAY_ERR
+	}
+	if len(s.seen) >= 1024 {
+		// stamps refused from then on, the nonces are not needed
+		for n, forget := range s.seen {
+			if now.After(forget) {
+				delete(s.seen, n)
+			}
+		}
+	}
+	s.seen[nonce] = sent.Add(udpAuthWindow)
+	return plain[8:], nil
+}
+
+func inAuthWindow(t, now time.Time) bool {
+	d := now.Sub(t)
+	return d < udpAuthWindow && d > -udpAuthWindow
+}
+
+// sessionNode is the sender of a request in a session, its id is authenticated
+type sessionNode struct {
+	*Node
+}
+
+func (sessionNode) Authenticated() bool {
+	return true
+}
+
+// udpResponderState is kept by the responder of a handshake
+// between its challenge and the auth packet
+type udpResponderState struct {
+	addr      string
+	ephemeral *ecdh.PrivateKey
+	hello     *udpHandshake
+	challenge *udpHandshake
+}
+
+// udpDial is a handshake in progress, shared by the requests waiting for it
+type udpDial struct {
+	done chan struct{}
+	s    *udpSession
+	err  error
+}
+
+func randomNonce() []byte {
+	nonce := make([]byte, udpNonceSize)
+	crand.Read(nonce)
+	return nonce
+}
+
+func (u *UDP) hashLength() int {
+	self, _ := u.serving()
+	if self == nil {
+		return DefaultHashLength
+	}
+	return len(self.GetID())
+}
+
+// session returns the session with to, a handshake is done when there is
+// none or it's too old. Concurrent requests share the handshake, which
+// expects the id of the first of them, see handshake
+func (u *UDP) session(cctx ctx.Context, to *net.UDPAddr, id Hash) (*udpSession, error) {
+	addr := to.String()
+	u.mutex.Lock()
+	if s := u.byAddr[addr]; s != nil && u.now().Sub(s.created) < udpSessionLifetime {
+		u.mutex.Unlock()
+		return s, nil
+	}
+	d := u.dialing[addr]
+	if d == nil {
+		d = &udpDial{done: make(chan struct{})}
+		u.dialing[addr] = d
+		go func() {
+			d.s, d.err = u.handshake(to, id)
+			u.mutex.Lock()
+			delete(u.dialing, addr)
+			u.mutex.Unlock()
+			close(d.done)
+		}()
+	}
+	u.mutex.Unlock()
+	select {
+	case <-d.done:
+		return d.s, d.err
+	case <-cctx.Done():
+		return nil, cctx.Err()
+	case <-u.closing:
+		return nil, UDP_CLOSED_ERR
+	}
+}
+
+// handshake authenticates the node at to and proves it our key:
+// hello -> challenge signed by it, auth signed by us -> ack.
+// A key other than the one of id, when set, fails it before the auth
+func (u *UDP) handshake(to *net.UDPAddr, id Hash) (*udpSession, error) {
+	eph, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := &udpHandshake{Ephemeral: eph.PublicKey().Bytes(), Nonce: randomNonce(), Time: u.now().UnixNano()}
+	rsp, err := u.send(ctx.Background(), to, nil, udpHelloPacket, &udpPacket{Handshake: hello}, udpChallengePacket)
+	if err != nil {
+		return nil, err
+	}
+	ch := rsp.Handshake
+	if ch == nil || len(ch.Nonce) != udpNonceSize || !inAuthWindow(time.Unix(0, ch.Time), u.now()) {
+		return nil, UDP_AUTH_ERR
+	}
+	transcript := handshakeTranscript("challenge", hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, ch.Time)
+	if err := verifySig(ch.Scheme, ch.PubKey, transcript, ch.Sig); err != nil {
+		return nil, errors.Wrap(UDP_AUTH_ERR, err.Error())
+	}
+	if remote := IDFromPubKey(ch.PubKey, u.hashLength()); id != nil && !remote.Equal(id) {
+		return nil, errors.Wrapf(UDP_AUTH_ERR, "node %x at %v, not %x", remote, to, id)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(ch.Ephemeral)
+	if err != nil {
+		return nil, errors.Wrap(UDP_AUTH_ERR, err.Error())
+	}
+	shared, err := eph.ECDH(peer)
+	if err != nil {
+		return nil, errors.Wrap(UDP_AUTH_ERR, err.Error())
+	}
+
+	auth := &udpHandshake{Ephemeral: hello.Ephemeral, Time: u.now().UnixNano(), Scheme: u.key.Scheme(), PubKey: u.key.PubKey()}
+	if auth.Sig, err = u.key.Sign(handshakeTranscript("auth", hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, auth.Time)); err != nil {
+		return nil, err
+	}
+	if _, err := u.send(ctx.Background(), to, nil, udpAuthPacket, &udpPacket{Handshake: auth}, udpAuthAckPacket); err != nil {
+		return nil, err
+	}
+	s, err := newUDPSession(to.String(), IDFromPubKey(ch.PubKey, u.hashLength()), shared,
+		hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, true, u.now())
+	if err != nil {
+		return nil, err
+	}
+	u.addSession(s)
+	return s, nil
+}
+
+// handleHello answers a hello with a challenge and waits for the auth
+func (u *UDP) handleHello(from *net.UDPAddr, reqID uint64, hello *udpHandshake) {
+	if hello == nil || len(hello.Nonce) != udpNonceSize || !inAuthWindow(time.Unix(0, hello.Time), u.now()) {
+		return
+	}
+	u.mutex.Lock()
+	allowed := u.hellos.take(from.IP.String(), u.now())
+	u.mutex.Unlock()
+	if !allowed {
+		log.Println("udp drop hello, rate limited", "from", from)
+		return
+	}
+	eph, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return
+	}
+	ch := &udpHandshake{
+		Ephemeral: eph.PublicKey().Bytes(),
+		Nonce:     randomNonce(),
+		Time:      u.now().UnixNano(),
+		Scheme:    u.key.Scheme(),
+		PubKey:    u.key.PubKey(),
+	}
+	if ch.Sig, err = u.key.Sign(handshakeTranscript("challenge", hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, ch.Time)); err != nil {
+		log.Println("udp sign challenge err", "err", err)
+		return
+	}
+	u.mutex.Lock()
+	for k, st := range u.handshakes {
+		if !inAuthWindow(time.Unix(0, st.challenge.Time), u.now()) {
+			delete(u.handshakes, k)
+		}
+	}
+	if len(u.handshakes) >= udpMaxHandshakes {
+		var oldest string
+		for k, st := range u.handshakes {
+			if oldest == "" || st.challenge.Time < u.handshakes[oldest].challenge.Time {
+				oldest = k
+			}
+		}
+		delete(u.handshakes, oldest)
+	}
+	u.handshakes[string(hello.Ephemeral)] = &udpResponderState{addr: from.String(), ephemeral: eph, hello: hello, challenge: ch}
+	u.mutex.Unlock()
+	u.reply(from, nil, udpChallengePacket, reqID, &udpPacket{Handshake: ch})
+}
+
+// handleAuth checks the signature of the initiator over our challenge
+// and opens the session
+func (u *UDP) handleAuth(from *net.UDPAddr, reqID uint64, auth *udpHandshake) {
+	if auth == nil || !inAuthWindow(time.Unix(0, auth.Time), u.now()) {
+		return
+	}
+	u.mutex.Lock()
+	st := u.handshakes[string(auth.Ephemeral)]
+	if st == nil || st.addr != from.String() {
+		u.mutex.Unlock()
+		return
+	}
+	delete(u.handshakes, string(auth.Ephemeral))
+	u.mutex.Unlock()
+
+	hello, ch := st.hello, st.challenge
+	transcript := handshakeTranscript("auth", hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, auth.Time)
+	if err := verifySig(auth.Scheme, auth.PubKey, transcript, auth.Sig); err != nil {
+		log.Println("udp drop auth", "from", from, "err", err)
+		return
+	}
+	peer, err := ecdh.X25519().NewPublicKey(hello.Ephemeral)
+	if err != nil {
+		return
+	}
+	shared, err := st.ephemeral.ECDH(peer)
+	if err != nil {
+		return
+	}
+	s, err := newUDPSession(from.String(), IDFromPubKey(auth.PubKey, u.hashLength()), shared,
+		hello.Ephemeral, ch.Ephemeral, hello.Nonce, ch.Nonce, false, u.now())
+	if err != nil {
+		return
+	}
+	u.addSession(s)
+	u.reply(from, nil, udpAuthAckPacket, reqID, &udpPacket{})
+}
+
+// addSession makes s the session with its address,
+// the expired sessions and then the oldest ones are dropped
+func (u *UDP) addSession(s *udpSession) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.sessions) >= udpMaxSessions {
+		var oldest *udpSession
+		for _, o := range u.sessions {
+			if u.now().Sub(o.created) > udpSessionLifetime+udpAuthWindow {
+				u.dropSession(o)
+			} else if oldest == nil || o.created.Before(oldest.created) {
+				oldest = o
+			}
+		}
+		if len(u.sessions) >= udpMaxSessions && oldest != nil {
+			u.dropSession(oldest)
+		}
+	}
+	u.sessions[s.id] = s
+	u.byAddr[s.addr] = s
+}
+
+func (u *UDP) dropSession(s *udpSession) {
+	delete(u.sessions, s.id)
+	if u.byAddr[s.addr] == s {
+		delete(u.byAddr, s.addr)
+	}
+}
+
+// openSealed finds the session of a sealed packet from its address
+// and returns the packet inside
+func (u *UDP) openSealed(from *net.UDPAddr, buf []byte) (*udpSession, []byte, error) {
+	if len(buf) < udpSealHeaderSize {
+		return nil, nil, UDP_PACKET_ERR
+	}
+	u.mutex.Lock()
+	s := u.sessions[binary.BigEndian.Uint64(buf[1:9])]
+	u.mutex.Unlock()
+	if s == nil || s.addr != from.String() || u.now().Sub(s.created) > udpSessionLifetime+udpAuthWindow {
+		return nil, nil, UDP_AUTH_ERR
+	}
+	packet, err := s.open(buf, u.now())
+	return s, packet, err
+}
+
+// proven reports whether the answers to from can't be amplified against
+// a victim: it authenticated, or it answered one of our pings lately
+func (u *UDP) proven(from *net.UDPAddr, s *udpSession) bool {
+	if s != nil {
+		return true
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	at, ok := u.proofs[from.String()]
+	return ok && u.now().Sub(at) < udpProofLifetime
+}
+
+// putProof records the proof of addr in proofs, the expired proofs and
+// then the oldest one are dropped over udpMaxProofs. u.mutex must be held
+func (u *UDP) putProof(proofs map[string]time.Time, addr string) {
+	if _, ok := proofs[addr]; !ok && len(proofs) >= udpMaxProofs {
+		var oldest string
+		for a, at := range proofs {
+			if u.now().Sub(at) >= udpProofLifetime {
+				delete(proofs, a)
+			} else if oldest == "" || at.Before(proofs[oldest]) {
+				oldest = a
+			}
+		}
+		if len(proofs) >= udpMaxProofs {
+			delete(proofs, oldest)
+		}
+	}
+	proofs[addr] = u.now()
+}
+
+// pingBack pings to in the background so that it gets proven,
+// one ping at a time
+func (u *UDP) pingBack(to *net.UDPAddr) {
+	addr := to.String()
+	u.mutex.Lock()
+	if u.pingingBack[addr] {
+		u.mutex.Unlock()
+		return
+	}
+	if len(u.pingingBack) >= udpMaxPingBacks {
+		// it may ping us again later
+		u.mutex.Unlock()
+		return
+	}
+	u.pingingBack[addr] = true
+	u.mutex.Unlock()
+	go func() {
+		u.Ping(addr)
+		u.mutex.Lock()
+		delete(u.pingingBack, addr)
+		u.mutex.Unlock()
+	}()
+}
+
+// provedBy records that from got a pong from us, it
+// proved our endpoint, and wakes the requests waiting for it
+func (u *UDP) provedBy(from *net.UDPAddr) {
+	addr := from.String()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.putProof(u.provenBy, addr)
+	for _, w := range u.waiters[addr] {
+		close(w)
+	}
+	delete(u.waiters, addr)
+}
+
+// bond makes sure the node at to answers our findnodes: when it didn't
+// prove our endpoint lately we ping it, and unless the pong tells we
+// are proven it pings us back. Sessions prove endpoints by themselves
+func (u *UDP) bond(cctx ctx.Context, to *net.UDPAddr) error {
+	if u.key != nil {
+		return nil
+	}
+	addr := to.String()
+	wait := make(chan struct{})
+	u.mutex.Lock()
+	if at, ok := u.provenBy[addr]; ok && u.now().Sub(at) < udpProofLifetime {
+		u.mutex.Unlock()
+		return nil
+	}
+	u.waiters[addr] = append(u.waiters[addr], wait)
+	timeout := u.timeout
+	u.mutex.Unlock()
+	defer u.dropWaiter(addr, wait)
+
+	self, _ := u.serving()
+	rsp, err := u.send(cctx, to, nil, udpPingPacket, &udpPacket{From: self}, udpPongPacket)
+	if err != nil {
+		return err
+	}
+	if rsp.Proven {
+		u.mutex.Lock()
+		u.putProof(u.provenBy, addr)
+		u.mutex.Unlock()
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wait:
+	case <-timer.C:
+		// it may not ping back, try anyway
+	case <-cctx.Done():
+		return cctx.Err()
+	case <-u.closing:
+		return UDP_CLOSED_ERR
+	}
+	return nil
+}
+
+func (u *UDP) dropWaiter(addr string, wait chan struct{}) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	ws := u.waiters[addr]
+	for i, w := range ws {
+		if w == wait {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(u.waiters, addr)
+	} else {
+		u.waiters[addr] = ws
+	}
+}
@@ -0,0 +1,234 @@
+package routing
+
+import (
+	ctx "context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPSessionSeal(t *testing.T) {
+	shared, ephA, ephB, nonceA, nonceB := randomNonce(), randomNonce(), randomNonce(), randomNonce(), randomNonce()
+	now := time.Now()
+	a, err := newUDPSession("b", nil, shared, ephA, ephB, nonceA, nonceB, true, now)
+	require.Nil(t, err)
+	b, err := newUDPSession("a", nil, shared, ephA, ephB, nonceA, nonceB, false, now)
+	require.Nil(t, err)
+	assert.Equal(t, a.id, b.id)
+
+	sealed, err := a.seal([]byte("ping"), now)
+	require.Nil(t, err)
+	got, err := b.open(sealed, now)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("ping"), got)
+	_, err = b.open(sealed, now.Add(time.Second))
+	assert.Equal(t, UDP_REPLAY_ERR, err)
+	// a packet can't be opened by its sender
+	_, err = a.open(sealed, now)
+	assert.Equal(t, UDP_AUTH_ERR, err)
+
+	sealed, err = b.seal([]byte("pong"), now)
+	require.Nil(t, err)
+	sealed[len(sealed)-1] ^= 1
+	_, err = a.open(sealed, now)
+	assert.Equal(t, UDP_AUTH_ERR, err)
+	sealed[len(sealed)-1] ^= 1
+	_, err = a.open(sealed, now.Add(udpAuthWindow))
+	assert.Equal(t, UDP_REPLAY_ERR, err)
+	got, err = a.open(sealed, now.Add(udpAuthWindow/2))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("pong"), got)
+}
+
+// newAuthUDPTablesForTest is newUDPTablesForTest with authenticated
+// transports, the ids derive from the keys of the tables
+func newAuthUDPTablesForTest(t *testing.T, num int) ([]*UDP, []*Table) {
+	udps := make([]*UDP, num)
+	keys := make([]PrivKey, num)
+	for i := range udps {
+		key, err := GenerateKey(SchemeEd25519)
+		require.Nil(t, err)
+		u, err := ListenUDPAuth("127.0.0.1:0", key)
+		require.Nil(t, err, "listen udp err")
+		udps[i], keys[i] = u, key
+	}
+	tabs := make([]*Table, num)
+	for i := range tabs {
+		next := (i + 1) % num
+		boot := []INode{NewNode(IDFromPubKey(keys[next].PubKey(), DefaultHashLength), udps[next].LocalAddr())}
+		cfg := DefaultConfig()
+		cfg.PrivateKey = keys[i]
+		tb, err := NewTable(udps[i], IDFromPubKey(keys[i].PubKey(), DefaultHashLength), udps[i].LocalAddr(), "", boot, cfg)
+		require.Nil(t, err, "new table err")
+		tabs[i] = tb
+	}
+	return udps, tabs
+}
+
+func TestUDPAuth(t *testing.T) {
+	initTest()
+	udps, tabs := newAuthUDPTablesForTest(t, 3)
+	defer closeUDPTablesForTest(udps, tabs)
+
+	nodes, err := udps[0].FindNode(ctx.Background(), udps[1].LocalAddr(), tabs[2].self.GetID())
+	require.Nil(t, err, "findnode err")
+	var found bool
+	for _, n := range nodes {
+		found = found || n.GetID().Equal(tabs[2].self.GetID())
+	}
+	assert.True(t, found, "neighbors miss the target")
+	// both sides authenticated the other
+	assert.NotNil(t, tabs[1].getNodeLocally(tabs[0].self.GetID()))
+	to, _ := net.ResolveUDPAddr("udp", udps[1].LocalAddr())
+	s, err := udps[0].session(ctx.Background(), to, nil)
+	require.Nil(t, err)
+	assert.True(t, s.remoteID.Equal(tabs[1].self.GetID()))
+	require.Nil(t, udps[0].Ping(udps[1].LocalAddr()))
+	udps[0].mutex.Lock()
+	assert.Len(t, udps[0].sessions, 1)
+	udps[0].mutex.Unlock()
+
+	// a node can't claim the id of another in its session
+	udps[0].SetTimeout(100 * time.Millisecond)
+	fake := NewNode(tabs[2].self.GetID(), udps[0].LocalAddr())
+	_, err = udps[0].send(ctx.Background(), to, s, udpPingPacket, &udpPacket{From: fake}, udpPongPacket)
+	assert.Equal(t, UDP_TIMEOUT_ERR, err)
+
+	// the node answering must be the one expected, in a session or in the handshake
+	wrong := WithNodeID(ctx.Background(), tabs[2].self.GetID())
+	assert.Equal(t, UDP_AUTH_ERR, errors.Cause(udps[0].PingContext(wrong, udps[1].LocalAddr())))
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	fresh, err := ListenUDPAuth("127.0.0.1:0", key)
+	require.Nil(t, err)
+	defer fresh.Close()
+	_, err = fresh.FindNode(wrong, udps[1].LocalAddr(), tabs[0].self.GetID())
+	assert.Equal(t, UDP_AUTH_ERR, errors.Cause(err))
+	fresh.mutex.Lock()
+	assert.Len(t, fresh.sessions, 0)
+	fresh.mutex.Unlock()
+	require.Nil(t, udps[0].PingContext(WithNodeID(ctx.Background(), tabs[1].self.GetID()), udps[1].LocalAddr()))
+
+	// plain packets are refused
+	plain, err := ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer plain.Close()
+	plain.SetTimeout(100 * time.Millisecond)
+	assert.Equal(t, UDP_TIMEOUT_ERR, plain.Ping(udps[1].LocalAddr()))
+}
+
+func TestUDPHelloLimit(t *testing.T) {
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	u, err := ListenUDPAuth("127.0.0.1:0", key)
+	require.Nil(t, err)
+	defer u.Close()
+	now := time.Now()
+	u.now = func() time.Time {
+		now = now.Add(time.Microsecond)
+		return now
+	}
+	hello := func(host string) {
+		from := &net.UDPAddr{IP: net.ParseIP(host), Port: 9}
+		u.handleHello(from, 1, &udpHandshake{Ephemeral: randomNonce(), Nonce: randomNonce(), Time: u.now().UnixNano()})
+	}
+	pending := func() int {
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		return len(u.handshakes)
+	}
+
+	// a host gets a burst of challenges
+	for i := 0; i < udpHelloLimit.Burst+2; i++ {
+		hello("10.0.0.1")
+	}
+	assert.Equal(t, udpHelloLimit.Burst, pending())
+
+	// the oldest handshakes make room for new ones
+	u.mutex.Lock()
+	var first string
+	for k, st := range u.handshakes {
+		if first == "" || st.challenge.Time < u.handshakes[first].challenge.Time {
+			first = k
+		}
+	}
+	u.mutex.Unlock()
+	for i := 0; pending() < udpMaxHandshakes; i++ {
+		hello(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	hello("10.2.0.1")
+	assert.Equal(t, udpMaxHandshakes, pending())
+	u.mutex.Lock()
+	_, ok := u.handshakes[first]
+	u.mutex.Unlock()
+	assert.False(t, ok, "oldest handshake kept")
+}
+
+func TestUDPProofLimits(t *testing.T) {
+	u, err := ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer u.Close()
+	now := time.Now()
+	u.now = func() time.Time {
+		now = now.Add(time.Microsecond)
+		return now
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	// the oldest proof makes room for a new one
+	for i := 0; i < udpMaxProofs; i++ {
+		u.putProof(u.provenBy, fmt.Sprintf("10.1.%d.%d:9", i/256, i%256))
+	}
+	u.putProof(u.provenBy, "10.2.0.1:9")
+	assert.Len(t, u.provenBy, udpMaxProofs)
+	_, ok := u.provenBy["10.1.0.0:9"]
+	assert.False(t, ok, "oldest proof kept")
+
+	// and the expired ones are all dropped
+	now = now.Add(udpProofLifetime)
+	u.putProof(u.provenBy, "10.2.0.2:9")
+	u.putProof(u.provenBy, "10.2.0.3:9")
+	assert.Len(t, u.provenBy, 2)
+
+	// pings back in flight are bounded
+	for i := 0; i < udpMaxPingBacks; i++ {
+		u.pingingBack[fmt.Sprintf("10.3.0.%d:9", i)] = true
+	}
+	u.mutex.Unlock()
+	u.pingBack(&net.UDPAddr{IP: net.ParseIP("10.4.0.1"), Port: 9})
+	u.mutex.Lock()
+	assert.Len(t, u.pingingBack, udpMaxPingBacks)
+}
+
+func TestUDPEndpointProof(t *testing.T) {
+	initTest()
+	udps, tabs := newUDPTablesForTest(t, 1)
+	defer closeUDPTablesForTest(udps, tabs)
+	to, _ := net.ResolveUDPAddr("udp", udps[0].LocalAddr())
+
+	// a findnode from an unproven address gets no answer but a ping
+	u, err := ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	defer u.Close()
+	u.SetTimeout(100 * time.Millisecond)
+	req := &udpPacket{Target: randHashForTest()}
+	_, err = u.send(ctx.Background(), to, nil, udpFindNodePacket, req, udpNeighborsPacket)
+	assert.Equal(t, UDP_TIMEOUT_ERR, err)
+	from, _ := net.ResolveUDPAddr("udp", u.LocalAddr())
+	assert.True(t, udps[0].proven(from, nil), "not proven by the ping back")
+	_, err = u.send(ctx.Background(), to, nil, udpFindNodePacket, req, udpNeighborsPacket)
+	assert.Nil(t, err)
+
+	// bonding pings first, the pong tells we are proven
+	u.mutex.Lock()
+	u.provenBy = make(map[string]time.Time)
+	u.mutex.Unlock()
+	_, err = u.FindNode(ctx.Background(), udps[0].LocalAddr(), randHashForTest())
+	assert.Nil(t, err)
+}
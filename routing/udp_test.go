@@ -0,0 +1,187 @@
+package routing
+
+import (
+	ctx "context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUDPTablesForTest builds num tables on 127.0.0.1,
+// table i is bootstrapped with table i+1 only
+func newUDPTablesForTest(t *testing.T, num int) ([]*UDP, []*Table) {
+	udps := make([]*UDP, num)
+	ids := make([]Hash, num)
+	for i := range udps {
+		u, err := ListenUDP("127.0.0.1:0")
+		require.Nil(t, err, "listen udp err")
+		udps[i] = u
+		ids[i] = randHashForTest()
+	}
+	tabs := make([]*Table, num)
+	for i := range tabs {
+		next := (i + 1) % num
+		boot := []INode{NewNode(ids[next], udps[next].LocalAddr())}
+		tb, err := NewTable(udps[i], ids[i], udps[i].LocalAddr(), "", boot, nil)
+		require.Nil(t, err, "new table err")
+		tabs[i] = tb
+	}
+	return udps, tabs
+}
+
+func closeUDPTablesForTest(udps []*UDP, tabs []*Table) {
+	for i := range udps {
+		udps[i].Close()
+		tabs[i].db.close()
+	}
+}
+
+func TestUDPPacketCodec(t *testing.T) {
+	initTest()
+	from := NewNode(randHashForTest(), "127.0.0.1:30303")
+	req := &udpPacket{
+		From:   from,
+		Target: randHashForTest(),
+		Nodes:  []*Node{NewNode(randHashForTest(), "127.0.0.1:30304")},
+	}
+	buf, err := encodePacket(udpNeighborsPacket, 42, req)
+	require.Nil(t, err, "encode err")
+
+	ptype, reqID, got, err := decodePacket(buf)
+	require.Nil(t, err, "decode err")
+	assert.Equal(t, udpNeighborsPacket, ptype)
+	assert.Equal(t, uint64(42), reqID)
+	assert.True(t, got.From.Equal(from))
+	assert.True(t, got.Target.Equal(req.Target))
+	require.Len(t, got.Nodes, 1)
+	assert.True(t, got.Nodes[0].Equal(req.Nodes[0]))
+
+	_, _, _, err = decodePacket(buf[:udpHeaderSize-1])
+	assert.Equal(t, UDP_PACKET_ERR, err)
+	buf[0] = 0
+	_, _, _, err = decodePacket(buf)
+	assert.Equal(t, UDP_PACKET_ERR, err)
+}
+
+func TestUDPPing(t *testing.T) {
+	initTest()
+	udps, tabs := newUDPTablesForTest(t, 2)
+	defer closeUDPTablesForTest(udps, tabs)
+
+	require.Nil(t, udps[0].Ping(udps[1].LocalAddr()))
+	// the pinged side learns about the sender
+	assert.NotNil(t, tabs[1].getNodeLocally(tabs[0].self.GetID()))
+
+	// nobody answers on a closed socket
+	dead, err := ListenUDP("127.0.0.1:0")
+	require.Nil(t, err)
+	deadAddr := dead.LocalAddr()
+	dead.Close()
+	udps[0].SetTimeout(100 * time.Millisecond)
+	assert.NotNil(t, udps[0].Ping(deadAddr))
+}
+
+func TestUDPSender(t *testing.T) {
+	key, err := GenerateKey(SchemeEd25519)
+	require.Nil(t, err)
+	rec := signedRecordForTest(t, key, 1, "1.2.3.4:30303/26656")
+	bogus, err := ParseEndpoint("6.6.6.6:30303/26656")
+	require.Nil(t, err)
+	from := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 30303}
+
+	// unsigned endpoints are dropped when there is a record
+	p := &udpPacket{From: &Node{ID: rec.ID, Addr: "1.2.3.4:30303", Record: rec, Endpoints: []Endpoint{bogus}}}
+	n := sender(from, p).(*Node)
+	assert.Equal(t, endpointsFromAddrs(rec.Addrs), n.Endpoints)
+	assert.Equal(t, endpointsFromAddrs(rec.Addrs), n.GetEndpoints())
+
+	p.From.Record = nil
+	n = sender(from, p).(*Node)
+	assert.Equal(t, []Endpoint{bogus}, n.Endpoints)
+}
+
+func TestUDPFindNodeContext(t *testing.T) {
+	initTest()
+	udps, tabs := newUDPTablesForTest(t, 1)
+	defer closeUDPTablesForTest(udps, tabs)
+
+	// a socket that reads requests but never replies
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer silent.Close()
+
+	udps[0].SetTimeout(time.Minute)
+	cctx, cancel := ctx.WithTimeout(ctx.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = udps[0].FindNode(cctx, silent.LocalAddr().String(), randHashForTest())
+	assert.Equal(t, ctx.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Minute/2, "findnode ignored the context")
+}
+
+func TestUDPGetNodeByNet(t *testing.T) {
+	initTest()
+	// A{B},B{C},C{A}
+	udps, tabs := newUDPTablesForTest(t, 3)
+	defer closeUDPTablesForTest(udps, tabs)
+
+	nodes, err := udps[0].FindNode(ctx.Background(), udps[1].LocalAddr(), tabs[2].self.GetID())
+	require.Nil(t, err, "findnode err")
+	var found bool
+	for _, n := range nodes {
+		if n.GetID().Equal(tabs[2].self.GetID()) {
+			found = true
+		}
+	}
+	assert.True(t, found, "neighbors miss the target")
+
+	for i := range tabs {
+		for j := range tabs {
+			if i == j {
+				continue
+			}
+			addr := tabs[i].GetNodeAddr(tabs[j].self.GetID())
+			assert.Equal(t, udps[j].LocalAddr(), addr, "table %v can't resolve table %v", i, j)
+		}
+	}
+}
+
+func TestUDPNetwork(t *testing.T) {
+	initTest()
+	udps := make([]*UDP, 2)
+	for i, network := range []string{"mainnet", "testnet"} {
+		u, err := ListenUDP("127.0.0.1:0")
+		require.Nil(t, err)
+		defer u.Close()
+		u.SetTimeout(100 * time.Millisecond)
+		cfg := DefaultConfig()
+		cfg.NetworkID = network
+		tab, err := NewTable(u, randHashForTest(), u.LocalAddr(), "", nil, cfg)
+		require.Nil(t, err)
+		defer tab.db.close()
+		udps[i] = u
+	}
+	assert.Equal(t, UDP_TIMEOUT_ERR, udps[0].Ping(udps[1].LocalAddr()))
+	_, err := udps[0].FindNode(ctx.Background(), udps[1].LocalAddr(), randHashForTest())
+	assert.Equal(t, UDP_TIMEOUT_ERR, err)
+}
+
+func TestUDPBannedPing(t *testing.T) {
+	initTest()
+	udps, tabs := newUDPTablesForTest(t, 2)
+	defer closeUDPTablesForTest(udps, tabs)
+	udps[0].SetTimeout(100 * time.Millisecond)
+	require.Nil(t, tabs[1].Ban(Ban{ID: tabs[0].self.GetID(), Reason: "test"}))
+	udps[1].mutex.Lock()
+	udps[1].provenBy = make(map[string]time.Time)
+	udps[1].mutex.Unlock()
+
+	// no pong, and the sender doesn't prove our endpoint
+	assert.Equal(t, UDP_TIMEOUT_ERR, udps[0].Ping(udps[1].LocalAddr()))
+	udps[1].mutex.Lock()
+	defer udps[1].mutex.Unlock()
+	assert.Len(t, udps[1].provenBy, 0)
+}